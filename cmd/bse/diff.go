@@ -0,0 +1,574 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Diff mode (bse -d a b) shows two files side by side with their lines
+// lined up: lines only one side has face a filler on the other, and lines
+// that differ are shown in pairs with the changed text marked. The two
+// windows scroll together, and long unchanged stretches are folded away
+// except round the cursor.
+const (
+	attrDiffAdd    = "\x1b[30;42m"
+	attrDiffChange = "\x1b[30;45m"
+	attrDiffText   = "\x1b[1;37;41m"
+	attrDiffFill   = "\x1b[34m"
+	attrFold       = "\x1b[36m"
+
+	diffContext = 6 // unchanged lines kept in view round each change
+)
+
+// diffState is the comparison between the buffers of two windows
+type diffState struct {
+	wins  [2]*window
+	rows  []diffRow
+	hunks []hunk
+	rowOf [2][]int // the row of each line on each side
+	seen  [2]int   // the change counts the rows were made from
+	lens  [2]int
+	view  []viewRow // the rows as shown, after folding
+	top   int       // the first of view on screen
+	fold  bool      // fold unchanged stretches (zM; zR opens them)
+}
+
+// diffRow is one row of the lined-up sides: the line on each side, -1 for a
+// filler, and the hunk it belongs to, -1 where the sides agree
+type diffRow struct {
+	line [2]int
+	hunk int
+}
+
+// hunk is a change: the lines [start, end) on each side
+type hunk struct {
+	start, end [2]int
+}
+
+// viewRow is a row on screen: a diff row, or n rows folded into one
+type viewRow struct {
+	row, n int
+}
+
+// startDiff compares the buffers of two windows
+func (e *editor) startDiff(a, b *window) {
+	e.diff = &diffState{wins: [2]*window{a, b}, fold: true}
+	e.diff.update()
+}
+
+// side returns which side of the diff w is, or -1
+func (d *diffState) side(w *window) int {
+	for s, dw := range d.wins {
+		if dw == w {
+			return s
+		}
+	}
+	return -1
+}
+
+// diffSide returns which side of the diff w shows, or -1 outside diff mode
+func (e *editor) diffSide(w *window) int {
+	if e.diff == nil {
+		return -1
+	}
+	return e.diff.side(w)
+}
+
+// stale reports whether either buffer changed since the rows were made
+func (d *diffState) stale() bool {
+	for s, w := range d.wins {
+		if w.changes != d.seen[s] || len(w.lines) != d.lens[s] {
+			return true
+		}
+	}
+	return false
+}
+
+// update compares the two sides again
+func (d *diffState) update() {
+	a, b := d.wins[0].lines, d.wins[1].lines
+	ids := map[string]int{}
+	hash := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i, l := range lines {
+			id, ok := ids[l]
+			if !ok {
+				id = len(ids)
+				ids[l] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+	d.rows, d.hunks = nil, nil
+	ai, bi := 0, 0
+	// change adds the hunk a[ai:ai+na], b[bi:bi+nb], pairing up its lines
+	change := func(na, nb int) {
+		if na == 0 && nb == 0 {
+			return
+		}
+		h := len(d.hunks)
+		d.hunks = append(d.hunks, hunk{[2]int{ai, bi}, [2]int{ai + na, bi + nb}})
+		for i := 0; i < max(na, nb); i++ {
+			r := diffRow{line: [2]int{-1, -1}, hunk: h}
+			if i < na {
+				r.line[0] = ai + i
+			}
+			if i < nb {
+				r.line[1] = bi + i
+			}
+			d.rows = append(d.rows, r)
+		}
+		ai, bi = ai+na, bi+nb
+	}
+	for _, p := range commonLines(hash(a), hash(b)) {
+		change(p[0]-ai, p[1]-bi)
+		d.rows = append(d.rows, diffRow{line: [2]int{ai, bi}, hunk: -1})
+		ai, bi = ai+1, bi+1
+	}
+	change(len(a)-ai, len(b)-bi)
+	d.rowOf = [2][]int{make([]int, len(a)), make([]int, len(b))}
+	for i, r := range d.rows {
+		for s := range r.line {
+			if r.line[s] >= 0 {
+				d.rowOf[s][r.line[s]] = i
+			}
+		}
+	}
+	for s, w := range d.wins {
+		d.seen[s], d.lens[s] = w.changes, len(w.lines)
+	}
+}
+
+// commonLines returns the pairs of indexes of the elements a and b keep in
+// common in a shortest edit script between them, found with Myers' O(ND)
+// algorithm after setting aside any common prefix and suffix
+func commonLines(a, b []int) [][2]int {
+	var pairs [][2]int
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pairs = append(pairs, [2]int{pre, pre})
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	for _, p := range myers(a[pre:len(a)-suf], b[pre:len(b)-suf]) {
+		pairs = append(pairs, [2]int{p[0] + pre, p[1] + pre})
+	}
+	for i := suf; i > 0; i-- {
+		pairs = append(pairs, [2]int{len(a) - i, len(b) - i})
+	}
+	return pairs
+}
+
+// myers is the core of commonLines, in the linear space form of the
+// algorithm: the middle snake of an optimal path splits the problem in two,
+// and each half is solved the same way. The diagonals searched take memory
+// in proportion to the input, not to its square.
+func myers(a, b []int) [][2]int {
+	var pairs [][2]int
+	off := (len(a)+len(b)+1)/2 + 1
+	vf, vb := make([]int, 2*off+1), make([]int, 2*off+1)
+	var solve func(a0, a1, b0, b1 int)
+	solve = func(a0, a1, b0, b1 int) {
+		for a0 < a1 && b0 < b1 && a[a0] == b[b0] {
+			pairs = append(pairs, [2]int{a0, b0})
+			a0, b0 = a0+1, b0+1
+		}
+		suf := 0
+		for a1 > a0 && b1 > b0 && a[a1-1] == b[b1-1] {
+			a1, b1, suf = a1-1, b1-1, suf+1
+		}
+		if a0 < a1 && b0 < b1 {
+			x, y, u, v := middleSnake(a, b, a0, a1, b0, b1, vf, vb, off)
+			solve(a0, x, b0, y)
+			for ; x < u; x, y = x+1, y+1 {
+				pairs = append(pairs, [2]int{x, y})
+			}
+			solve(u, a1, v, b1)
+		}
+		for i := 0; i < suf; i++ {
+			pairs = append(pairs, [2]int{a1 + i, b1 + i})
+		}
+	}
+	solve(0, len(a), 0, len(b))
+	return pairs
+}
+
+// middleSnake finds the snake (x, y) to (u, v) in the middle of a shortest
+// edit script from a[a0:a1] to b[b0:b1], searching forward from the start
+// and backward from the end until the two meet. The ends differ and
+// neither slice is empty, so both halves it leaves are smaller. vf and vb
+// hold the furthest x on each diagonal k at index off+k, the backward one
+// counted from the end.
+func middleSnake(a, b []int, a0, a1, b0, b1 int, vf, vb []int, off int) (x, y, u, v int) {
+	n, m := a1-a0, b1-b0
+	delta := n - m
+	odd := delta%2 != 0
+	vf[off+1], vb[off+1] = 0, 0
+	for d := 0; d <= (n+m+1)/2; d++ {
+		for k := -d; k <= d; k += 2 {
+			x := vf[off+k+1] // down: a line of b inserted
+			if k != -d && (k == d || vf[off+k-1] >= vf[off+k+1]) {
+				x = vf[off+k-1] + 1 // right: a line of a deleted
+			}
+			sx := x
+			for x < n && x-k < m && a[a0+x] == b[b0+x-k] {
+				x++
+			}
+			vf[off+k] = x
+			if kb := delta - k; odd && kb >= -(d-1) && kb <= d-1 && x+vb[off+kb] >= n {
+				return a0 + sx, b0 + sx - k, a0 + x, b0 + x - k
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			x := vb[off+k+1]
+			if k != -d && (k == d || vb[off+k-1] >= vb[off+k+1]) {
+				x = vb[off+k-1] + 1
+			}
+			sx := x
+			for x < n && x-k < m && a[a1-1-x] == b[b1-1-(x-k)] {
+				x++
+			}
+			vb[off+k] = x
+			if kf := delta - k; !odd && kf >= -d && kf <= d && x+vf[off+kf] >= n {
+				return a1 - x, b1 - (x - k), a1 - sx, b1 - (sx - k)
+			}
+		}
+	}
+	panic("diff: the searches never met")
+}
+
+// layoutView folds the unchanged stretches of rows, leaving diffContext
+// lines next to each change and the stretch the cursor is in open
+func (d *diffState) layoutView(cursor int) {
+	d.view = d.view[:0]
+	for i := 0; i < len(d.rows); {
+		if d.rows[i].hunk >= 0 {
+			d.view = append(d.view, viewRow{i, 0})
+			i++
+			continue
+		}
+		j := i
+		for j < len(d.rows) && d.rows[j].hunk < 0 {
+			j++
+		}
+		s, t := i, j
+		if s > 0 {
+			s += diffContext
+		}
+		if t < len(d.rows) {
+			t -= diffContext
+		}
+		folded := d.fold && t-s > 1 && (cursor < s || cursor >= t)
+		for k := i; k < j; k++ {
+			if folded && k == s {
+				d.view = append(d.view, viewRow{s, t - s})
+				k = t - 1
+				continue
+			}
+			d.view = append(d.view, viewRow{k, 0})
+		}
+		i = j
+	}
+}
+
+// viewIndex returns the screen row of diff row r
+func (d *diffState) viewIndex(r int) int {
+	for i, v := range d.view {
+		if r >= v.row && r < v.row+max(v.n, 1) {
+			return i
+		}
+	}
+	return max(len(d.view)-1, 0)
+}
+
+// lineAt returns the line of side s nearest diff row r: the one on the row,
+// or above it, or failing that below
+func (d *diffState) lineAt(s, r int) int {
+	for i := min(r, len(d.rows)-1); i >= 0; i-- {
+		if l := d.rows[i].line[s]; l >= 0 {
+			return l
+		}
+	}
+	for i := r; i < len(d.rows); i++ {
+		if l := d.rows[i].line[s]; l >= 0 {
+			return l
+		}
+	}
+	return 0
+}
+
+// syncDiff brings the diff up to date before drawing: it compares the
+// buffers again if they changed, puts the other window's cursor on the line
+// facing this one's, and scrolls both together to keep the cursor in view.
+// The diff ends when either of its windows is closed.
+func (e *editor) syncDiff(height int) {
+	d := e.diff
+	for _, w := range d.wins {
+		if e.winIndexOf(w) < 0 {
+			e.diff = nil
+			return
+		}
+	}
+	if d.stale() {
+		d.update()
+	}
+	s := d.side(e.window)
+	if s < 0 {
+		d.layoutView(-1)
+		return
+	}
+	o := d.wins[1-s]
+	r := d.rowOf[s][min(e.row, len(e.lines)-1)]
+	d.layoutView(r)
+	o.row = d.lineAt(1-s, r)
+	o.col = min(o.col, len(o.lines[o.row]))
+	ci := d.viewIndex(r)
+	if ci < d.top {
+		d.top = ci
+	}
+	if ci >= d.top+height {
+		d.top = ci - height + 1
+	}
+	d.top = min(d.top, max(len(d.view)-1, 0))
+	vc, width := visualCol(e.lines[e.row], e.col), e.textWidth(e.window)
+	if vc < e.leftCol {
+		e.leftCol = vc
+	}
+	if vc >= e.leftCol+width {
+		e.leftCol = vc - width + 1
+	}
+	o.leftCol = e.leftCol
+}
+
+// winIndexOf returns the index of w in e.wins, or -1
+func (e *editor) winIndexOf(w *window) int {
+	for i, x := range e.wins {
+		if x == w {
+			return i
+		}
+	}
+	return -1
+}
+
+// drawDiff paints side s of the diff in its window
+func (e *editor) drawDiff(w *window, s, height int, hlRe *regexp.Regexp) {
+	d := e.diff
+	active := w == e.window
+	inVisual := active && e.inVisual()
+	sel := e.selection()
+	gutter := e.gutterWidth(w)
+	x, width := w.x+gutter, e.textWidth(w)
+	for i := 0; i < height; i++ {
+		if d.top+i >= len(d.view) {
+			e.scr.setSpan(i, w.x, w.w, "~", 0, nil)
+			continue
+		}
+		v := d.view[d.top+i]
+		r := d.rows[v.row]
+		all := make([]string, w.w)
+		if v.n > 0 {
+			paint(all, 0, 0, w.w, attrFold)
+			first := strings.TrimSpace(w.lines[r.line[s]])
+			e.scr.setSpan(i, w.x, w.w, fmt.Sprintf("+--%3d lines: %s", v.n, first), 0, all)
+			continue
+		}
+		l := r.line[s]
+		if l < 0 {
+			paint(all, 0, 0, w.w, attrDiffFill)
+			e.scr.setSpan(i, w.x, w.w, strings.Repeat("-", w.w), 0, all)
+			continue
+		}
+		line := w.lines[l]
+		if gutter > 0 {
+			num := e.lineNumber(w, l)
+			e.scr.setSpan(i, w.x, gutter, fmt.Sprintf("%*s ", gutter-1, num), 0, nil)
+			e.scr.setText(i, w.x, fmt.Sprintf("%*s", gutter-1, num), attrLineNr)
+		}
+		attrs := make([]string, width)
+		switch {
+		case r.hunk >= 0 && r.line[1-s] < 0:
+			paint(attrs, 0, 0, width, attrDiffAdd)
+		case r.hunk >= 0:
+			paint(attrs, 0, 0, width, attrDiffChange)
+			from, to := changedSpan(line, d.wins[1-s].lines[r.line[1-s]])
+			paint(attrs, w.leftCol, visualCol(line, from), max(visualCol(line, to), visualCol(line, from)+1), attrDiffText)
+		}
+		if active && !inVisual && l == w.row {
+			paint(attrs, 0, 0, width, attrReverse)
+		}
+		if hlRe != nil {
+			paintMatches(attrs, line, w.leftCol, hlRe)
+		}
+		if inVisual {
+			if from, to, ok := sel.span(line, l); ok {
+				paint(attrs, w.leftCol, from, to, attrReverse)
+			}
+		}
+		e.scr.setSpan(i, x, width, line, w.leftCol, attrs)
+	}
+}
+
+// changedSpan returns the part of a that differs from b, between their
+// common prefix and suffix
+func changedSpan(a, b string) (from, to int) {
+	for from < len(a) && from < len(b) && a[from] == b[from] {
+		from++
+	}
+	to = len(a)
+	for n := len(b); to > from && n > from && a[to-1] == b[n-1]; n-- {
+		to--
+	}
+	// keep to whole characters
+	for from > 0 && from < len(a) && !isRuneStart(a[from]) {
+		from--
+	}
+	for to < len(a) && !isRuneStart(a[to]) {
+		to++
+	}
+	return from, to
+}
+
+func isRuneStart(c byte) bool {
+	return c&0xc0 != 0x80
+}
+
+// diffCursor is where the terminal cursor goes in a diff window
+func (e *editor) diffCursor() (y, x int) {
+	d := e.diff
+	y = d.viewIndex(d.rowOf[d.side(e.window)][e.row]) - d.top
+	x = visualCol(e.lines[e.row], e.col) - e.leftCol
+	return y, e.x + e.gutterWidth(e.window) + min(max(x, 0), e.textWidth(e.window)-1)
+}
+
+// diffPlaceCursor puts the cursor where a diff window was clicked
+func (e *editor) diffPlaceCursor(x, y int) {
+	d := e.diff
+	s := d.side(e.window)
+	if len(d.view) == 0 {
+		return
+	}
+	v := d.view[min(max(d.top+y, 0), len(d.view)-1)]
+	e.row = d.lineAt(s, v.row)
+	x -= e.x + e.gutterWidth(e.window)
+	e.col = byteColAtVisual(e.lines[e.row], e.leftCol+min(max(x, 0), e.textWidth(e.window)-1))
+}
+
+// diffScroll scrolls both sides by n screen rows, taking the cursor along
+// when it would leave the screen
+func (e *editor) diffScroll(w *window, n, height int) {
+	d := e.diff
+	d.top = min(max(d.top+n, 0), max(len(d.view)-height, 0))
+	s := d.side(w)
+	ci := d.viewIndex(d.rowOf[s][w.row])
+	if ci < d.top || ci >= d.top+height {
+		v := d.view[min(min(max(ci, d.top), d.top+height-1), len(d.view)-1)]
+		w.row = d.lineAt(s, v.row)
+		w.col = min(w.col, len(w.lines[w.row]))
+	}
+}
+
+// diffJump is ]c and [c: the cursor goes to the start of the next (or
+// previous) change
+func (e *editor) diffJump(forward bool) {
+	d := e.diff
+	if d.stale() {
+		d.update()
+	}
+	s := d.side(e.window)
+	hunks := d.hunks
+	for n := range hunks {
+		i := n
+		if !forward {
+			i = len(hunks) - 1 - n
+		}
+		start := min(hunks[i].start[s], len(e.lines)-1)
+		if forward && start > e.row || !forward && start < e.row {
+			e.pushJump()
+			e.row, e.col = start, 0
+			e.moveCursor('^')
+			return
+		}
+	}
+	e.abortKeys()
+}
+
+// diffHunkAt returns the hunk the cursor is on in side s: one holding the
+// cursor line, or one with no lines on this side just above it
+func (d *diffState) diffHunkAt(s, row, lines int) (hunk, bool) {
+	for _, h := range d.hunks {
+		start, end := h.start[s], h.end[s]
+		if start == end && start == lines {
+			start-- // a change past the last line belongs to it
+		}
+		if row >= start && row < max(end, start+1) {
+			return h, true
+		}
+	}
+	return hunk{}, false
+}
+
+// diffGet is do and dp: the other side's lines of the change under the
+// cursor replace this side's, or with put set the other way round
+func (e *editor) diffGet(put bool) error {
+	d := e.diff
+	if d.stale() {
+		d.update()
+	}
+	s := d.side(e.window)
+	h, ok := d.diffHunkAt(s, e.row, len(e.lines))
+	if !ok {
+		return errors.New("E101: No difference here")
+	}
+	from, to := 1-s, s
+	if put {
+		from, to = s, 1-s
+	}
+	src := d.wins[from]
+	text := append([]string(nil), src.lines[h.start[from]:h.end[from]]...)
+	cur := e.window
+	e.window = d.wins[to]
+	e.saveSnapshot()
+	lines := append(append(append([]string(nil), e.lines[:h.start[to]]...), text...), e.lines[h.end[to]:]...)
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	e.lines = lines
+	e.modified = true
+	if !put {
+		e.row = min(h.start[to], len(e.lines)-1)
+		e.col = 0
+	}
+	e.window = cur
+	return nil
+}
+
+// diffCommand handles the keys diff mode adds to normal mode: ]c, [c, do,
+// dp, and zR and zM to open and close the folds. It reports whether k
+// started one of them; any other key read is put back.
+func (e *editor) diffCommand(k rune) bool {
+	if e.diffSide(e.window) < 0 {
+		return false
+	}
+	next := e.readKey()
+	switch {
+	case (k == ']' || k == '[') && next == 'c':
+		e.diffJump(k == ']')
+	case k == 'd' && (next == 'o' || next == 'p'):
+		if err := e.diffGet(next == 'p'); err != nil {
+			e.status = err.Error()
+			e.abortKeys()
+		}
+	case k == 'z' && (next == 'R' || next == 'M'):
+		e.diff.fold = next == 'M'
+	default:
+		e.unreadKey(next)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,819 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// mark is a saved cursor position
+type mark struct {
+	row int
+	col int
+}
+
+// exCmd is one parsed ex command line. Line numbers are 1-based; 0 is only
+// meaningful as the destination of :m, :t and :r.
+type exCmd struct {
+	addrs []int
+	name  string
+	bang  bool
+	arg   string
+}
+
+// execEx parses and runs one ex command line such as ":%s/a/b/g"
+func (e *editor) execEx(line string) error {
+	line = strings.TrimLeft(line, ": \t")
+	if line == "" {
+		return nil
+	}
+	if n, ok := parseOffset(line); ok && e.hex != nil {
+		// in hex mode :N goes to offset N
+		e.setHexCursor(n)
+		return nil
+	}
+	if n, err := strconv.Atoi(line); err == nil && e.pg != nil {
+		// in a large file :N can go anywhere, not just within the page
+		e.pushJump()
+		e.gotoLine(max(n, 1) - 1)
+		e.moveCursor('^')
+		return nil
+	}
+	c, err := e.parseEx(line)
+	if err != nil {
+		return err
+	}
+	return e.runEx(c)
+}
+
+func (e *editor) parseEx(line string) (*exCmd, error) {
+	c := &exCmd{}
+	rest, err := e.parseRange(line, c)
+	if err != nil {
+		return nil, err
+	}
+	rest = strings.TrimLeft(rest, " \t")
+	n := 0
+	for n < len(rest) && isAlpha(rest[n]) {
+		n++
+	}
+	if n == 0 && rest != "" {
+		n = 1 // single-character commands such as & and <
+	}
+	c.name = rest[:n]
+	rest = rest[n:]
+	if strings.HasPrefix(rest, "!") && c.name != "" {
+		c.bang = true
+		rest = rest[1:]
+	}
+	// :s and :g take their delimiter straight after the name
+	if c.name == "s" || c.name == "substitute" || c.name == "g" || c.name == "global" || c.name == "v" || c.name == "vglobal" {
+		c.arg = rest
+	} else {
+		c.arg = strings.TrimLeft(rest, " \t")
+	}
+	return c, nil
+}
+
+func isAlpha(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// parseRange reads the leading "%", "N,M", ".,$" ... of a command line. In a
+// large file % and $ only reach the end of the page.
+func (e *editor) parseRange(s string, c *exCmd) (string, error) {
+	s = strings.TrimLeft(s, " \t")
+	if strings.HasPrefix(s, "%") {
+		c.addrs = []int{1, len(e.lines)}
+		return s[1:], nil
+	}
+	cur := e.row + 1
+	for {
+		addr, rest, ok, err := e.parseAddr(s, cur)
+		if err != nil {
+			return "", err
+		}
+		s = rest
+		if ok {
+			if addr < 0 || addr > len(e.lines) {
+				return "", errors.New("E16: Invalid range")
+			}
+			c.addrs = append(c.addrs, addr)
+		}
+		s = strings.TrimLeft(s, " \t")
+		if s == "" || (s[0] != ',' && s[0] != ';') {
+			break
+		}
+		if !ok {
+			c.addrs = append(c.addrs, cur)
+		}
+		if s[0] == ';' {
+			cur = c.addrs[len(c.addrs)-1]
+		}
+		s = s[1:]
+		// "1," means "1,."
+		if rest := strings.TrimLeft(s, " \t"); rest == "" || isAlpha(rest[0]) {
+			c.addrs = append(c.addrs, cur)
+			break
+		}
+	}
+	if len(c.addrs) > 2 {
+		c.addrs = c.addrs[len(c.addrs)-2:]
+	}
+	return s, nil
+}
+
+// parseAddr reads a single line address with any +N/-N offsets
+func (e *editor) parseAddr(s string, cur int) (int, string, bool, error) {
+	s = strings.TrimLeft(s, " \t")
+	addr, ok := cur, false
+	switch {
+	case s == "":
+		return 0, s, false, nil
+	case s[0] >= '0' && s[0] <= '9':
+		n := 0
+		for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		addr, _ = strconv.Atoi(s[:n])
+		if e.pg != nil {
+			// line numbers count from the start of the file, not the page
+			first, known := e.firstLine()
+			if !known {
+				return 0, "", false, errors.New("line numbers are not indexed here yet")
+			}
+			addr -= first
+		}
+		s, ok = s[n:], true
+	case s[0] == '.':
+		s, ok = s[1:], true
+	case s[0] == '$':
+		addr, s, ok = len(e.lines), s[1:], true
+	case s[0] == '\'' && len(s) > 1:
+		m, found := e.marks[rune(s[1])]
+		if !found {
+			return 0, "", false, errors.New("E20: Mark not set")
+		}
+		addr, s, ok = m.row+1, s[2:], true
+	case s[0] == '/' || s[0] == '?':
+		pat, rest := splitDelim(s[1:], s[0])
+		re, err := e.compilePattern(pat)
+		if err != nil {
+			return 0, "", false, err
+		}
+		row, found := e.findLine(re, cur-1, s[0] == '/')
+		if !found {
+			return 0, "", false, fmt.Errorf("E486: Pattern not found: %s", pat)
+		}
+		addr, s, ok = row+1, rest, true
+	}
+	for len(s) > 0 && (s[0] == '+' || s[0] == '-') {
+		sign := 1
+		if s[0] == '-' {
+			sign = -1
+		}
+		s = s[1:]
+		n := 0
+		for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		off := 1
+		if n > 0 {
+			off, _ = strconv.Atoi(s[:n])
+		}
+		addr += sign * off
+		s, ok = s[n:], true
+	}
+	return addr, s, ok, nil
+}
+
+// splitDelim splits s at the first unescaped delim, returning the part
+// before it (with "\delim" unescaped) and the remainder after it
+func splitDelim(s string, delim byte) (string, string) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			if s[i+1] == delim {
+				b.WriteByte(delim)
+			} else {
+				b.WriteByte('\\')
+				b.WriteByte(s[i+1])
+			}
+			i++
+			continue
+		}
+		if s[i] == delim {
+			return b.String(), s[i+1:]
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), ""
+}
+
+// compilePattern compiles a search pattern; an empty pattern reuses the last one
+func (e *editor) compilePattern(pat string) (*regexp.Regexp, error) {
+	if pat == "" {
+		pat = e.searchQuery
+		if pat == "" {
+			pat = e.lastSubPat
+		}
+		if pat == "" {
+			return nil, errors.New("E35: No previous regular expression")
+		}
+	}
+	return compileSearch(pat, &e.opts)
+}
+
+// findLine returns the next line after (or before) from matching re, wrapping around
+func (e *editor) findLine(re *regexp.Regexp, from int, forward bool) (int, bool) {
+	n := len(e.lines)
+	for i := 1; i <= n; i++ {
+		r := (from + i) % n
+		if !forward {
+			r = ((from-i)%n + n) % n
+		}
+		if re.MatchString(e.lines[r]) {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+// lineRange returns the 0-based [first, last] lines addressed by c, defaulting
+// to the current line (or the whole buffer when whole is set)
+func (e *editor) lineRange(c *exCmd, whole bool) (int, int) {
+	var first, last int
+	switch len(c.addrs) {
+	case 0:
+		if whole {
+			return 0, len(e.lines) - 1
+		}
+		return e.row, e.row
+	case 1:
+		first, last = c.addrs[0], c.addrs[0]
+	default:
+		first, last = c.addrs[0], c.addrs[1]
+	}
+	if first > last {
+		first, last = last, first
+	}
+	first = max(first, 1)
+	last = max(last, 1)
+	return first - 1, last - 1
+}
+
+func (e *editor) runEx(c *exCmd) error {
+	if e.hex != nil {
+		if err := hexCheck(c); err != nil {
+			return err
+		}
+	}
+	switch c.name {
+	case "":
+		// :N jumps to a line
+		if len(c.addrs) > 0 {
+			e.pushJump()
+			e.row = max(c.addrs[len(c.addrs)-1], 1) - 1
+			e.col = 0
+			e.moveCursor('^')
+		}
+		return nil
+	case "q", "quit", "clo", "close":
+		return e.closeWindow(c.bang)
+	case "qa", "qall", "quita", "quitall":
+		return e.quitAll(c.bang)
+	case "wqa", "wqall", "xa", "xall":
+		for _, w := range e.wins {
+			if w.modified {
+				if err := w.checkWrite(w.filename, c.bang); err != nil {
+					e.focus(w)
+					return err
+				}
+				if err := w.writeFile(w.filename); err != nil {
+					return errors.New("write error: " + err.Error())
+				}
+				w.modified = false
+			}
+		}
+		e.quit = true
+	case "vs", "vsplit":
+		return e.splitWindow(c.arg)
+	case "hex":
+		return e.toggleHex()
+	case "diffu", "diffupdate":
+		if e.diff != nil {
+			e.diff.update()
+		}
+	case "diffo", "diffoff":
+		e.diff = nil
+	case "w", "write", "wq", "x", "xit", "exit":
+		return e.exWrite(c)
+	case "e", "edit":
+		if c.arg != "" && c.arg != e.filename {
+			return fmt.Errorf("only :e! is supported")
+		}
+		if e.modified && !c.bang {
+			return errors.New("E37: No write since last change (add ! to override)")
+		}
+		if e.hex != nil {
+			h, err := newHexFile(e.filename)
+			if err != nil {
+				return errors.New("reload error: " + err.Error())
+			}
+			e.hex.close()
+			e.hex = h
+		} else if e.pg != nil {
+			if err := e.reloadLarge(); err != nil {
+				return errors.New("reload error: " + err.Error())
+			}
+		} else {
+			lines, format, err := readLines(e.filename)
+			if err != nil {
+				return errors.New("reload error: " + err.Error())
+			}
+			e.lines, e.format = lines, format
+		}
+		e.removeSwap()
+		e.row = 0
+		e.col = 0
+		e.modified = false
+		e.status = fmt.Sprintf("\"%s\" %s", e.filename, e.sizeLabel())
+	case "r", "read":
+		if c.bang || strings.HasPrefix(c.arg, "!") {
+			return e.exReadCmd(c, strings.TrimPrefix(c.arg, "!"))
+		}
+		return e.exRead(c)
+	case "!":
+		if c.bang {
+			// :!! repeats the last command
+			c.arg = "!" + c.arg
+		}
+		return e.exBang(c)
+	case "d", "delete":
+		first, last := e.lineRange(c, false)
+		e.saveSnapshot()
+		e.reg = register{lines: append([]string{}, e.lines[first:last+1]...), kind: visualLine}
+		e.lines = append(e.lines[:first], e.lines[last+1:]...)
+		if len(e.lines) == 0 {
+			e.lines = []string{""}
+		}
+		e.row = min(first, len(e.lines)-1)
+		e.col = 0
+		e.moveCursor('^')
+		e.modified = true
+	case "y", "yank":
+		first, last := e.lineRange(c, false)
+		e.reg = register{lines: append([]string{}, e.lines[first:last+1]...), kind: visualLine}
+	case "m", "move", "t", "co", "copy":
+		return e.exMoveCopy(c)
+	case "k", "mark", "ma":
+		if len(c.arg) != 1 {
+			return errors.New("E471: Argument required")
+		}
+		_, last := e.lineRange(c, false)
+		e.marks[rune(c.arg[0])] = mark{last, 0}
+	case "s", "substitute", "&":
+		return e.exSubstitute(c)
+	case "g", "global", "v", "vglobal":
+		return e.exGlobal(c)
+	case "norm", "normal":
+		return e.exNormal(c)
+	case "set", "se":
+		return e.exSet(c.arg)
+	case "noh", "nohl", "nohlsearch":
+		e.search.noHL = true
+	case "h", "help":
+		e.status = "i:insert a:append x:delete dd:delete-line u:undo ^r:redo v/V/^v:visual /?:search n/N */#:word w:save q{r}/@{r}:macro m{a-z}/'a:mark ^O/^I:jumps :q:quit :vs ^W:window :hex :set :map :! :r! :s :g :d :m :t :normal :r"
+	default:
+		if modes, ok := mapModes[c.name]; ok {
+			return e.exMap(c, modes)
+		}
+		if modes, ok := unmapModes[c.name]; ok {
+			return e.exUnmap(c, modes)
+		}
+		if len(c.name) == 2 && c.name[0] == 'k' {
+			// :ka is :k a
+			_, last := e.lineRange(c, false)
+			e.marks[rune(c.name[1])] = mark{last, 0}
+			return nil
+		}
+		return fmt.Errorf("unknown command: %s", c.name)
+	}
+	return nil
+}
+
+// exWrite implements :w, :w file, :w >> file, :wq and :x
+func (e *editor) exWrite(c *exCmd) error {
+	first, last := e.lineRange(c, true)
+	quit := c.name != "w" && c.name != "write"
+	name := e.filename
+	appendTo := false
+	arg := c.arg
+	if strings.HasPrefix(arg, ">>") {
+		appendTo = true
+		arg = strings.TrimSpace(arg[2:])
+	}
+	if arg != "" {
+		name = arg
+	}
+	whole := first == 0 && last == len(e.lines)-1
+	if (c.name == "x" || c.name == "xit" || c.name == "exit") && !e.modified && name == e.filename {
+		return e.closeWindow(false)
+	}
+	if err := e.checkWrite(name, c.bang); err != nil {
+		return err
+	}
+	var err error
+	if appendTo {
+		err = appendLines(name, e.lines[first:last+1], e.format)
+	} else if whole {
+		err = e.writeFile(name)
+	} else {
+		err = atomicWrite(name, encodeLines(e.lines[first:last+1], fileFormat{crlf: e.format.crlf, eol: true}))
+	}
+	if err != nil {
+		return errors.New("write error: " + err.Error())
+	}
+	if name == e.filename && whole && !appendTo {
+		e.modified = false
+	}
+	e.status = fmt.Sprintf("\"%s\" %dL written", name, last-first+1)
+	if whole {
+		e.status = fmt.Sprintf("\"%s\" %s written", name, e.sizeLabel())
+	}
+	if appendTo {
+		e.status = fmt.Sprintf("\"%s\" %dL appended", name, last-first+1)
+	}
+	if quit {
+		return e.closeWindow(false)
+	}
+	return nil
+}
+
+func appendLines(name string, lines []string, format fileFormat) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	format.eol = true
+	if _, err := f.Write(encodeLines(lines, format)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// exRead implements :r file, inserting it below the addressed line
+func (e *editor) exRead(c *exCmd) error {
+	name := c.arg
+	if name == "" {
+		name = e.filename
+	}
+	lines, _, err := readLines(name)
+	if err != nil {
+		return fmt.Errorf("E484: Can't open file %s", name)
+	}
+	after := e.row + 1
+	if len(c.addrs) > 0 {
+		after = c.addrs[len(c.addrs)-1]
+	}
+	e.insertLines(after, lines)
+	return nil
+}
+
+// insertLines inserts lines below 1-based line after (0 inserts at the top)
+// and puts the cursor on the first of them
+func (e *editor) insertLines(after int, lines []string) {
+	e.saveSnapshot()
+	added := append([]string{}, lines...)
+	e.lines = append(e.lines[:after], append(added, e.lines[after:]...)...)
+	e.row = after
+	e.col = 0
+	e.moveCursor('^')
+	e.modified = true
+}
+
+// exMoveCopy implements :m and :t
+func (e *editor) exMoveCopy(c *exCmd) error {
+	first, last := e.lineRange(c, false)
+	dest, rest, ok, err := e.parseAddr(c.arg, e.row+1)
+	if err != nil {
+		return err
+	}
+	if !ok || strings.TrimSpace(rest) != "" || dest < 0 || dest > len(e.lines) {
+		return errors.New("E14: Invalid address")
+	}
+	block := append([]string{}, e.lines[first:last+1]...)
+	if c.name == "t" || c.name == "co" || c.name == "copy" {
+		e.insertLines(dest, block)
+		e.row = dest + len(block) - 1
+		return nil
+	}
+	if dest > first && dest <= last {
+		return errors.New("E134: Cannot move a range of lines into itself")
+	}
+	e.saveSnapshot()
+	remaining := append(append([]string{}, e.lines[:first]...), e.lines[last+1:]...)
+	if dest > last+1 {
+		dest -= len(block)
+	}
+	e.lines = append(remaining[:dest], append(block, remaining[dest:]...)...)
+	e.row = dest + len(block) - 1
+	e.col = 0
+	e.moveCursor('^')
+	e.modified = true
+	return nil
+}
+
+// exSubstitute implements :s/pat/rep/flags with Go regexp syntax. In the
+// replacement, & and \0 stand for the whole match, \1..\9 for groups and
+// \n for a line break.
+func (e *editor) exSubstitute(c *exCmd) error {
+	first, last := e.lineRange(c, false)
+	pat, rep, flags := e.lastSubPat, e.lastSubRep, ""
+	if c.arg != "" && !isAlpha(c.arg[0]) && c.arg[0] != ' ' && c.name != "&" {
+		delim := c.arg[0]
+		var rest string
+		pat, rest = splitDelim(c.arg[1:], delim)
+		rep, flags = splitDelim(rest, delim)
+		if pat == "" {
+			pat = e.searchQuery
+		}
+	} else {
+		flags = strings.TrimSpace(c.arg)
+	}
+	if pat == "" {
+		return errors.New("E35: No previous regular expression")
+	}
+	e.lastSubPat, e.lastSubRep = pat, rep
+	global := strings.Contains(flags, "g")
+	if strings.Contains(flags, "i") {
+		pat = `\c` + pat
+	} else if strings.Contains(flags, "I") {
+		pat = `\C` + pat
+	}
+	re, err := compileSearch(pat, &e.opts)
+	if err != nil {
+		return err
+	}
+	template := goTemplate(rep)
+
+	subs, lastRow := 0, -1
+	for r := first; r <= last && r < len(e.lines); r++ {
+		line := e.lines[r]
+		matches := re.FindAllStringSubmatchIndex(line, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		if !global {
+			matches = matches[:1]
+		}
+		var out []byte
+		prev := 0
+		for _, m := range matches {
+			out = append(out, line[prev:m[0]]...)
+			out = re.ExpandString(out, template, line, m)
+			prev = m[1]
+		}
+		out = append(out, line[prev:]...)
+		if subs == 0 {
+			e.saveSnapshot()
+		}
+		subs += len(matches)
+		parts := strings.Split(string(out), "\n")
+		e.lines = append(e.lines[:r], append(parts, e.lines[r+1:]...)...)
+		r += len(parts) - 1
+		last += len(parts) - 1
+		lastRow = r
+	}
+	if subs == 0 {
+		if e.inGlobal || strings.Contains(flags, "e") {
+			// the e flag makes no match quietly succeed, for scripts
+			return nil
+		}
+		return fmt.Errorf("E486: Pattern not found: %s", e.lastSubPat)
+	}
+	e.row = lastRow
+	e.col = 0
+	e.moveCursor('^')
+	e.modified = true
+	if !e.inGlobal {
+		e.status = fmt.Sprintf("%d substitutions", subs)
+	}
+	return nil
+}
+
+// goTemplate converts a vim-style replacement into a regexp.Expand template
+func goTemplate(rep string) string {
+	var b strings.Builder
+	for i := 0; i < len(rep); i++ {
+		ch := rep[i]
+		switch {
+		case ch == '$':
+			b.WriteString("$$")
+		case ch == '&':
+			b.WriteString("${0}")
+		case ch == '\\' && i+1 < len(rep):
+			i++
+			switch n := rep[i]; {
+			case n >= '0' && n <= '9':
+				b.WriteString("${" + string(n) + "}")
+			case n == 'n' || n == 'r':
+				b.WriteByte('\n')
+			case n == 't':
+				b.WriteByte('\t')
+			case n == '$':
+				b.WriteString("$$")
+			default:
+				b.WriteByte(n)
+			}
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+// exGlobal implements :g/pat/cmd, :g!/pat/cmd and :v/pat/cmd
+func (e *editor) exGlobal(c *exCmd) error {
+	if e.inGlobal {
+		return errors.New("E147: Cannot do :global recursive")
+	}
+	if c.arg == "" {
+		return errors.New("E476: Invalid command")
+	}
+	first, last := e.lineRange(c, true)
+	delim := c.arg[0]
+	pat, cmd := splitDelim(c.arg[1:], delim)
+	re, err := e.compilePattern(pat)
+	if err != nil {
+		return err
+	}
+	invert := c.bang || c.name == "v" || c.name == "vglobal"
+	var rows []int
+	for r := first; r <= last; r++ {
+		if re.MatchString(e.lines[r]) != invert {
+			rows = append(rows, r)
+		}
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("E486: Pattern not found: %s", pat)
+	}
+	if strings.TrimSpace(cmd) == "" {
+		cmd = "p"
+	}
+	e.inGlobal = true
+	defer func() { e.inGlobal = false }()
+	return e.forEachLine(rows, func(row int) error {
+		e.row, e.col = row, 0
+		if strings.TrimSpace(cmd) == "p" {
+			return nil
+		}
+		return e.execEx(cmd)
+	})
+}
+
+// exNormal implements :normal, running keys as if typed in normal mode on
+// each line of the range (or at the cursor when no range is given)
+func (e *editor) exNormal(c *exCmd) error {
+	if c.arg == "" {
+		return errors.New("E471: Argument required")
+	}
+	if len(c.addrs) == 0 {
+		e.feedKeys(c.arg)
+		return nil
+	}
+	first, last := e.lineRange(c, false)
+	rows := make([]int, 0, last-first+1)
+	for r := first; r <= last; r++ {
+		rows = append(rows, r)
+	}
+	return e.forEachLine(rows, func(row int) error {
+		e.row, e.col = row, 0
+		e.feedKeys(c.arg)
+		return nil
+	})
+}
+
+// forEachLine calls fn with the cursor on each of rows in turn as one undo
+// step. Rows still to be visited are kept in step with lines that fn
+// inserts or deletes above them; a row whose own text disappears is skipped.
+func (e *editor) forEachLine(rows []int, fn func(row int) error) error {
+	e.saveSnapshot()
+	e.holdUndo++
+	defer func() { e.holdUndo-- }()
+	for i := 0; i < len(rows); i++ {
+		if rows[i] < 0 || rows[i] >= len(e.lines) {
+			continue
+		}
+		before := append([]string(nil), e.lines...)
+		if err := fn(rows[i]); err != nil {
+			return err
+		}
+		after := e.lines
+		if sameLines(before, after) {
+			continue
+		}
+		// Lines in the common prefix keep their index, those in the common
+		// suffix shift by the change in length, and lines in between are
+		// followed to wherever fn moved them
+		p, s := commonEnds(before, after)
+		delta := len(after) - len(before)
+		moved := matchLines(before[p:len(before)-s], after[p:len(after)-s])
+		for j := i + 1; j < len(rows); j++ {
+			switch {
+			case rows[j] < p:
+			case rows[j] >= len(before)-s:
+				rows[j] += delta
+			default:
+				if to, ok := moved[rows[j]-p]; ok {
+					rows[j] = p + to
+				} else {
+					rows[j] = -1
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func sameLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// commonEnds returns the lengths of the common prefix and suffix of a and b
+func commonEnds(a, b []string) (int, int) {
+	n := min(len(a), len(b))
+	p := 0
+	for p < n && a[p] == b[p] {
+		p++
+	}
+	s := 0
+	for s < n-p && a[len(a)-1-s] == b[len(b)-1-s] {
+		s++
+	}
+	return p, s
+}
+
+// matchLines pairs up equal lines of a and b along their longest common
+// subsequence, returning a map from index in a to index in b
+func matchLines(a, b []string) map[int]int {
+	m := map[int]int{}
+	if len(a) == 0 || len(b) == 0 || len(a)*len(b) > 1<<20 {
+		return m
+	}
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			m[i] = j
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return m
+}
+
+// feedKeys runs keys through the normal-mode dispatcher without touching the
+// terminal, finishing back in normal mode like vim's :normal
+func (e *editor) feedKeys(keys string) {
+	saved, wasFeeding, noremap := e.pending, e.feeding, e.noremapKeys
+	e.pending = []rune(keys)
+	e.feeding = true
+	e.noremapKeys = 0
+	e.mode = "NORMAL"
+	for len(e.pending) > 0 && !e.quit {
+		e.dispatch(e.readMapped())
+	}
+	if e.mode != "NORMAL" {
+		e.dispatch(keyEsc)
+	}
+	e.pending, e.feeding, e.noremapKeys = saved, wasFeeding, noremap
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const usage = `usage: bse [-R] [-b] FILE
+       bse [-R] -d FILE1 FILE2
+       bse [-R] [-b] -c CMD [-c CMD...] FILE...
+       bse [-R] [-b] -e SCRIPT FILE...`
+
+// batchArgs are the command line of a headless run
+type batchArgs struct {
+	cmds     []string
+	files    []string
+	readonly bool
+	binary   bool
+	diff     bool
+}
+
+// parseArgs splits the command line into ex commands and files. -c adds one
+// command and -e adds every line of a script file ("-" reads standard input).
+// -R opens the files read-only, -b opens them in hex mode and -d compares
+// two files side by side. It reports whether any commands were given,
+// which makes the run headless.
+func parseArgs(args []string) (*batchArgs, bool, error) {
+	b := &batchArgs{}
+	headless := false
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "--":
+			b.files = append(b.files, args[i+1:]...)
+			return b, headless, nil
+		case a == "-R":
+			b.readonly = true
+		case a == "-b":
+			b.binary = true
+		case a == "-d":
+			b.diff = true
+		case a == "-c" || a == "-e":
+			if i+1 >= len(args) {
+				return nil, false, fmt.Errorf("option %s needs an argument", a)
+			}
+			i++
+			headless = true
+			if a == "-c" {
+				b.cmds = append(b.cmds, args[i])
+				continue
+			}
+			lines, err := readScript(args[i])
+			if err != nil {
+				return nil, false, err
+			}
+			b.cmds = append(b.cmds, lines...)
+		case strings.HasPrefix(a, "-") && a != "-":
+			return nil, false, fmt.Errorf("unknown option %s", a)
+		default:
+			b.files = append(b.files, a)
+		}
+	}
+	return b, headless, nil
+}
+
+// readScript reads an ex script, dropping blank lines and " comments
+func readScript(name string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var lines []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "\"") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, sc.Err()
+}
+
+// runBatch edits each file in turn with the commands, like ex -s: there is
+// no terminal, keys only come from :normal, and nothing is saved unless the
+// commands write it. The first failing command abandons that file. It
+// returns false if any command failed.
+func (e *editor) runBatch(b *batchArgs) bool {
+	// keys run out instead of waiting on a terminal that isn't there
+	e.feeding = true
+	ok := true
+	for _, name := range b.files {
+		var buf *buffer
+		if b.binary {
+			buf = openHexBuffer(name)
+		} else {
+			// scripts see the whole file, so large files are read in too
+			buf = openBuffer(name, false)
+		}
+		buf.swapFile = ""
+		buf.readonly = e.readonly
+		e.window = &window{buffer: buf}
+		e.wins = []*window{e.window}
+		e.quit = false
+		e.mode = "NORMAL"
+		for _, cmd := range b.cmds {
+			if err := e.execEx(cmd); err != nil {
+				fmt.Fprintf(os.Stderr, "bse: %s: %s: %v\n", name, cmd, err)
+				ok = false
+				break
+			}
+			if e.quit {
+				break
+			}
+		}
+	}
+	return ok
+}
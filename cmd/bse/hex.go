@@ -0,0 +1,925 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// In hex mode (bse -b, or :hex) a buffer is shown and edited as bytes, in
+// rows of an offset, the bytes in hex and the same bytes as ASCII, like
+// hexdump -C. The cursor sits in either column; Tab moves it across.
+//
+// The bytes are a piece table over the original contents (the file, mapped
+// when it can be, or the text the buffer held when it switched to hex) and
+// the bytes typed since, so even a whole disk image opens at once and is
+// written back exactly.
+type hexView struct {
+	file   *lazyFile // the original, when it came from a file
+	data   []byte    // the original otherwise
+	added  []byte    // bytes typed, only ever appended to
+	pieces []piece
+	size   int64
+
+	cursor int64
+	top    int64 // offset of the first row shown
+	ascii  bool  // the cursor is in the ASCII column
+	nibble int   // 1 when the cursor is on the low digit of a byte
+
+	undo, redo []hexState
+}
+
+// piece is a run of n bytes from the original (or from added) at off
+type piece struct {
+	added  bool
+	off, n int64
+}
+
+// hexState is one entry on the hex undo/redo stacks. The pieces can be
+// kept as they are since added only grows.
+type hexState struct {
+	pieces []piece
+	size   int64
+	cursor int64
+}
+
+// hexRowMax is the most bytes shown in a row; narrow windows show fewer
+const hexRowMax = 16
+
+// newHexData starts a hex view of data
+func newHexData(data []byte) *hexView {
+	h := &hexView{data: data, size: int64(len(data))}
+	if h.size > 0 {
+		h.pieces = []piece{{off: 0, n: h.size}}
+	}
+	return h
+}
+
+// newHexFile starts a hex view of a file, which may be a device. A file
+// that doesn't exist yet gives an empty view.
+func newHexFile(name string) (*hexView, error) {
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return newHexData(nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 && !isDevice(info) {
+		return newHexData(nil), nil
+	}
+	lf, err := openLazy(name, false)
+	if err != nil {
+		return nil, err
+	}
+	h := &hexView{file: lf, size: lf.size}
+	h.pieces = []piece{{off: 0, n: h.size}}
+	return h, nil
+}
+
+// openHexBuffer opens name in hex mode, or an empty buffer if it can't be
+// read. Hex buffers have no swap file.
+func openHexBuffer(name string) *buffer {
+	b := &buffer{
+		filename: name,
+		lines:    []string{""},
+		format:   fileFormat{eol: true},
+		marks:    map[rune]mark{},
+	}
+	h, err := newHexFile(name)
+	if err != nil {
+		h = newHexData(nil)
+	}
+	b.hex = h
+	return b
+}
+
+// close releases the file behind the view
+func (h *hexView) close() {
+	if h.file != nil {
+		h.file.close()
+	}
+}
+
+// orig returns the original bytes [from, to)
+func (h *hexView) orig(from, to int64) []byte {
+	if h.file != nil {
+		return h.file.bytesAt(from, to)
+	}
+	return h.data[from:to]
+}
+
+// read returns up to n bytes from off
+func (h *hexView) read(off, n int64) []byte {
+	var out []byte
+	pos := int64(0)
+	for _, p := range h.pieces {
+		end := pos + p.n
+		if end > off && pos < off+n {
+			a, b := max64(off, pos)-pos, min64(off+n, end)-pos
+			if p.added {
+				out = append(out, h.added[p.off+a:p.off+b]...)
+			} else {
+				out = append(out, h.orig(p.off+a, p.off+b)...)
+			}
+		}
+		if end >= off+n {
+			break
+		}
+		pos = end
+	}
+	return out
+}
+
+// byteAt returns the byte at off, which must be inside the data
+func (h *hexView) byteAt(off int64) byte {
+	return h.read(off, 1)[0]
+}
+
+// replace puts ins in place of the del bytes at off
+func (h *hexView) replace(off, del int64, ins []byte) {
+	var out []piece
+	add := func(p piece) {
+		if p.n == 0 {
+			return
+		}
+		if k := len(out) - 1; k >= 0 && out[k].added == p.added && out[k].off+out[k].n == p.off {
+			// typing along a row keeps extending the same piece
+			out[k].n += p.n
+			return
+		}
+		out = append(out, p)
+	}
+	ip := piece{added: true, off: int64(len(h.added)), n: int64(len(ins))}
+	h.added = append(h.added, ins...)
+	inserted := false
+	pos := int64(0)
+	for _, p := range h.pieces {
+		end := pos + p.n
+		if pos < off {
+			add(piece{p.added, p.off, min64(end, off) - pos})
+		}
+		if !inserted && end >= off {
+			add(ip)
+			inserted = true
+		}
+		if end > off+del {
+			s := max64(pos, off+del)
+			add(piece{p.added, p.off + s - pos, end - s})
+		}
+		pos = end
+	}
+	if !inserted {
+		add(ip)
+	}
+	h.pieces = out
+	h.size += int64(len(ins)) - del
+}
+
+// writeTo streams the bytes to w
+func (h *hexView) writeTo(w io.Writer) error {
+	for _, p := range h.pieces {
+		var err error
+		switch {
+		case p.added:
+			_, err = w.Write(h.added[p.off : p.off+p.n])
+		case h.file != nil && h.file.data == nil:
+			_, err = io.Copy(w, io.NewSectionReader(h.file.f, p.off, p.n))
+		default:
+			_, err = w.Write(h.orig(p.off, p.off+p.n))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// hexSnapshot saves the bytes before a change for u
+func (e *editor) hexSnapshot() {
+	h := e.hex
+	h.undo = append(h.undo, hexState{h.pieces, h.size, h.cursor})
+	h.redo = nil
+	e.modified = true
+	e.changes++
+}
+
+// hexUndo moves one state from one stack to the other
+func (e *editor) hexUndo(from, to *[]hexState) {
+	h := e.hex
+	if len(*from) == 0 {
+		e.status = "Already at oldest change"
+		if from == &h.redo {
+			e.status = "Already at newest change"
+		}
+		e.abortKeys()
+		return
+	}
+	s := (*from)[len(*from)-1]
+	*from = (*from)[:len(*from)-1]
+	*to = append(*to, hexState{h.pieces, h.size, h.cursor})
+	h.pieces, h.size, h.cursor = s.pieces, s.size, s.cursor
+	h.nibble = 0
+	e.modified = true
+	e.changes++
+}
+
+// hexLayout picks how many bytes a row of w shows, and how many digits the
+// offsets need
+func hexLayout(w *window) (bpr, offW int) {
+	offW = max(8, len(strconv.FormatInt(w.hex.size, 16)))
+	bpr = hexRowMax
+	if w.w == 0 {
+		// headless: no screen, but j and k still move by rows
+		return bpr, offW
+	}
+	for bpr > 1 && hexCol(bpr, offW, bpr)+2+bpr > w.w {
+		bpr /= 2
+	}
+	return bpr, offW
+}
+
+// hexCol is the column of byte i of a row in the hex column; i == bpr gives
+// the column of the ASCII column's left border
+func hexCol(bpr, offW, i int) int {
+	x := offW + 2 + 3*i
+	if bpr >= 8 && i >= bpr/2 {
+		x++
+	}
+	return x
+}
+
+// asciiCol is the column of byte i of a row in the ASCII column
+func asciiCol(bpr, offW, i int) int {
+	return hexCol(bpr, offW, bpr) + 1 + i
+}
+
+// scrollHex keeps the cursor's row in view
+func (h *hexView) scrollHex(bpr, height int) {
+	row, top := h.cursor/int64(bpr), h.top/int64(bpr)
+	if row < top {
+		top = row
+	}
+	if row >= top+int64(height) {
+		top = row - int64(height) + 1
+	}
+	h.top = top * int64(bpr)
+}
+
+// drawHex paints the rows of a window in hex mode. The cursor's byte is
+// marked in the column it isn't in.
+func (e *editor) drawHex(w *window, height int) {
+	h := w.hex
+	bpr, offW := hexLayout(w)
+	h.scrollHex(bpr, height)
+	for i := 0; i < height; i++ {
+		off := h.top + int64(i*bpr)
+		if off > h.size || (off == h.size && off > 0 && h.cursor < h.size) {
+			e.scr.setSpan(i, w.x, w.w, "~", 0, nil)
+			continue
+		}
+		data := h.read(off, int64(bpr))
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%0*x  ", offW, off)
+		for j := 0; j < bpr; j++ {
+			if bpr >= 8 && j == bpr/2 {
+				sb.WriteByte(' ')
+			}
+			if j < len(data) {
+				fmt.Fprintf(&sb, "%02x ", data[j])
+			} else {
+				sb.WriteString("   ")
+			}
+		}
+		sb.WriteByte('|')
+		for _, c := range data {
+			if c < 0x20 || c >= 0x7f {
+				c = '.'
+			}
+			sb.WriteByte(c)
+		}
+		sb.WriteByte('|')
+		attrs := make([]string, w.w)
+		if j := int(h.cursor - off); w == e.window && j >= 0 && j < len(data) {
+			if h.ascii {
+				paint(attrs, 0, hexCol(bpr, offW, j), hexCol(bpr, offW, j)+2, attrReverse)
+			} else {
+				paint(attrs, 0, asciiCol(bpr, offW, j), asciiCol(bpr, offW, j)+1, attrReverse)
+			}
+		}
+		e.scr.setSpan(i, w.x, w.w, sb.String(), 0, attrs)
+	}
+}
+
+// hexCursor is where the terminal cursor goes in a hex window
+func (e *editor) hexCursor(w *window) (y, x int) {
+	h := w.hex
+	bpr, offW := hexLayout(w)
+	j := int(h.cursor % int64(bpr))
+	y = int((h.cursor - h.top) / int64(bpr))
+	if h.ascii {
+		return y, w.x + min(asciiCol(bpr, offW, j), w.w-1)
+	}
+	return y, w.x + min(hexCol(bpr, offW, j)+h.nibble, w.w-1)
+}
+
+// hexRuler is the cursor offset and size shown in the status of a hex window
+func (h *hexView) ruler() string {
+	return fmt.Sprintf("0x%x/0x%x", h.cursor, h.size)
+}
+
+// setHexCursor moves the cursor to off, kept inside the data (or just past
+// its end while typing)
+func (e *editor) setHexCursor(off int64) {
+	h := e.hex
+	limit := h.size - 1
+	if e.mode == "INSERT" || e.mode == "REPLACE" {
+		limit = h.size
+	}
+	h.cursor = max64(min64(off, limit), 0)
+	h.nibble = 0
+}
+
+// handleHex handles a key in normal, insert or replace mode in hex mode.
+// Normal mode moves about by bytes and rows; i inserts bytes, R overwrites
+// them, r overwrites one, x deletes. In the hex column bytes are typed as two
+// hex digits, in the ASCII column as text.
+func (e *editor) handleHex(k rune) {
+	if e.mode != "NORMAL" {
+		e.hexType(k)
+		return
+	}
+	h := e.hex
+	bpr, _ := hexLayout(e.window)
+	count := int64(1)
+	if k >= '1' && k <= '9' {
+		count = int64(k - '0')
+		for k = e.readKey(); k >= '0' && k <= '9'; k = e.readKey() {
+			count = count*10 + int64(k-'0')
+		}
+	}
+	rowStart := h.cursor - h.cursor%int64(bpr)
+	switch k {
+	case 'h', keyLeft, 127, 8:
+		e.setHexCursor(h.cursor - count)
+	case 'l', keyRight, ' ':
+		e.setHexCursor(h.cursor + count)
+	case 'k', keyUp:
+		if h.cursor >= int64(bpr)*count {
+			e.setHexCursor(h.cursor - int64(bpr)*count)
+		}
+	case 'j', keyDown:
+		if rowStart+int64(bpr)*count < h.size {
+			e.setHexCursor(h.cursor + int64(bpr)*count)
+		}
+	case '0', '^', keyHome:
+		e.setHexCursor(rowStart)
+	case '$', keyEnd:
+		e.setHexCursor(rowStart + int64(bpr) - 1)
+	case keyPgDn, 0x06:
+		e.setHexCursor(h.cursor + int64(bpr*e.textHeight())*count)
+	case keyPgUp, 0x02:
+		e.setHexCursor(h.cursor - int64(bpr*e.textHeight())*count)
+	case 'g':
+		if e.readKey() == 'g' {
+			e.setHexCursor(0)
+		}
+	case 'G':
+		e.setHexCursor(h.size - 1)
+	case '\t':
+		h.ascii = !h.ascii
+		h.nibble = 0
+	case 'x', keyDelete:
+		if h.cursor < h.size {
+			e.hexSnapshot()
+			h.replace(h.cursor, min64(count, h.size-h.cursor), nil)
+			e.setHexCursor(h.cursor)
+		}
+	case 'X':
+		if n := min64(count, h.cursor); n > 0 {
+			e.hexSnapshot()
+			h.replace(h.cursor-n, n, nil)
+			e.setHexCursor(h.cursor - n)
+		}
+	case 'r':
+		e.hexReplaceOne()
+	case 'i':
+		e.setMode("INSERT")
+	case 'a':
+		e.setMode("INSERT")
+		e.setHexCursor(h.cursor + 1)
+	case 'R':
+		e.setMode("REPLACE")
+	case 'u':
+		e.hexUndo(&h.undo, &h.redo)
+	case 0x12: // Ctrl-R
+		e.hexUndo(&h.redo, &h.undo)
+	case ':', '/', '?', 'n', 'N', 'w', 'q', '@', 0x17:
+		// commands, searches, saving, macros and windows work as in text
+		e.handleNormal(k)
+	case keyEsc:
+		e.abortKeys()
+	}
+}
+
+// hexType handles a key in insert or replace mode in hex mode
+func (e *editor) hexType(k rune) {
+	h := e.hex
+	bpr, _ := hexLayout(e.window)
+	switch k {
+	case keyEsc:
+		e.setMode("NORMAL")
+		e.setHexCursor(h.cursor)
+		return
+	case '\t':
+		h.ascii = !h.ascii
+		h.nibble = 0
+		return
+	case keyLeft:
+		e.setHexCursor(h.cursor - 1)
+		return
+	case keyRight:
+		e.setHexCursor(h.cursor + 1)
+		return
+	case keyUp:
+		e.setHexCursor(h.cursor - int64(bpr))
+		return
+	case keyDown:
+		e.setHexCursor(h.cursor + int64(bpr))
+		return
+	case 127, 8:
+		if h.nibble == 1 {
+			// drop the half-typed byte
+			h.nibble = 0
+			if e.mode == "INSERT" {
+				e.hexSnapshot()
+				h.replace(h.cursor, 1, nil)
+			}
+			return
+		}
+		if h.cursor > 0 && e.mode == "INSERT" {
+			e.hexSnapshot()
+			h.replace(h.cursor-1, 1, nil)
+		}
+		e.setHexCursor(h.cursor - 1)
+		return
+	}
+	if h.ascii {
+		if k == '\r' {
+			k = '\n'
+		}
+		if isInsertable(k) || k == '\n' {
+			e.hexSnapshot()
+			e.hexPut([]byte(string(k)))
+		}
+		return
+	}
+	d, ok := hexDigit(k)
+	if !ok {
+		return
+	}
+	if h.nibble == 0 {
+		// the first digit starts a new byte, or in replace mode changes
+		// the high half of the one there
+		e.hexSnapshot()
+		if e.mode == "REPLACE" && h.cursor < h.size {
+			h.replace(h.cursor, 1, []byte{h.byteAt(h.cursor)&0x0f | d<<4})
+		} else {
+			h.replace(h.cursor, 0, []byte{d << 4})
+		}
+		h.nibble = 1
+		return
+	}
+	h.replace(h.cursor, 1, []byte{h.byteAt(h.cursor)&0xf0 | d})
+	h.cursor++
+	h.nibble = 0
+	e.changes++
+}
+
+// hexPut types bs at the cursor: inserted in insert (and normal) mode,
+// over what is there in replace mode
+func (e *editor) hexPut(bs []byte) {
+	h := e.hex
+	del := int64(0)
+	if e.mode == "REPLACE" {
+		del = min64(int64(len(bs)), h.size-h.cursor)
+	}
+	h.replace(h.cursor, del, bs)
+	h.cursor += int64(len(bs))
+	h.nibble = 0
+}
+
+// hexReplaceOne is r: the next two hex digits (or one character in the
+// ASCII column) replace the byte under the cursor
+func (e *editor) hexReplaceOne() {
+	h := e.hex
+	if h.cursor >= h.size {
+		return
+	}
+	var c byte
+	if h.ascii {
+		k := e.readKey()
+		if k >= 0x80 || !(isInsertable(k) || k == '\r') {
+			return
+		}
+		if k == '\r' {
+			k = '\n'
+		}
+		c = byte(k)
+	} else {
+		hi, ok1 := hexDigit(e.readKey())
+		if !ok1 {
+			return
+		}
+		lo, ok2 := hexDigit(e.readKey())
+		if !ok2 {
+			return
+		}
+		c = hi<<4 | lo
+	}
+	e.hexSnapshot()
+	h.replace(h.cursor, 1, []byte{c})
+}
+
+func hexDigit(k rune) (byte, bool) {
+	switch {
+	case k >= '0' && k <= '9':
+		return byte(k - '0'), true
+	case k >= 'a' && k <= 'f':
+		return byte(k-'a') + 10, true
+	case k >= 'A' && k <= 'F':
+		return byte(k-'A') + 10, true
+	}
+	return 0, false
+}
+
+// hexPaste puts pasted text in at the cursor: as text in the ASCII column,
+// and read as hex digits (spaces allowed) in the hex column
+func (e *editor) hexPaste(text string) {
+	h := e.hex
+	bs := []byte(text)
+	if !h.ascii {
+		pat, mask, err := parseBytePattern(text)
+		if err != nil || !exact(mask) || strings.HasPrefix(strings.TrimSpace(text), "\"") {
+			e.status = "E: paste hex digits in the hex column"
+			return
+		}
+		bs = pat
+	}
+	if len(bs) == 0 {
+		return
+	}
+	e.hexSnapshot()
+	e.hexPut(bs)
+	if e.mode == "NORMAL" {
+		e.setHexCursor(h.cursor - int64(len(bs)))
+	}
+}
+
+// parseBytePattern reads a hex search: pairs of hex digits with optional
+// spaces, where ? matches any digit, or "text" in quotes for the bytes of
+// the text. mask has the bits of each byte that must match.
+func parseBytePattern(s string) (pat, mask []byte, err error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "\"") {
+		text := strings.TrimSuffix(s[1:], "\"")
+		return []byte(text), bytes.Repeat([]byte{0xff}, len(text)), nil
+	}
+	s = strings.NewReplacer(" ", "", "\t", "").Replace(strings.TrimPrefix(s, "0x"))
+	if s == "" || len(s)%2 != 0 {
+		return nil, nil, errors.New("E: hex patterns are pairs of digits, or \"text\"")
+	}
+	for i := 0; i < len(s); i += 2 {
+		var b, m byte
+		for _, c := range s[i : i+2] {
+			b, m = b<<4, m<<4
+			if c == '?' {
+				continue
+			}
+			d, ok := hexDigit(c)
+			if !ok {
+				return nil, nil, fmt.Errorf("E: bad hex digit %q", c)
+			}
+			b, m = b|d, m|0x0f
+		}
+		pat, mask = append(pat, b), append(mask, m)
+	}
+	return pat, mask, nil
+}
+
+// matchAt reports whether pat matches data at i
+func matchAt(data []byte, i int, pat, mask []byte) bool {
+	for j := range pat {
+		if data[i+j]&mask[j] != pat[j]&mask[j] {
+			return false
+		}
+	}
+	return true
+}
+
+// exact reports whether a pattern's mask has no wildcards
+func exact(mask []byte) bool {
+	for _, m := range mask {
+		if m != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// indexPattern finds the first (or last) match in data, -1 if there's none
+func indexPattern(data, pat, mask []byte, forward bool) int {
+	if exact(mask) {
+		if forward {
+			return bytes.Index(data, pat)
+		}
+		return bytes.LastIndex(data, pat)
+	}
+	n := len(data) - len(pat)
+	for i := 0; i <= n; i++ {
+		j := i
+		if !forward {
+			j = n - i
+		}
+		if matchAt(data, j, pat, mask) {
+			return j
+		}
+	}
+	return -1
+}
+
+// hexSearch moves to the next match of a byte pattern after (or before) the
+// cursor, wrapping round the end. Long searches can be stopped with Esc.
+func (e *editor) hexSearch(query string, forward bool) (wrapped, ok bool, err error) {
+	h := e.hex
+	pat, mask, err := parseBytePattern(query)
+	if err != nil {
+		return false, false, err
+	}
+	// each chunk overlaps the next by a pattern's length less one
+	over := int64(len(pat) - 1)
+	stopped := false
+	find := func(a, b int64) (int64, bool) {
+		if forward {
+			for a < b {
+				c := min64(a+searchChunk, b)
+				if i := indexPattern(h.read(a, c+over-a), pat, mask, true); i >= 0 && a+int64(i) < b {
+					return a + int64(i), true
+				}
+				if stopped = e.interrupted(); stopped {
+					return 0, false
+				}
+				a = c
+			}
+			return 0, false
+		}
+		for a < b {
+			c := max64(b-searchChunk, a)
+			if i := indexPattern(h.read(c, b+over-c), pat, mask, false); i >= 0 {
+				return c + int64(i), true
+			}
+			if stopped = e.interrupted(); stopped {
+				return 0, false
+			}
+			b = c
+		}
+		return 0, false
+	}
+	if e.scr != nil && h.size > searchChunk {
+		e.status = "searching... (Esc to stop)"
+		e.draw()
+	}
+	var off int64
+	if forward {
+		if off, ok = find(h.cursor+1, h.size); !ok && !stopped {
+			wrapped = true
+			off, ok = find(0, h.cursor+1)
+		}
+	} else {
+		if off, ok = find(0, h.cursor); !ok && !stopped {
+			wrapped = true
+			off, ok = find(h.cursor, h.size)
+		}
+	}
+	if stopped {
+		return false, false, errors.New("Interrupted")
+	}
+	if !ok {
+		return false, false, nil
+	}
+	h.cursor, h.nibble = off, 0
+	return wrapped, true, nil
+}
+
+// parseOffset reads an offset for :N in hex mode, decimal or 0x hex
+func parseOffset(s string) (int64, bool) {
+	if rest, ok := strings.CutPrefix(strings.ToLower(s), "0x"); ok {
+		n, err := strconv.ParseInt(rest, 16, 64)
+		return n, err == nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// hexCommands are the ex commands that make sense without lines
+var hexCommands = map[string]bool{
+	"q": true, "quit": true, "clo": true, "close": true, "qa": true, "qall": true,
+	"quita": true, "quitall": true, "wqa": true, "wqall": true, "xa": true, "xall": true,
+	"vs": true, "vsplit": true, "w": true, "write": true, "wq": true, "x": true,
+	"xit": true, "exit": true, "e": true, "edit": true, "!": true, "norm": true,
+	"normal": true, "set": true, "se": true, "noh": true, "nohl": true,
+	"nohlsearch": true, "h": true, "help": true, "hex": true,
+}
+
+// hexCheck refuses the ex commands that work on lines in hex mode
+func hexCheck(c *exCmd) error {
+	_, mapping := mapModes[c.name]
+	_, unmapping := unmapModes[c.name]
+	switch {
+	case len(c.addrs) > 0 || c.name == "":
+		return errors.New("E: there are no lines in hex mode; :N goes to offset N")
+	case strings.HasPrefix(c.arg, ">>") && (c.name == "w" || c.name == "write"):
+		return errors.New("E: can't append in hex mode")
+	case !hexCommands[c.name] && !mapping && !unmapping:
+		return fmt.Errorf("E: :%s works on lines, which hex mode doesn't have", c.name)
+	}
+	return nil
+}
+
+// toggleHex implements :hex, switching the current buffer between text and
+// hex mode. Bytes edited in hex become lines again on the way back.
+func (e *editor) toggleHex() error {
+	b := e.buffer
+	if b.hex == nil {
+		var off int64
+		if b.pg != nil {
+			if b.modified {
+				return errors.New("E: write the file before switching it to hex")
+			}
+			h, err := newHexFile(b.filename)
+			if err != nil {
+				return err
+			}
+			b.pg.file.close()
+			b.pg = nil
+			b.hex = h
+		} else {
+			off = int64(len(encodeLines(b.lines[:e.row], fileFormat{crlf: b.format.crlf, eol: true})) + e.col)
+			b.hex = newHexData(encodeLines(b.lines, b.format))
+		}
+		e.setMode("NORMAL")
+		e.setHexCursor(off)
+		return nil
+	}
+	h := b.hex
+	if h.size >= largeFileSize {
+		if b.modified || h.file == nil {
+			return errors.New("E: too big to edit as text; write it and open it again")
+		}
+		h.close()
+		b.hex = nil
+		b.lines = []string{""}
+		if !b.openLarge(b.filename) {
+			return errors.New("E: can't page " + b.filename)
+		}
+		e.row, e.col = 0, 0
+		return nil
+	}
+	e.saveSnapshot()
+	b.lines, b.format = decodeLines(string(h.read(0, h.size)))
+	h.close()
+	b.hex = nil
+	e.row, e.col = 0, 0
+	for _, w := range e.wins {
+		if w.buffer == b {
+			w.row, w.col, w.topLine = 0, 0, 0
+		}
+	}
+	return nil
+}
+
+// writeHex saves a hex buffer's bytes to name. A device is patched in place,
+// which works as long as no bytes were inserted or deleted; files are
+// replaced as usual.
+func (b *buffer) writeHex(name string) error {
+	h := b.hex
+	if info, err := os.Stat(name); err == nil && isDevice(info) {
+		return b.patchDevice(name)
+	}
+	same := name == b.filename && h.file != nil
+	if err := atomicWriteFrom(name, h.writeTo, !same); err != nil || !same {
+		return err
+	}
+	// the old file is gone, so read the new one
+	nh, err := newHexFile(name)
+	if err != nil {
+		return err
+	}
+	nh.cursor, nh.top, nh.ascii = h.cursor, h.top, h.ascii
+	h.close()
+	b.hex = nh
+	return nil
+}
+
+// patchDevice writes the changed bytes of a hex buffer over the same
+// offsets of a device
+func (b *buffer) patchDevice(name string) error {
+	h := b.hex
+	if h.file == nil || name != b.filename {
+		return errors.New("can only patch the device the buffer was read from")
+	}
+	pos := int64(0)
+	for _, p := range h.pieces {
+		if !p.added && p.off != pos || h.size != h.file.size {
+			return errors.New("bytes were inserted or deleted; a device can only be overwritten")
+		}
+		pos += p.n
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	pos = 0
+	for _, p := range h.pieces {
+		if p.added {
+			if _, err := f.WriteAt(h.added[p.off:p.off+p.n], pos); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		pos += p.n
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// the mapping sees what was written, so the file is the original again
+	h.pieces = []piece{{off: 0, n: h.size}}
+	h.added, h.undo, h.redo = nil, nil, nil
+	return nil
+}
+
+// hexMouse handles the mouse over a hex window: a click puts the cursor on
+// the byte under it and the wheel scrolls. It reports whether the event was
+// for a hex window.
+func (e *editor) hexMouse(ev mouseEvent, height int) bool {
+	w, border := e.windowAt(ev.x)
+	if w.hex == nil || border || ev.y >= height {
+		return false
+	}
+	h := w.hex
+	bpr, offW := hexLayout(w)
+	switch {
+	case ev.button == mouseWheelUp || ev.button == mouseWheelDown:
+		n := int64(wheelLines * bpr)
+		if ev.button == mouseWheelUp {
+			n = -n
+		}
+		h.top = max64(min64(h.top+n, h.size-h.size%int64(bpr)), 0)
+		if h.cursor < h.top || h.cursor >= h.top+int64(height*bpr) {
+			h.cursor = min64(max64(h.cursor, h.top), h.top+int64(height*bpr)-1)
+			h.cursor = max64(min64(h.cursor, h.size-1), 0)
+		}
+	case ev.button == mouseLeft && !ev.release:
+		e.focus(w)
+		x := ev.x - w.x
+		j, ascii := -1, false
+		for i := 0; i < bpr; i++ {
+			if x >= hexCol(bpr, offW, i) && x < hexCol(bpr, offW, i)+3 {
+				j = i
+			}
+			if x == asciiCol(bpr, offW, i) {
+				j, ascii = i, true
+			}
+		}
+		if j >= 0 {
+			h.ascii = ascii
+			e.setHexCursor(h.top + int64(ev.y*bpr+j))
+		}
+	}
+	return true
+}
+
+// sizeLabel is the size given in messages about the buffer: lines, or bytes
+// in hex mode
+func (b *buffer) sizeLabel() string {
+	if b.hex != nil {
+		return fmt.Sprintf("%dB", b.hex.size)
+	}
+	n, _ := b.lineCount()
+	return fmt.Sprintf("%dL", n)
+}
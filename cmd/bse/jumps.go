@@ -0,0 +1,88 @@
+package main
+
+// maxJumps bounds each window's jump list
+const maxJumps = 100
+
+// pushJump records the cursor position on the jump list before a large
+// motion, dropping an older entry for the same line. It also sets the ”
+// mark, which returns to the position before the latest jump.
+func (e *editor) pushJump() {
+	if e.inGlobal {
+		return
+	}
+	here := mark{e.row, e.col}
+	jumps := e.jumps[:0:0]
+	for _, j := range e.jumps {
+		if j.row != here.row {
+			jumps = append(jumps, j)
+		}
+	}
+	jumps = append(jumps, here)
+	if len(jumps) > maxJumps {
+		jumps = jumps[len(jumps)-maxJumps:]
+	}
+	e.jumps = jumps
+	e.jumpIdx = len(jumps)
+	e.marks['\''] = here
+}
+
+// jumpOlder implements Ctrl-O: go back n entries in the jump list. Leaving
+// the newest position saves it first so Ctrl-I can return to it.
+func (e *editor) jumpOlder(n int) {
+	if e.jumpIdx >= len(e.jumps) {
+		e.pushJump()
+		e.jumpIdx = len(e.jumps) - 1
+	}
+	if e.jumpIdx-n < 0 {
+		e.abortKeys()
+		return
+	}
+	e.jumpIdx -= n
+	e.gotoMark(e.jumps[e.jumpIdx], true)
+}
+
+// jumpNewer implements Ctrl-I (Tab): go forward n entries in the jump list
+func (e *editor) jumpNewer(n int) {
+	if e.jumpIdx+n >= len(e.jumps) {
+		e.abortKeys()
+		return
+	}
+	e.jumpIdx += n
+	e.gotoMark(e.jumps[e.jumpIdx], true)
+}
+
+// gotoMark moves the cursor to m, clamped to the buffer as it is now. With
+// exact unset it goes to the first non-blank of the line, like 'a.
+func (e *editor) gotoMark(m mark, exact bool) {
+	e.row = min(m.row, len(e.lines)-1)
+	e.col = 0
+	if exact {
+		e.col = min(m.col, len(e.lines[e.row]))
+	} else {
+		e.moveCursor('^')
+	}
+}
+
+// jumpToMark implements 'x and `x
+func (e *editor) jumpToMark(name rune, exact bool) {
+	if name == '`' {
+		name = '\''
+	}
+	m, ok := e.marks[name]
+	if !ok {
+		e.status = "E20: Mark not set"
+		e.abortKeys()
+		return
+	}
+	e.pushJump()
+	e.gotoMark(m, exact)
+}
+
+// setMark implements m{a-z}
+func (e *editor) setMark(name rune) {
+	if name < 'a' || name > 'z' {
+		e.status = "E191: Argument must be a letter or forward/backward quote"
+		return
+	}
+	e.marks[name] = mark{e.row, e.col}
+}
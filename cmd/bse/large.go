@@ -0,0 +1,958 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Files of largeFileSize bytes or more (and block devices) are edited in
+// large-file mode: the file is mapped instead of read, only a page of it is
+// held as lines, and edits become overlays on the original bytes until the
+// file is written.
+const (
+	largeFileSize = 64 << 20
+	pageLines     = 4096     // lines held at a time
+	maxLineBytes  = 64 << 10 // longer lines are shown broken into pieces
+	indexStep     = 1024     // lines between line index checkpoints
+	pollLines     = 1 << 16  // lines scanned between checks for Esc
+)
+
+// lazyFile is a large file opened for paging: its bytes, mapped when the
+// system allows it and read on demand otherwise, and a line index built in
+// the background.
+//
+// A line ends at a newline, or at a multiple of maxLineBytes with no newline
+// in the maxLineBytes before it. The second rule only breaks up overlong
+// lines, and being local it gives the same lines scanning either way.
+type lazyFile struct {
+	f    *os.File
+	data []byte
+	size int64
+
+	mu          sync.Mutex
+	checkpoints []int64 // where every indexStep'th line starts
+	lines       int     // lines indexed so far
+	done        bool
+	stop        chan struct{}
+	stopped     chan struct{}
+}
+
+// openLazy opens a file for paging, starting its line index unless the lines
+// aren't wanted (as in hex mode)
+func openLazy(name string, index bool) (*lazyFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	// seeking also finds the size of a block device, which stat reports as 0
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil || size == 0 {
+		f.Close()
+		return nil, errors.New("nothing to page")
+	}
+	lf := &lazyFile{f: f, size: size, stop: make(chan struct{}), stopped: make(chan struct{})}
+	if int64(int(size)) == size {
+		lf.data = mapFile(f, int(size))
+	}
+	if index {
+		go lf.index()
+	} else {
+		close(lf.stopped)
+	}
+	return lf, nil
+}
+
+// close stops the indexer and releases the file
+func (lf *lazyFile) close() {
+	close(lf.stop)
+	<-lf.stopped
+	if lf.data != nil {
+		unmapFile(lf.data)
+	}
+	lf.f.Close()
+}
+
+// bytesAt returns the bytes [from, to) of the file, cut short at its end
+func (lf *lazyFile) bytesAt(from, to int64) []byte {
+	if to > lf.size {
+		to = lf.size
+	}
+	if from >= to {
+		return nil
+	}
+	if lf.data != nil {
+		return lf.data[from:to]
+	}
+	buf := make([]byte, to-from)
+	n, _ := lf.f.ReadAt(buf, from)
+	return buf[:n]
+}
+
+// nextLine returns where the line starting at s ends and the next one starts
+func (lf *lazyFile) nextLine(s int64) (end, next int64) {
+	c := s - s%maxLineBytes + maxLineBytes
+	if s%maxLineBytes != 0 {
+		// the newline before s is too close for the line to break at c
+		if i := bytes.IndexByte(lf.bytesAt(s, c), '\n'); i >= 0 {
+			return s + int64(i), s + int64(i) + 1
+		}
+		if c >= lf.size {
+			return lf.size, lf.size
+		}
+		s, c = c, c+maxLineBytes
+	}
+	if i := bytes.IndexByte(lf.bytesAt(s, c), '\n'); i >= 0 {
+		return s + int64(i), s + int64(i) + 1
+	}
+	if c >= lf.size {
+		return lf.size, lf.size
+	}
+	return c, c
+}
+
+// lineStart returns where the line holding byte off starts
+func (lf *lazyFile) lineStart(off int64) int64 {
+	c := off - off%maxLineBytes
+	if i := bytes.LastIndexByte(lf.bytesAt(c, off), '\n'); i >= 0 {
+		return c + int64(i) + 1
+	}
+	if c == 0 {
+		return 0
+	}
+	i := bytes.LastIndexByte(lf.bytesAt(c-maxLineBytes, c), '\n')
+	if i < 0 {
+		return c
+	}
+	return c - maxLineBytes + int64(i) + 1
+}
+
+// index counts the file's lines, recording a checkpoint every indexStep
+func (lf *lazyFile) index() {
+	defer close(lf.stopped)
+	var s int64
+	n := 0
+	for s < lf.size {
+		if n%indexStep == 0 {
+			select {
+			case <-lf.stop:
+				return
+			default:
+			}
+			lf.mu.Lock()
+			lf.checkpoints = append(lf.checkpoints, s)
+			lf.lines = n
+			lf.mu.Unlock()
+		}
+		_, s = lf.nextLine(s)
+		n++
+	}
+	lf.mu.Lock()
+	lf.lines = n
+	lf.done = true
+	lf.mu.Unlock()
+}
+
+// progress returns how many lines have been indexed and whether that is all
+func (lf *lazyFile) progress() (int, bool) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.lines, lf.done
+}
+
+// lineOf returns the number of the line starting at off, once the index has
+// reached it
+func (lf *lazyFile) lineOf(off int64) (int, bool) {
+	lf.mu.Lock()
+	cps, lines, done := lf.checkpoints, lf.lines, lf.done
+	lf.mu.Unlock()
+	if off >= lf.size {
+		return lines, done
+	}
+	i := sort.Search(len(cps), func(i int) bool { return cps[i] > off }) - 1
+	if i < 0 {
+		return 0, false
+	}
+	s, n := cps[i], i*indexStep
+	for k := 0; s < off && k < indexStep; k++ {
+		_, s = lf.nextLine(s)
+		n++
+	}
+	return n, s == off
+}
+
+// offsetOfLine returns where line n starts, once the index has reached it
+func (lf *lazyFile) offsetOfLine(n int) (int64, bool) {
+	lf.mu.Lock()
+	cps, lines, done := lf.checkpoints, lf.lines, lf.done
+	lf.mu.Unlock()
+	if done && n >= lines {
+		return lf.size, true
+	}
+	if n/indexStep >= len(cps) {
+		return 0, false
+	}
+	s := cps[n/indexStep]
+	for k := 0; k < n%indexStep && s < lf.size; k++ {
+		_, s = lf.nextLine(s)
+	}
+	return s, s < lf.size
+}
+
+// isDevice reports whether info describes a block device
+func isDevice(info os.FileInfo) bool {
+	return info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0
+}
+
+// overlay replaces the whole lines in the bytes [start, end) of the file
+type overlay struct {
+	start, end int64
+	origLines  int  // how many lines the bytes held
+	split      bool // they included pieces of an overlong line
+	lines      []string
+}
+
+// pager is the large-file state of a buffer, whose lines are then one page
+// of the file as edited. Page lines are identified by the offset of a line
+// of the file (or the start of an overlay) and how many lines past it they
+// are.
+type pager struct {
+	file     *lazyFile
+	crlf     bool
+	overlays []overlay // sorted, never overlapping
+
+	start, end int64    // the bytes the page covers
+	offs       []int64  // where each line started when loaded; -1 inside an overlay
+	orig       []string // the lines as loaded, to find what has changed since
+	changes    int      // the buffer's change count when loaded
+}
+
+// openLarge sets b up to page through name, reporting whether it could
+func (b *buffer) openLarge(name string) bool {
+	lf, err := openLazy(name, true)
+	if err != nil {
+		return false
+	}
+	b.pg = &pager{file: lf}
+	if end, next := lf.nextLine(0); next == end+1 && end > 0 && lf.bytesAt(end-1, end)[0] == '\r' {
+		b.pg.crlf = true
+		b.format.crlf = true
+	}
+	b.loadPage(0, 0)
+	b.swapFile = ""
+	return true
+}
+
+// overlayAt returns the overlay starting at off, if any
+func (p *pager) overlayAt(off int64) *overlay {
+	i := sort.Search(len(p.overlays), func(i int) bool { return p.overlays[i].start >= off })
+	if i < len(p.overlays) && p.overlays[i].start == off {
+		return &p.overlays[i]
+	}
+	return nil
+}
+
+// overlayEnding returns the overlay ending at off, if any
+func (p *pager) overlayEnding(off int64) *overlay {
+	i := sort.Search(len(p.overlays), func(i int) bool { return p.overlays[i].end >= off })
+	if i < len(p.overlays) && p.overlays[i].end == off {
+		return &p.overlays[i]
+	}
+	return nil
+}
+
+// line returns the text of the file's line starting at s and where the next
+// one starts
+func (p *pager) line(s int64) ([]byte, int64) {
+	end, next := p.file.nextLine(s)
+	if p.crlf && next == end+1 && end > s && p.file.bytesAt(end-1, end)[0] == '\r' {
+		end--
+	}
+	return p.file.bytesAt(s, end), next
+}
+
+// loadPage makes the page the lines from start, a line boundary, on: at
+// least pageLines of them, and enough to include the line starting at past
+func (b *buffer) loadPage(start, past int64) {
+	p := b.pg
+	var lines []string
+	var offs []int64
+	pos := start
+	for pos < p.file.size && (len(lines) < pageLines || pos <= past) {
+		if ov := p.overlayAt(pos); ov != nil {
+			for i, l := range ov.lines {
+				lines = append(lines, l)
+				offs = append(offs, -1)
+				if i == 0 {
+					offs[len(offs)-1] = pos
+				}
+			}
+			pos = ov.end
+			continue
+		}
+		text, next := p.line(pos)
+		lines = append(lines, string(text))
+		offs = append(offs, pos)
+		pos = next
+	}
+	if len(lines) == 0 {
+		// everything from start on has been deleted
+		lines, offs = []string{""}, []int64{pos}
+	}
+	p.start, p.end, p.offs = start, pos, offs
+	p.orig = append([]string(nil), lines...)
+	p.changes = b.changes
+	b.lines = lines
+}
+
+// flushPage turns the edits made to the page since it was loaded into an
+// overlay covering the lines that changed
+func (b *buffer) flushPage() {
+	p := b.pg
+	if p == nil || b.changes == p.changes {
+		return
+	}
+	p.changes = b.changes
+	orig, lines := p.orig, b.lines
+	pre := 0
+	for pre < len(orig) && pre < len(lines) && orig[pre] == lines[pre] {
+		pre++
+	}
+	if pre == len(orig) && pre == len(lines) {
+		return
+	}
+	suf := 0
+	for suf < len(orig)-pre && suf < len(lines)-pre && orig[len(orig)-1-suf] == lines[len(lines)-1-suf] {
+		suf++
+	}
+	// replace at least one line of the file, and start and end on lines of
+	// the file rather than inside an older overlay
+	if pre+suf == len(orig) {
+		if pre > 0 {
+			pre--
+		} else {
+			suf--
+		}
+	}
+	for pre > 0 && p.offs[pre] < 0 {
+		pre--
+	}
+	for suf > 0 && p.offs[len(orig)-suf] < 0 {
+		suf--
+	}
+	from, to := p.offs[pre], p.end
+	if suf > 0 {
+		to = p.offs[len(orig)-suf]
+	}
+	ov := overlay{start: from, end: to, lines: append([]string(nil), lines[pre:len(lines)-suf]...)}
+	for pos := from; pos < to; {
+		if o := p.overlayAt(pos); o != nil {
+			ov.origLines += o.origLines
+			ov.split = ov.split || o.split
+			pos = o.end
+			continue
+		}
+		end, next := p.file.nextLine(pos)
+		ov.split = ov.split || (end == next && next < p.file.size)
+		ov.origLines++
+		pos = next
+	}
+	kept := p.overlays[:0:0]
+	for _, o := range p.overlays {
+		if o.start < from || o.end > to {
+			kept = append(kept, o)
+		}
+	}
+	i := sort.Search(len(kept), func(i int) bool { return kept[i].start >= from })
+	p.overlays = append(kept[:i], append([]overlay{ov}, kept[i:]...)...)
+
+	offs := append([]int64(nil), p.offs[:pre]...)
+	for i := range ov.lines {
+		offs = append(offs, -1)
+		if i == 0 {
+			offs[len(offs)-1] = from
+		}
+	}
+	p.offs = append(offs, p.offs[len(orig)-suf:]...)
+	p.orig = append([]string(nil), lines...)
+}
+
+// back returns the line boundary n lines of the file as edited before off
+func (p *pager) back(off int64, n int) int64 {
+	for n > 0 && off > 0 {
+		if ov := p.overlayEnding(off); ov != nil {
+			n -= max(len(ov.lines), 1)
+			off = ov.start
+			continue
+		}
+		off = p.file.lineStart(off - 1)
+		n--
+	}
+	return off
+}
+
+// rowOf returns the page row of the line k lines after boundary off
+func (p *pager) rowOf(off int64, k int) int {
+	for i, o := range p.offs {
+		if o >= off {
+			return min(i+k, len(p.offs)-1)
+		}
+	}
+	return len(p.offs) - 1
+}
+
+// firstLine returns the number of the page's first line in the file as
+// edited, once the index has got that far
+func (b *buffer) firstLine() (int, bool) {
+	p := b.pg
+	n, ok := p.file.lineOf(p.offs[0])
+	for _, ov := range p.overlays {
+		if ov.end <= p.offs[0] {
+			n += len(ov.lines) - ov.origLines
+		}
+	}
+	return n, ok
+}
+
+// lineCount returns how many lines the buffer has, and false while a large
+// file is still being indexed and there may be more
+func (b *buffer) lineCount() (int, bool) {
+	p := b.pg
+	if p == nil {
+		return len(b.lines), true
+	}
+	n, done := p.file.progress()
+	for _, ov := range p.overlays {
+		n += len(ov.lines) - ov.origLines
+	}
+	return n + len(b.lines) - len(p.orig), done
+}
+
+// posOfLine finds line n (0-based) of the file as edited, as a boundary and
+// a count of lines past it
+func (p *pager) posOfLine(n int) (int64, int, bool) {
+	if n <= 0 {
+		return 0, 0, true
+	}
+	delta := 0
+	for _, ov := range p.overlays {
+		first, ok := p.file.lineOf(ov.start)
+		if !ok {
+			return 0, 0, false
+		}
+		at := first + delta
+		if n < at {
+			break
+		}
+		if n < at+len(ov.lines) {
+			return ov.start, n - at, true
+		}
+		delta += len(ov.lines) - ov.origLines
+	}
+	off, ok := p.file.offsetOfLine(n - delta)
+	return off, 0, ok
+}
+
+// switchPage replaces the page with the one from start (covering past).
+// Windows on the buffer, marks and jump lists keep their lines when the two
+// pages overlap and are reset when they don't. Undo does not reach back
+// past a page switch.
+func (e *editor) switchPage(start, past int64) {
+	b := e.buffer
+	p := b.pg
+	b.flushPage()
+	oldOffs := p.offs
+	b.loadPage(start, past)
+	shift, n := 0, len(b.lines)
+	if j := indexOffset(p.offs, oldOffs[0]); j >= 0 {
+		shift = j
+	} else if i := indexOffset(oldOffs, p.offs[0]); i >= 0 {
+		shift = -i
+	} else {
+		n = 0
+	}
+	move := func(row int) (int, bool) {
+		row += shift
+		return row, row >= 0 && row < n
+	}
+	b.undoStack, b.redoStack = nil, nil
+	for name, m := range b.marks {
+		var ok bool
+		if m.row, ok = move(m.row); ok {
+			b.marks[name] = m
+		} else {
+			delete(b.marks, name)
+		}
+	}
+	for _, w := range e.wins {
+		if w.buffer != b {
+			continue
+		}
+		jumps := w.jumps[:0:0]
+		for _, j := range w.jumps {
+			if row, ok := move(j.row); ok {
+				jumps = append(jumps, mark{row, j.col})
+			}
+		}
+		w.jumps, w.jumpIdx = jumps, len(jumps)
+		var ok1, ok2 bool
+		w.lastVisual.anchorRow, ok1 = move(w.lastVisual.anchorRow)
+		w.lastVisual.row, ok2 = move(w.lastVisual.row)
+		w.lastVisual.valid = w.lastVisual.valid && ok1 && ok2
+		// a selection being made loses what is no longer in the page
+		w.visual.anchorRow, _ = move(w.visual.anchorRow)
+		w.visual.anchorRow = min(max(w.visual.anchorRow, 0), len(b.lines)-1)
+		w.row, _ = move(w.row)
+		w.topLine, _ = move(w.topLine)
+		w.row = min(max(w.row, 0), len(b.lines)-1)
+		w.topLine = min(max(w.topLine, 0), w.row)
+	}
+}
+
+func indexOffset(offs []int64, off int64) int {
+	for i, o := range offs {
+		if o == off {
+			return i
+		}
+	}
+	return -1
+}
+
+// slidePage moves the page along when the cursor is at its last (or first)
+// line, and reports whether there was more of the file that way
+func (e *editor) slidePage(forward bool) bool {
+	p := e.pg
+	if p == nil {
+		return false
+	}
+	e.flushPage()
+	if !forward {
+		if p.start == 0 {
+			return false
+		}
+		e.switchPage(p.back(p.start, pageLines/2), 0)
+		return true
+	}
+	if p.end >= p.file.size {
+		return false
+	}
+	i := max(e.row-pageLines/2, 0)
+	for i > 0 && p.offs[i] < 0 {
+		i--
+	}
+	e.switchPage(p.offs[i], p.end)
+	return true
+}
+
+// gotoPos moves the cursor to the line k lines after boundary off, loading
+// the page around it if it isn't in this one
+func (e *editor) gotoPos(off int64, k int) {
+	p := e.pg
+	e.flushPage()
+	if off < p.offs[0] || off >= p.end {
+		e.switchPage(p.back(off, pageLines/2), off)
+	}
+	e.row = p.rowOf(off, k)
+	e.col = 0
+}
+
+// gotoLine moves the cursor to line n (0-based) of the buffer
+func (e *editor) gotoLine(n int) {
+	if e.pg == nil {
+		e.row = min(max(n, 0), len(e.lines)-1)
+		return
+	}
+	e.flushPage()
+	off, k, ok := e.pg.posOfLine(n)
+	if !ok {
+		lines, _ := e.pg.file.progress()
+		e.status = fmt.Sprintf("line %d is not indexed yet (%d lines so far)", n+1, lines)
+		e.abortKeys()
+		return
+	}
+	e.gotoPos(off, k)
+}
+
+// gotoEnd moves the cursor to the last line of the buffer
+func (e *editor) gotoEnd() {
+	if p := e.pg; p != nil && p.end < p.file.size {
+		e.switchPage(p.back(p.file.size, pageLines-1), p.file.size)
+	}
+	e.row = len(e.lines) - 1
+}
+
+// indexing reports whether any window's file is still being indexed
+func (e *editor) indexing() bool {
+	for _, w := range e.wins {
+		if w.pg != nil {
+			if _, done := w.pg.file.progress(); !done {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findMatchLarge searches a large file for re from the cursor: the rest of
+// the page, then the file beyond it, wrapping round to the page again. Esc
+// interrupts a long scan.
+func (e *editor) findMatchLarge(re *regexp.Regexp, forward bool) (wrapped, ok bool, err error) {
+	r, c, inWrapped, inOK := e.findMatch(re, e.row, e.col, forward)
+	if inOK && !inWrapped {
+		e.row, e.col = r, c
+		return false, true, nil
+	}
+	e.flushPage()
+	p := e.pg
+	if e.scr != nil {
+		e.status = "searching... (Esc to stop)"
+		e.draw()
+	}
+	s := &lineSearch{p: p, re: re, forward: forward, interrupted: e.interrupted}
+	if !p.crlf {
+		// whole chunks are matched at once, with ^ and $ at line ends
+		s.chunkRe, _ = regexp.Compile("(?m)" + re.String())
+	}
+	if forward {
+		if !s.run(p.end, p.file.size) {
+			wrapped = true
+			s.run(0, p.offs[0])
+		}
+	} else {
+		if !s.run(0, p.offs[0]) {
+			wrapped = true
+			s.run(p.end, p.file.size)
+		}
+	}
+	switch {
+	case s.stopped:
+		return false, false, errors.New("Interrupted")
+	case s.found:
+		e.gotoPos(s.off, s.k)
+		e.col = s.col
+		return wrapped, true, nil
+	case inOK:
+		e.row, e.col = r, c
+		return true, true, nil
+	}
+	return false, false, nil
+}
+
+// searchChunk is how much of a large file is matched against at once
+const searchChunk = 1 << 20
+
+// lineSearch looks for the first (or last) line with a match in part of a
+// large file. Overlays are searched line by line and the file's own bytes a
+// chunk at a time, checking the line of each match found there since a
+// match in a chunk may run across lines.
+type lineSearch struct {
+	p           *pager
+	re          *regexp.Regexp
+	chunkRe     *regexp.Regexp
+	forward     bool
+	interrupted func() bool
+
+	off       int64
+	k, col    int
+	found     bool
+	stopped   bool
+	sincePoll int64
+}
+
+// run searches [from, to), which starts and ends on line boundaries, and
+// reports whether it found a match or was stopped
+func (s *lineSearch) run(from, to int64) bool {
+	p := s.p
+	// the overlays in the range split it into stretches of the file's bytes
+	type part struct {
+		a, b int64
+		ov   *overlay
+	}
+	var parts []part
+	pos := from
+	i := sort.Search(len(p.overlays), func(i int) bool { return p.overlays[i].start >= from })
+	for ; i < len(p.overlays) && p.overlays[i].end <= to; i++ {
+		ov := &p.overlays[i]
+		parts = append(parts, part{pos, ov.start, nil}, part{ov.start, ov.end, ov})
+		pos = ov.end
+	}
+	parts = append(parts, part{pos, to, nil})
+	for n := range parts {
+		pt := parts[n]
+		if !s.forward {
+			pt = parts[len(parts)-1-n]
+		}
+		if pt.ov != nil {
+			s.searchLines(pt.ov)
+		} else {
+			s.searchBytes(pt.a, pt.b)
+		}
+		if s.found || s.stopped {
+			return true
+		}
+	}
+	return false
+}
+
+// match finds the first (or last) match of the search in a line
+func (s *lineSearch) match(line []byte) []int {
+	if s.forward {
+		return s.re.FindIndex(line)
+	}
+	if all := s.re.FindAllIndex(line, -1); len(all) > 0 {
+		return all[len(all)-1]
+	}
+	return nil
+}
+
+func (s *lineSearch) searchLines(ov *overlay) {
+	for n := range ov.lines {
+		i := n
+		if !s.forward {
+			i = len(ov.lines) - 1 - n
+		}
+		if loc := s.match([]byte(ov.lines[i])); loc != nil {
+			s.off, s.k, s.col, s.found = ov.start, i, loc[0], true
+			return
+		}
+	}
+}
+
+// poll checks for an interrupt every searchChunk bytes
+func (s *lineSearch) poll(n int64) bool {
+	if s.sincePoll += n; s.sincePoll >= searchChunk {
+		s.sincePoll = 0
+		s.stopped = s.interrupted()
+	}
+	return s.stopped
+}
+
+// checkLine looks for a match in the file's line starting at ls, and
+// returns where the next line starts
+func (s *lineSearch) checkLine(ls int64) (int64, bool) {
+	text, next := s.p.line(ls)
+	if loc := s.match(text); loc != nil {
+		s.off, s.k, s.col, s.found = ls, 0, loc[0], true
+		return next, true
+	}
+	return next, false
+}
+
+func (s *lineSearch) searchBytes(a, b int64) {
+	f := s.p.file
+	switch {
+	case s.chunkRe == nil && s.forward:
+		for pos := a; pos < b; {
+			next, ok := s.checkLine(pos)
+			if ok || s.poll(next-pos) {
+				return
+			}
+			pos = next
+		}
+	case s.chunkRe == nil:
+		for pos := b; pos > a; {
+			ls := f.lineStart(pos - 1)
+			if _, ok := s.checkLine(ls); ok || s.poll(pos-ls) {
+				return
+			}
+			pos = ls
+		}
+	case s.forward:
+		for a < b {
+			c := b
+			if b-a > searchChunk {
+				c = f.lineStart(a + searchChunk)
+			}
+			data := f.bytesAt(a, c)
+			for pos := 0; pos < len(data); {
+				loc := s.chunkRe.FindIndex(data[pos:])
+				if loc == nil {
+					break
+				}
+				next, ok := s.checkLine(max64(f.lineStart(a+int64(pos+loc[0])), a))
+				if ok {
+					return
+				}
+				pos = int(next - a)
+			}
+			if s.poll(c - a) {
+				return
+			}
+			a = c
+		}
+	default:
+		for a < b {
+			c := a
+			if b-a > searchChunk {
+				c = f.lineStart(b - searchChunk)
+			}
+			all := s.chunkRe.FindAllIndex(f.bytesAt(c, b), -1)
+			checked := int64(-1)
+			for n := len(all) - 1; n >= 0; n-- {
+				ls := max64(f.lineStart(c+int64(all[n][0])), c)
+				if ls == checked {
+					continue
+				}
+				checked = ls
+				if _, ok := s.checkLine(ls); ok {
+					return
+				}
+			}
+			if s.poll(b - c) {
+				return
+			}
+			b = c
+		}
+	}
+}
+
+// interrupted checks for Esc or Ctrl-C typed during a long operation. Other
+// keys are kept for afterwards.
+func (e *editor) interrupted() bool {
+	if e.keys == nil {
+		return false
+	}
+	select {
+	case k := <-e.keys:
+		switch k {
+		case keyEsc, 0x03:
+			return true
+		case keyMouse:
+			<-e.mouse
+		case keyPaste:
+			e.pasteText = <-e.pasted
+			e.pending = append(e.pending, k)
+		default:
+			e.pending = append(e.pending, k)
+		}
+	default:
+	}
+	return false
+}
+
+// writeLarge saves a paged buffer to name: the file's bytes with the
+// overlays in place of what they replace, streamed so that the file never
+// has to fit in memory. Saving over the file itself reopens it afterwards.
+func (b *buffer) writeLarge(name string) error {
+	b.flushPage()
+	p := b.pg
+	if info, err := os.Stat(b.filename); err == nil && isDevice(info) && name == b.filename {
+		return errors.New("can't rewrite a device in large-file mode")
+	}
+	var start, end int64
+	err := atomicWriteFrom(name, func(w io.Writer) error {
+		var err error
+		start, end, err = p.writeTo(w)
+		return err
+	}, name != b.filename)
+	if err != nil || name != b.filename {
+		return err
+	}
+	lf, err := openLazy(b.filename, true)
+	if err != nil {
+		return err
+	}
+	p.file.close()
+	*p = pager{file: lf, crlf: p.crlf}
+	// the page holds the same lines as before, now read from the new file
+	b.loadPage(start, end-1)
+	return nil
+}
+
+// writeTo streams the file as edited to w, returning where the page's
+// start and end ended up
+func (p *pager) writeTo(w io.Writer) (start, end int64, err error) {
+	var n int64
+	start, end = -1, -1
+	note := func(pos int64, at int64) {
+		if start < 0 && p.start <= pos {
+			start = at - (pos - p.start)
+		}
+		if end < 0 && p.end <= pos {
+			end = at - (pos - p.end)
+		}
+	}
+	copyTo := func(from, to int64) error {
+		m, err := io.Copy(w, io.NewSectionReader(p.file.f, from, to-from))
+		n += m
+		note(to, n)
+		return err
+	}
+	nl := "\n"
+	if p.crlf {
+		nl = "\r\n"
+	}
+	eol := p.file.bytesAt(p.file.size-1, p.file.size)[0] == '\n'
+	pos := int64(0)
+	for _, ov := range p.overlays {
+		if err := copyTo(pos, ov.start); err != nil {
+			return 0, 0, err
+		}
+		for i, l := range ov.lines {
+			if i < len(ov.lines)-1 || ov.end < p.file.size || eol {
+				l += nl
+			}
+			m, err := io.WriteString(w, l)
+			n += int64(m)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		pos = ov.end
+	}
+	if err := copyTo(pos, p.file.size); err != nil {
+		return 0, 0, err
+	}
+	return max64(start, 0), max64(end, 0), nil
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// reloadLarge implements :e! for a paged buffer: drop the overlays and read
+// the page again from the file
+func (b *buffer) reloadLarge() error {
+	p := b.pg
+	lf, err := openLazy(b.filename, true)
+	if err != nil {
+		return err
+	}
+	p.file.close()
+	*p = pager{file: lf, crlf: p.crlf}
+	b.loadPage(0, 0)
+	return nil
+}
+
+// checkWrite refuses, unless forced, to write a read-only buffer over its
+// file, or a large file whose edits touched an overlong line: its pieces
+// would be saved as separate lines
+func (b *buffer) checkWrite(name string, force bool) error {
+	if force {
+		return nil
+	}
+	if b.readonly && name == b.filename {
+		return errors.New("E45: 'readonly' option is set (add ! to override)")
+	}
+	if b.pg != nil {
+		b.flushPage()
+		for _, ov := range b.pg.overlays {
+			if ov.split {
+				return errors.New("an edit touched a line longer than 64KiB, which would be saved broken into lines (add ! to override)")
+			}
+		}
+	}
+	return nil
+}
+
+// indexTick is how often the screen is redrawn while a file is indexed
+const indexTick = 500 * time.Millisecond
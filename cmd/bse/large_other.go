@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// mapFile maps nothing where there is no mmap; the file is read on demand
+func mapFile(f *os.File, size int) []byte {
+	return nil
+}
+
+func unmapFile(data []byte) {}
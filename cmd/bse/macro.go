@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"unicode"
+)
+
+// maxMacroKeys stops a runaway count or self-replaying macro from queueing
+// keys without bound
+const maxMacroKeys = 1 << 20
+
+// macroRegister maps the register named after q or @ to where its keys are
+// kept; upper case names the same register as lower case
+func macroRegister(name rune) (rune, bool) {
+	switch {
+	case name >= 'a' && name <= 'z', name >= '0' && name <= '9', name == '"':
+		return name, true
+	case name >= 'A' && name <= 'Z':
+		return unicode.ToLower(name), true
+	}
+	return 0, false
+}
+
+// startRecording implements q{reg}: keys typed from now on are saved in reg.
+// Recording into an upper-case register appends to it.
+func (e *editor) startRecording(name rune) {
+	reg, ok := macroRegister(name)
+	if !ok {
+		return
+	}
+	e.recording = name
+	e.recorded = nil
+	if unicode.IsUpper(name) {
+		e.recorded = append(e.recorded, e.macros[reg]...)
+	}
+}
+
+// stopRecording ends q{reg}; the q that stopped it is not part of the macro
+func (e *editor) stopRecording() {
+	reg, _ := macroRegister(e.recording)
+	keys := e.recorded
+	if n := len(keys); n > 0 && keys[n-1] == 'q' {
+		keys = keys[:n-1]
+	}
+	if e.macros == nil {
+		e.macros = map[rune][]rune{}
+	}
+	e.macros[reg] = keys
+	e.recording = 0
+	e.recorded = nil
+}
+
+// replayMacro implements @{reg} and @@, queueing the register's keys count
+// times ahead of anything still pending. A command that fails while they run
+// drops the rest (see abortKeys), so 999@a stops at the end of the file.
+func (e *editor) replayMacro(name rune, count int) {
+	if name == '@' {
+		if e.lastMacro == 0 {
+			e.status = "E748: No previously used register"
+			return
+		}
+		name = e.lastMacro
+	}
+	reg, ok := macroRegister(name)
+	if !ok {
+		e.status = fmt.Sprintf("E354: Invalid register name: '%c'", name)
+		return
+	}
+	e.lastMacro = reg
+	keys := e.macros[reg]
+	if len(keys) == 0 {
+		return
+	}
+	count = min(count, maxMacroKeys/len(keys))
+	if len(e.pending)+count*len(keys) > maxMacroKeys {
+		e.status = "E169: Command too recursive"
+		e.abortKeys()
+		return
+	}
+	queued := make([]rune, 0, count*len(keys)+len(e.pending))
+	for i := 0; i < count; i++ {
+		queued = append(queued, keys...)
+	}
+	e.pending = append(queued, e.pending...)
+}
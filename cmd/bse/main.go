@@ -4,605 +4,911 @@ import (
 	"bufio"
 	"fmt"
 	"os"
-	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/term"
 )
 
-const tabWidth = 4
+// Special keys decoded from terminal escape sequences. They live above the
+// Unicode range so they can share a rune with ordinary input.
+const (
+	keyUp rune = 0x110000 + iota
+	keyDown
+	keyRight
+	keyLeft
+	keyHome
+	keyEnd
+	keyDelete
+	keyPgUp
+	keyPgDn
+	keyMouse // details in editor.mouseEv
+	keyPaste // text in editor.pasteText
+	keyNone
+)
+
+const keyEsc rune = 0x1b
+
+// snapshot is one entry on the undo/redo stacks
+type snapshot struct {
+	lines []string
+	row   int
+	col   int
+}
+
+// editor holds the whole state of a bse session. The current window (and
+// through it, its buffer) is embedded so e.lines, e.row and friends always
+// refer to what the cursor is in.
+type editor struct {
+	*window
+	wins []*window
+
+	mode   string
+	status string
+	cmd    string
+	width  int
+	height int
+
+	reg register
+
+	searchQuery string
+	search      searchState
+
+	blockInsert *blockInsert
+
+	in        *bufio.Reader
+	keys      chan rune
+	mouse     chan mouseEvent
+	mouseEv   mouseEvent
+	pasted    chan string
+	pasteText string // the last bracketed paste read
+	drag      mouseDrag
+	winch     chan os.Signal
+	scr       *screen
+	pending   []rune
+	// noremapKeys counts the keys at the front of pending that came from a
+	// mapping; keyNoremap is set when the last key read was one of them
+	noremapKeys int
+	keyNoremap  bool
+	maps        map[byte][]keymap
+	opts        options
+	macros      map[rune][]rune
+	recording   rune
+	recorded    []rune
+	lastMacro   rune
+	feeding     bool
+	holdUndo    int
+	oldState    *term.State
+	quit        bool
+
+	lastSubPat   string
+	lastSubRep   string
+	lastShellCmd string
+	inGlobal     bool
+	readonly     bool // -R: buffers are opened read-only
+	binary       bool // -b: buffers are opened in hex mode
+	diff         *diffState
+}
 
 // bse: a minimal vim-like text editor with normal/insert mode, syntax highlighting,
 // search, undo/redo, and mouse support
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Fprintln(os.Stderr, "bse: usage: bse FILE")
+	args, headless, err := parseArgs(os.Args[1:])
+	files := 1
+	if args != nil && args.diff {
+		files = 2
+	}
+	if err != nil || len(args.files) == 0 || (!headless && len(args.files) != files) || (args.diff && (headless || args.binary)) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "bse:", err)
+		}
+		fmt.Fprintln(os.Stderr, usage)
 		os.Exit(1)
 	}
-	filename := os.Args[1]
-	lines := []string{""}
-	if data, err := os.ReadFile(filename); err == nil {
-		content := string(data)
-		if content == "" {
-			lines = []string{""}
-		} else {
-			lines = strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
-			// Remove trailing empty line that split creates for files ending with newline
-			if len(lines) > 1 && lines[len(lines)-1] == "" {
-				lines = lines[:len(lines)-1]
-			}
+	e := &editor{
+		mode:     "NORMAL",
+		in:       bufio.NewReader(os.Stdin),
+		opts:     defaultOptions,
+		readonly: args.readonly,
+		binary:   args.binary,
+	}
+	if headless {
+		// scripts get the defaults, not the user's ~/.bserc
+		if !e.runBatch(args) {
+			os.Exit(1)
+		}
+		return
+	}
+	if args.binary {
+		e.window = &window{buffer: openHexBuffer(args.files[0])}
+	} else {
+		// diffs compare whole files, so they aren't paged
+		e.window = &window{buffer: openBuffer(args.files[0], !args.diff)}
+	}
+	e.window.readonly = args.readonly
+	e.wins = []*window{e.window}
+	if args.diff {
+		b := openBuffer(args.files[1], false)
+		b.readonly = args.readonly
+		if _, err := os.Stat(b.swapFile); err == nil {
+			// as with :vs, only the first file offers recovery
+			b.swapFile = ""
 		}
+		e.wins = append(e.wins, &window{buffer: b})
+		e.startDiff(e.wins[0], e.wins[1])
 	}
-	row, col := 0, 0
-	topLine := 0
-	leftCol := 0
-	mode := "NORMAL"
-	status := ""
-	modified := false
-
-	oldState, _ := term.MakeRaw(int(os.Stdin.Fd()))
-	defer term.Restore(int(os.Stdin.Fd()), oldState)
-
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
-	go func() {
-		<-sigCh
-		term.Restore(int(os.Stdin.Fd()), oldState)
-		os.Exit(0)
-	}()
-
-	stdin := bufio.NewReader(os.Stdin)
-	cmd := ""
-	width, height, _ := term.GetSize(int(os.Stdin.Fd()))
-	windowHeight := height - 1
-
-	// Undo/redo stacks
-	type snapshot struct {
-		lines []string
-		row   int
-		col   int
-	}
-	undoStack := []snapshot{}
-	redoStack := []snapshot{}
-
-	saveSnapshot := func() {
-		linesCopy := make([]string, len(lines))
-		copy(linesCopy, lines)
-		undoStack = append(undoStack, snapshot{lines: linesCopy, row: row, col: col})
-		redoStack = nil // clear redo on new action
-	}
-
-	// Search state
-	searchQuery := ""
-	searchResults := []int{}
-
-	performSearch := func(query string, forward bool) {
-		if query == "" {
-			searchResults = nil
+	e.loadRC(rcPath())
+	if !e.checkSwap(e.in) {
+		os.Exit(1)
+	}
+
+	e.startTerminal()
+	defer e.stopTerminal()
+	e.run()
+}
+
+// readLines loads a file and splits it into lines, noting its line endings
+func readLines(filename string) ([]string, fileFormat, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fileFormat{eol: true}, err
+	}
+	lines, format := decodeLines(string(data))
+	return lines, format, nil
+}
+
+// decodeLines splits file contents into lines. They are treated as CRLF only
+// when every line ends in \r\n; otherwise any stray \r is kept as part of its
+// line so the bytes survive a round trip.
+func decodeLines(content string) ([]string, fileFormat) {
+	if content == "" {
+		return []string{""}, fileFormat{}
+	}
+	format := fileFormat{eol: strings.HasSuffix(content, "\n")}
+	if n := strings.Count(content, "\n"); n > 0 && strings.Count(content, "\r\n") == n {
+		format.crlf = true
+		content = strings.ReplaceAll(content, "\r\n", "\n")
+	}
+	lines := strings.Split(content, "\n")
+	// Remove trailing empty line that split creates for files ending with newline
+	if len(lines) > 1 && format.eol {
+		lines = lines[:len(lines)-1]
+	}
+	return lines, format
+}
+
+// writeFile saves the whole buffer to name in the file's own format
+func (b *buffer) writeFile(name string) error {
+	if b.pg != nil {
+		return b.writeLarge(name)
+	}
+	if b.hex != nil {
+		return b.writeHex(name)
+	}
+	if err := atomicWrite(name, encodeLines(b.lines, b.format)); err != nil {
+		return err
+	}
+	if name == b.filename {
+		b.removeSwap()
+	}
+	return nil
+}
+
+// run is the main edit loop: draw, read a key, dispatch it on the current mode
+func (e *editor) run() {
+	for !e.quit {
+		e.draw()
+		k := e.readMapped()
+		if k == keyNone {
 			return
 		}
-		searchResults = nil
-		q := strings.ToLower(query)
-		for i, line := range lines {
-			if strings.Contains(strings.ToLower(line), q) {
-				searchResults = append(searchResults, i)
-			}
+		e.dispatch(k)
+		e.maybeWriteSwap(false)
+	}
+	if e.quit {
+		for _, w := range e.wins {
+			w.removeSwap()
 		}
-		if len(searchResults) > 0 {
-			if forward {
-				for _, r := range searchResults {
-					if r > row {
-						row = r
-						col = 0
-						break
-					}
-				}
-			} else {
-				for i := len(searchResults) - 1; i >= 0; i-- {
-					if searchResults[i] < row {
-						row = searchResults[i]
-						col = 0
-						break
-					}
-				}
-			}
-			// If no new position found, wrap around
-			if forward && row < len(lines) && !contains(searchResults, row) {
-				row = searchResults[0]
-				col = 0
-			} else if !forward && row >= 0 && !contains(searchResults, row) {
-				row = searchResults[len(searchResults)-1]
-				col = 0
-			}
+	}
+}
+
+// dispatch handles one key in the current mode
+func (e *editor) dispatch(k rune) {
+	switch {
+	case k == keyMouse:
+		e.handleMouse(e.mouseEv)
+	case k == keyPaste:
+		e.handlePaste(e.pasteText)
+	case e.hex != nil && (e.mode == "NORMAL" || e.mode == "INSERT" || e.mode == "REPLACE"):
+		e.handleHex(k)
+	case e.mode == "NORMAL":
+		e.handleNormal(k)
+	case e.mode == "INSERT":
+		e.handleInsert(k)
+	case e.mode == "CMD":
+		e.handleCmd(k)
+	case e.mode == "SEARCH":
+		e.handleSearch(k)
+	case e.inVisual():
+		e.handleVisual(k)
+	}
+	e.clampRow()
+	e.col = graphemeStart(e.lines[e.row], min(e.col, len(e.lines[e.row])))
+}
+
+// unreadKey pushes a key back so the next readKey returns it
+func (e *editor) unreadKey(k rune) {
+	e.pending = append([]rune{k}, e.pending...)
+	if e.keyNoremap {
+		e.noremapKeys++
+	}
+}
+
+func (e *editor) saveSnapshot() {
+	e.changes++
+	if e.holdUndo > 0 {
+		return
+	}
+	linesCopy := make([]string, len(e.lines))
+	copy(linesCopy, e.lines)
+	e.undoStack = append(e.undoStack, snapshot{lines: linesCopy, row: e.row, col: e.col})
+	e.redoStack = nil // clear redo on new action
+}
+
+func (e *editor) clampRow() {
+	if e.row >= len(e.lines) {
+		e.row = len(e.lines) - 1
+	}
+	if e.row < 0 {
+		e.row = 0
+	}
+}
+
+func (e *editor) setMode(mode string) {
+	e.mode = mode
+	e.status = ""
+	if mode == "INSERT" {
+		e.status = "INSERT"
+	}
+}
+
+// moveCursor applies a cursor motion shared by normal and visual mode and
+// reports whether k was one
+func (e *editor) moveCursor(k rune) bool {
+	switch k {
+	case 'h', keyLeft:
+		if e.col > 0 {
+			e.col = prevBoundary(e.lines[e.row], e.col)
+		}
+	case 'l', keyRight:
+		if e.col < len(e.lines[e.row]) {
+			e.col = nextBoundary(e.lines[e.row], e.col)
+		}
+	case 'j', keyDown:
+		if e.row < len(e.lines)-1 || e.slidePage(true) {
+			e.moveToRow(e.row + 1)
+		} else {
+			e.abortKeys()
+		}
+	case 'k', keyUp:
+		if e.row > 0 || e.slidePage(false) {
+			e.moveToRow(e.row - 1)
+		} else {
+			e.abortKeys()
+		}
+	case '0', keyHome:
+		e.col = 0
+	case '$', keyEnd:
+		e.col = len(e.lines[e.row])
+		if e.mode == "NORMAL" && e.col > 0 {
+			// on the last character, not past it as in insert mode
+			e.col = prevBoundary(e.lines[e.row], e.col)
+		}
+	case '^':
+		e.col = len(e.lines[e.row]) - len(strings.TrimLeft(e.lines[e.row], " \t"))
+	case 'G':
+		e.pushJump()
+		e.gotoEnd()
+		e.col = 0
+	case keyPgDn:
+		if e.row+e.textHeight() >= len(e.lines) {
+			e.slidePage(true)
 		}
+		e.row = min(e.row+e.textHeight(), len(e.lines)-1)
+	case keyPgUp:
+		if e.row < e.textHeight() {
+			e.slidePage(false)
+		}
+		e.row = max(e.row-e.textHeight(), 0)
+	default:
+		return false
 	}
+	return true
+}
 
-	for {
-		// Adjust topLine for vertical scrolling
-		if row < topLine {
-			topLine = row
+// moveToRow moves the cursor to row, keeping it in the same screen column
+func (e *editor) moveToRow(row int) {
+	vcol := visualCol(e.lines[e.row], e.col)
+	e.row = row
+	e.col = byteColAtVisual(e.lines[e.row], vcol)
+}
+
+func (e *editor) handleNormal(k rune) {
+	if k >= '1' && k <= '9' {
+		e.handleCount(k)
+		return
+	}
+	if e.moveCursor(k) {
+		return
+	}
+	if (k == ']' || k == '[' || k == 'd' || k == 'z') && e.diffCommand(k) {
+		return
+	}
+	switch k {
+	case keyDelete, 'x':
+		if len(e.lines[e.row]) > 0 && e.col < len(e.lines[e.row]) {
+			e.saveSnapshot()
+			end := nextBoundary(e.lines[e.row], e.col)
+			e.reg = register{lines: []string{e.lines[e.row][e.col:end]}}
+			e.lines[e.row] = e.lines[e.row][:e.col] + e.lines[e.row][end:]
+			e.modified = true
+		}
+	case 'i':
+		e.setMode("INSERT")
+	case 'a':
+		e.setMode("INSERT")
+		e.col = nextBoundary(e.lines[e.row], e.col)
+	case 'I':
+		e.setMode("INSERT")
+		e.col = 0
+	case 'A':
+		e.setMode("INSERT")
+		e.col = len(e.lines[e.row])
+	case 'o':
+		e.saveSnapshot()
+		// open a line below; the current line stays as it is
+		indent := e.autoIndent(e.lines[e.row], true)
+		e.lines = append(e.lines[:e.row+1], append([]string{indent}, e.lines[e.row+1:]...)...)
+		e.row++
+		e.col = len(indent)
+		e.setMode("INSERT")
+		e.modified = true
+	case 'O':
+		e.saveSnapshot()
+		newLines := make([]string, len(e.lines)+1)
+		copy(newLines, e.lines[:e.row])
+		newLines[e.row] = e.autoIndent(e.lines[e.row], false)
+		copy(newLines[e.row+1:], e.lines[e.row:])
+		e.lines = newLines
+		e.col = len(newLines[e.row])
+		e.setMode("INSERT")
+		e.modified = true
+	case 'X':
+		if e.col > 0 {
+			e.saveSnapshot()
+			start := prevBoundary(e.lines[e.row], e.col)
+			e.lines[e.row] = e.lines[e.row][:start] + e.lines[e.row][e.col:]
+			e.col = start
+			e.modified = true
+		}
+	case 'd':
+		// dd - delete line
+		if next := e.readKey(); next != 'd' {
+			e.unreadKey(next)
+			return
+		}
+		if len(e.lines) > 1 {
+			e.saveSnapshot()
+			e.reg = register{lines: []string{e.lines[e.row]}, kind: visualLine}
+			e.lines = append(e.lines[:e.row], e.lines[e.row+1:]...)
+			e.clampRow()
+			e.col = min(e.col, len(e.lines[e.row]))
+			e.modified = true
+		}
+	case 'y':
+		// yy - yank (copy) line
+		if next := e.readKey(); next != 'y' {
+			e.unreadKey(next)
+			return
+		}
+		e.reg = register{lines: []string{e.lines[e.row]}, kind: visualLine}
+		e.status = fmt.Sprintf("yanked line %d", e.row+1)
+	case 'p':
+		e.put(true)
+	case 'P':
+		e.put(false)
+	case 'u':
+		// Undo
+		if len(e.undoStack) > 0 {
+			// Save current state to redo
+			linesCopy := make([]string, len(e.lines))
+			copy(linesCopy, e.lines)
+			e.redoStack = append(e.redoStack, snapshot{lines: linesCopy, row: e.row, col: e.col})
+			// Restore previous state
+			snap := e.undoStack[len(e.undoStack)-1]
+			e.undoStack = e.undoStack[:len(e.undoStack)-1]
+			e.lines = snap.lines
+			e.row = snap.row
+			e.col = snap.col
+			e.status = "undo"
+			e.changes++
+		}
+	case 0x12: // Ctrl+R - Redo
+		if len(e.redoStack) > 0 {
+			linesCopy := make([]string, len(e.lines))
+			copy(linesCopy, e.lines)
+			e.undoStack = append(e.undoStack, snapshot{lines: linesCopy, row: e.row, col: e.col})
+			snap := e.redoStack[len(e.redoStack)-1]
+			e.redoStack = e.redoStack[:len(e.redoStack)-1]
+			e.lines = snap.lines
+			e.row = snap.row
+			e.col = snap.col
+			e.status = "redo"
+			e.changes++
 		}
-		if row >= topLine+windowHeight {
-			topLine = row - windowHeight + 1
+	case 'v':
+		e.startVisual(visualChar)
+	case 'V':
+		e.startVisual(visualLine)
+	case 0x16: // Ctrl+V
+		e.startVisual(visualBlock)
+	case '/':
+		e.startSearch(true)
+	case '?':
+		e.startSearch(false)
+	case 'n':
+		e.search.noHL = false
+		e.performSearch(e.searchQuery, e.search.forward)
+	case 'N':
+		e.search.noHL = false
+		e.performSearch(e.searchQuery, !e.search.forward)
+	case '*':
+		e.searchWord(true)
+	case '#':
+		e.searchWord(false)
+	case 'g':
+		switch next := e.readKey(); next {
+		case 'g':
+			e.pushJump()
+			e.gotoLine(0)
+			e.col = 0
+		case 'v':
+			e.reselectVisual()
+		default:
+			e.unreadKey(next)
 		}
-		// Adjust leftCol for horizontal scrolling
-		cursorVisCol := visualCol(lines[row], col)
-		if cursorVisCol < leftCol {
-			leftCol = cursorVisCol
+	case 'w':
+		// Save file
+		if err := e.checkWrite(e.filename, false); err != nil {
+			e.status = err.Error()
+		} else if err := e.writeFile(e.filename); err != nil {
+			e.status = "write error: " + err.Error()
+		} else {
+			e.modified = false
+			e.status = fmt.Sprintf("\"%s\" %s written", e.filename, e.sizeLabel())
 		}
-		if cursorVisCol >= leftCol+width {
-			leftCol = cursorVisCol - width + 1
+	case 'q':
+		if e.recording != 0 {
+			e.stopRecording()
+		} else {
+			e.startRecording(e.readKey())
 		}
+	case '@':
+		e.replayMacro(e.readKey(), 1)
+	case 'm':
+		e.setMark(e.readKey())
+	case '\'', '`':
+		e.jumpToMark(e.readKey(), k == '`')
+	case 0x0f: // Ctrl+O - older jump
+		e.jumpOlder(1)
+	case '\t': // Ctrl+I - newer jump
+		e.jumpNewer(1)
+	case '!':
+		e.filterMotion(1)
+	case 0x17: // Ctrl+W - window commands
+		e.windowCommand(e.readKey())
+	case ':':
+		e.mode = "CMD"
+		e.cmd = ":"
+		e.status = ":"
+	}
+}
 
-		clearScreen()
-		for i := 0; i < windowHeight; i++ {
-			lineIdx := topLine + i
-			if lineIdx < len(lines) {
-				if lineIdx == row {
-					printLineHighlightedScroll(lines[lineIdx], width, col, leftCol)
-				} else {
-					printLineScroll(lines[lineIdx], width, leftCol)
-				}
-			} else {
-				fmt.Print("~\r\n")
-			}
+// autoIndent returns the indentation a new line opened next to line starts
+// with: the same as line's with autoindent or smartindent set, otherwise
+// none. With smartindent a line opened below one ending in { gets another
+// level.
+func (e *editor) autoIndent(line string, below bool) string {
+	if !e.opts.autoindent && !e.opts.smartindent {
+		return ""
+	}
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	if below && e.opts.smartindent && strings.HasSuffix(strings.TrimRight(line, " \t"), "{") {
+		indent += e.indentUnit()
+	}
+	return indent
+}
+
+// backspaceStart returns where <BS> at col deletes back to: the previous
+// character, or in the indentation a whole shiftwidth of spaces
+func (e *editor) backspaceStart(line string, col int) int {
+	if line[col-1] != ' ' || strings.TrimLeft(line[:col], " \t") != "" {
+		return prevBoundary(line, col)
+	}
+	sw := max(e.opts.shiftwidth, 1)
+	stop := (visualCol(line, col) - 1) / sw * sw
+	start := col - 1
+	for start > 0 && line[start-1] == ' ' && visualCol(line, start-1) >= stop {
+		start--
+	}
+	return start
+}
+
+// repeatable are the normal-mode commands a count simply repeats
+var repeatable = map[rune]bool{
+	'h': true, 'j': true, 'k': true, 'l': true, 'x': true, 'X': true,
+	'p': true, 'P': true, 'u': true, 0x12: true, 'n': true, 'N': true,
+	'*': true, '#': true, keyLeft: true, keyRight: true, keyUp: true,
+	keyDown: true, keyDelete: true,
+}
+
+// handleCount reads a count typed before a command and applies it: NG and
+// Ngg go to line N, N@r replays a macro N times, Ctrl-O/Ctrl-I skip N jumps
+// and simple commands are repeated. Anything else runs once.
+func (e *editor) handleCount(k rune) {
+	count := int(k - '0')
+	k = e.readKey()
+	for k >= '0' && k <= '9' {
+		count = min(count*10+int(k-'0'), maxMacroKeys)
+		k = e.readKey()
+	}
+	switch {
+	case k == 'g':
+		if next := e.readKey(); next != 'g' {
+			e.unreadKey(next)
+			e.handleNormal(k)
+			return
+		}
+		fallthrough
+	case k == 'G':
+		e.pushJump()
+		e.gotoLine(count - 1)
+		e.moveCursor('^')
+	case k == '@':
+		e.replayMacro(e.readKey(), count)
+	case k == '!':
+		e.filterMotion(count)
+	case k == 0x0f:
+		e.jumpOlder(count)
+	case k == '\t':
+		e.jumpNewer(count)
+	case repeatable[k]:
+		for i := 0; i < count; i++ {
+			e.handleNormal(k)
 		}
+	default:
+		e.handleNormal(k)
+	}
+}
 
-		// Status bar
-		modIndicator := ""
-		if modified {
-			modIndicator = " [+]" 
-		}
-		fileName := filepath.Base(filename)
-		statusLine := fmt.Sprintf("--%s-- %s%s | %s:%d/%d", mode, status, modIndicator, fileName, row+1, len(lines))
-		if len(statusLine) > width {
-			statusLine = statusLine[:width]
-		}
-		fmt.Printf("\x1b[7m%-*s\x1b[0m\r\n", width, statusLine)
-
-		cursorCol := visualCol(lines[row], col) - leftCol
-		fmt.Printf("\x1b[%d;%dH", row-topLine+1, cursorCol+1)
-
-		b, _ := stdin.ReadByte()
-		if b == 0x1b {
-			seq := make([]byte, 2)
-			n, _ := stdin.Read(seq)
-			if n == 2 && seq[0] == '[' {
-				switch seq[1] {
-				case 'A': // Up
-					if row > 0 {
-						row--
-						col = min(col, len(lines[row]))
-					}
-				case 'B': // Down
-					if row < len(lines)-1 {
-						row++
-						col = min(col, len(lines[row]))
-					}
-				case 'C': // Right
-					if col < len(lines[row]) {
-						col++
-					}
-				case 'D': // Left
-					if col > 0 {
-						col--
-					}
-				case 'H': // Home
-					col = 0
-				case 'F': // End
-					col = len(lines[row])
-				case '~': // Could be Delete (ESC[3~)
-					// Check for more bytes
-					more := make([]byte, 2)
-					n2, _ := stdin.Read(more)
-					if n2 == 2 && more[0] == '3' && more[1] == '~' {
-						// Delete key
-						if mode == "NORMAL" && len(lines[row]) > 0 && col < len(lines[row]) {
-							saveSnapshot()
-							lines[row] = lines[row][:col] + lines[row][col+1:]
-							modified = true
-						}
-					}
-				}
-				continue
-			}
-			// Alt+key sequences
-			if n == 2 && seq[0] == 'O' {
-				switch seq[1] {
-				case 'H': // Home (xterm)
-					col = 0
-				case 'F': // End (xterm)
-					col = len(lines[row])
-				}
-				continue
+// abortKeys drops any queued keys, so a command that fails partway through a
+// macro or :normal stops the rest of it from running
+func (e *editor) abortKeys() {
+	e.pending = nil
+	e.noremapKeys = 0
+}
+
+// put pastes the unnamed register after (or before) the cursor
+func (e *editor) put(after bool) {
+	if len(e.reg.lines) == 0 {
+		return
+	}
+	e.saveSnapshot()
+	e.modified = true
+	switch e.reg.kind {
+	case visualLine:
+		at := e.row
+		if after {
+			at++
+		}
+		added := append([]string{}, e.reg.lines...)
+		e.lines = append(e.lines[:at], append(added, e.lines[at:]...)...)
+		e.row = at
+		e.col = 0
+	case visualBlock:
+		col := e.col
+		if after {
+			col = nextBoundary(e.lines[e.row], col)
+		}
+		vcol := visualCol(e.lines[e.row], col)
+		for i, piece := range e.reg.lines {
+			r := e.row + i
+			if r >= len(e.lines) {
+				e.lines = append(e.lines, "")
 			}
+			line := padToVisual(e.lines[r], vcol)
+			at := byteColAtVisual(line, vcol)
+			e.lines[r] = line[:at] + piece + line[at:]
 		}
+		e.col = col
+	default:
+		col := e.col
+		if after {
+			col = nextBoundary(e.lines[e.row], col)
+		}
+		e.insertText(e.row, col, strings.Join(e.reg.lines, "\n"))
+	}
+}
 
-		if mode == "NORMAL" {
-			switch b {
-			case 'h':
-				if col > 0 {
-					col--
-				}
-			case 'l':
-				if col < len(lines[row]) {
-					col++
-				}
-			case 'j':
-				if row < len(lines)-1 {
-					row++
-					col = min(col, len(lines[row]))
-				}
-			case 'k':
-				if row > 0 {
-					row--
-					col = min(col, len(lines[row]))
-				}
-			case 'i':
-				mode = "INSERT"
-				status = "INSERT"
-			case 'a':
-				mode = "INSERT"
-				status = "INSERT"
-				if col < len(lines[row]) {
-					col++
-				}
-			case 'I':
-				mode = "INSERT"
-				status = "INSERT"
-				col = 0
-			case 'A':
-				mode = "INSERT"
-				status = "INSERT"
-				col = len(lines[row])
-			case 'o':
-				saveSnapshot()
-				rest := ""
-				if col < len(lines[row]) {
-					rest = lines[row][col:]
-					lines[row] = lines[row][:col]
-				}
-				lines = append(lines[:row+1], append([]string{rest}, lines[row+1:]...)...)
-				row++
-				col = 0
-				mode = "INSERT"
-				status = "INSERT"
-				modified = true
-			case 'O':
-				saveSnapshot()
-				newLines := make([]string, len(lines)+1)
-				copy(newLines, lines[:row])
-				newLines[row] = ""
-				copy(newLines[row+1:], lines[row:])
-				lines = newLines
-				col = 0
-				mode = "INSERT"
-				status = "INSERT"
-				modified = true
-			case 'x':
-				if len(lines[row]) > 0 && col < len(lines[row]) {
-					saveSnapshot()
-					lines[row] = lines[row][:col] + lines[row][col+1:]
-					modified = true
-				}
-			case 'X':
-				if col > 0 {
-					saveSnapshot()
-					lines[row] = lines[row][:col-1] + lines[row][col:]
-					col--
-					modified = true
-				}
-			case 'd':
-				// dd - delete line
-				next, _ := stdin.Peek(1)
-				if len(next) > 0 && next[0] == 'd' {
-					stdin.Discard(1)
-					if len(lines) > 1 {
-						saveSnapshot()
-						lines = append(lines[:row], lines[row+1:]...)
-						if row >= len(lines) {
-							row = len(lines) - 1
-						}
-						col = min(col, len(lines[row]))
-						modified = true
-					}
-				}
-			case 'y':
-				// yy - yank (copy) line
-				next, _ := stdin.Peek(1)
-				if len(next) > 0 && next[0] == 'y' {
-					stdin.Discard(1)
-					status = fmt.Sprintf("yanked line %d", row+1)
-				}
-			case 'p':
-				// Paste below
-				if len(undoStack) > 0 {
-					lastSnap := undoStack[len(undoStack)-1]
-					if len(lastSnap.lines) > row {
-						saveSnapshot()
-						line := lastSnap.lines[row]
-						lines = append(lines[:row+1], append([]string{line}, lines[row+1:]...)...)
-						row++
-						col = 0
-						modified = true
-					}
-				}
-			case 'u':
-				// Undo
-				if len(undoStack) > 0 {
-					// Save current state to redo
-					linesCopy := make([]string, len(lines))
-					copy(linesCopy, lines)
-					redoStack = append(redoStack, snapshot{lines: linesCopy, row: row, col: col})
-					// Restore previous state
-					snap := undoStack[len(undoStack)-1]
-					undoStack = undoStack[:len(undoStack)-1]
-					lines = snap.lines
-					row = snap.row
-					col = snap.col
-					status = "undo"
-				}
-			case 0x12: // Ctrl+R - Redo
-				if len(redoStack) > 0 {
-					linesCopy := make([]string, len(lines))
-					copy(linesCopy, lines)
-					undoStack = append(undoStack, snapshot{lines: linesCopy, row: row, col: col})
-					snap := redoStack[len(redoStack)-1]
-					redoStack = redoStack[:len(redoStack)-1]
-					lines = snap.lines
-					row = snap.row
-					col = snap.col
-					status = "redo"
-				}
-			case '/':
-				// Search
-				mode = "SEARCH"
-				cmd = "/"
-				status = "/"
-			case 'n':
-				if searchQuery != "" {
-					performSearch(searchQuery, true)
-				}
-			case 'N':
-				if searchQuery != "" {
-					performSearch(searchQuery, false)
-				}
-			case 'G':
-				row = len(lines) - 1
-				col = 0
-			case 'g':
-				next, _ := stdin.Peek(1)
-				if len(next) > 0 && next[0] == 'g' {
-					stdin.Discard(1)
-					row = 0
-					col = 0
-				}
-			case 'w':
-				// Save file
-				err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
-				if err != nil {
-					status = "write error: " + err.Error()
-				} else {
-					modified = false
-					status = fmt.Sprintf("\"%s\" %dL written", filename, len(lines))
-				}
-			case ':':
-				mode = "CMD"
-				cmd = ":"
-				status = ":"
-			}
-		} else if mode == "INSERT" {
-			if b == 27 { // ESC
-				mode = "NORMAL"
-				status = ""
-				continue
-			}
-			if b == 127 || b == 8 { // Backspace
-				if col > 0 {
-					saveSnapshot()
-					lines[row] = lines[row][:col-1] + lines[row][col:]
-					col--
-					modified = true
-				} else if row > 0 {
-					// Join with previous line
-					saveSnapshot()
-					prevLen := len(lines[row-1])
-					lines[row-1] = lines[row-1] + lines[row]
-					lines = append(lines[:row], lines[row+1:]...)
-					row--
-					col = prevLen
-					modified = true
-				}
-				continue
-			}
-			if b == '\r' || b == '\n' {
-				saveSnapshot()
-				rest := lines[row][col:]
-				lines[row] = lines[row][:col]
-				newLines := make([]string, len(lines)+1)
-				copy(newLines, lines[:row+1])
-				newLines[row+1] = rest
-				copy(newLines[row+2:], lines[row+1:])
-				lines = newLines
-				row++
-				col = 0
-				modified = true
-				continue
-			}
-			if b == '\t' {
-				saveSnapshot()
-				spaces := strings.Repeat(" ", tabWidth)
-				lines[row] = lines[row][:col] + spaces + lines[row][col:]
-				col += tabWidth
-				modified = true
-				continue
-			}
-			if b >= 32 && b <= 126 {
-				saveSnapshot()
-				lines[row] = lines[row][:col] + string(b) + lines[row][col:]
-				col++
-				modified = true
-			}
-		} else if mode == "CMD" {
-			if b == '\r' || b == '\n' {
-				cmdStr := strings.TrimSpace(cmd)
-				if cmdStr == ":q" || cmdStr == ":q!" {
-					if modified && cmdStr == ":q" {
-						status = "No write since last change (use :q! to force quit)"
-					} else {
-						clearScreen()
-						term.Restore(int(os.Stdin.Fd()), oldState)
-						return
-					}
-				} else if cmdStr == ":w" {
-					err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
-					if err != nil {
-						status = "write error: " + err.Error()
-					} else {
-						modified = false
-						status = fmt.Sprintf("\"%s\" %dL written", filename, len(lines))
-					}
-				} else if cmdStr == ":wq" {
-					err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
-					if err != nil {
-						status = "write error: " + err.Error()
-					} else {
-						clearScreen()
-						term.Restore(int(os.Stdin.Fd()), oldState)
-						return
-					}
-				} else if strings.HasPrefix(cmdStr, ":w ") {
-					newName := strings.TrimSpace(cmdStr[3:])
-					err := os.WriteFile(newName, []byte(strings.Join(lines, "\n")+"\n"), 0644)
-					if err != nil {
-						status = "write error: " + err.Error()
-					} else {
-						status = fmt.Sprintf("\"%s\" %dL written", newName, len(lines))
-					}
-				} else if cmdStr == ":e!" {
-					if data, err := os.ReadFile(filename); err == nil {
-						content := string(data)
-						if content == "" {
-							lines = []string{""}
-						} else {
-							lines = strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
-							if len(lines) > 1 && lines[len(lines)-1] == "" {
-								lines = lines[:len(lines)-1]
-							}
-						}
-						row = 0
-						col = 0
-						modified = false
-						status = fmt.Sprintf("\"%s\" %dL", filename, len(lines))
-					} else {
-						status = "reload error: " + err.Error()
-					}
-				} else if cmdStr == ":set number" || cmdStr == ":set nu" {
-					status = "number (line numbers always shown in status bar)"
-				} else if cmdStr == ":help" || cmdStr == ":h" {
-					status = "i:insert a:append x:delete dd:delete-line u:undo ^r:redo /:search w:save :q:quit"
-				} else {
-					status = fmt.Sprintf("unknown command: %s", cmdStr)
-				}
-				mode = "NORMAL"
-				cmd = ""
-				continue
-			}
-			if b == 127 || b == 8 {
-				if len(cmd) > 1 {
-					cmd = cmd[:len(cmd)-1]
-				}
-			} else if b >= 32 && b <= 126 {
-				cmd += string(b)
-			}
-			status = cmd
-		} else if mode == "SEARCH" {
-			if b == '\r' || b == '\n' {
-				searchQuery = strings.TrimPrefix(cmd, "/")
-				performSearch(searchQuery, true)
-				mode = "NORMAL"
-				status = ""
-				continue
-			}
-			if b == 27 { // ESC
-				mode = "NORMAL"
-				status = ""
-				cmd = ""
-				continue
-			}
-			if b == 127 || b == 8 {
-				if len(cmd) > 1 {
-					cmd = cmd[:len(cmd)-1]
-				}
-			} else if b >= 32 && b <= 126 {
-				cmd += string(b)
-			}
-			status = cmd
+// insertText inserts text (which may contain newlines) at row, col and leaves
+// the cursor on its last character
+func (e *editor) insertText(row, col int, text string) {
+	line := e.lines[row]
+	parts := strings.Split(text, "\n")
+	tail := line[col:]
+	parts[0] = line[:col] + parts[0]
+	endCol := len(parts[len(parts)-1]) - 1
+	parts[len(parts)-1] += tail
+	e.lines = append(e.lines[:row], append(parts, e.lines[row+1:]...)...)
+	e.row = row + len(parts) - 1
+	e.col = max(endCol, 0)
+}
+
+func (e *editor) handleInsert(k rune) {
+	switch {
+	case k == keyEsc:
+		if e.blockInsert != nil {
+			e.finishBlockInsert()
+		}
+		e.setMode("NORMAL")
+	case k >= keyUp && e.moveCursor(k):
+		// arrow and paging keys move the cursor
+	case k == keyDelete:
+		if e.col < len(e.lines[e.row]) {
+			e.saveSnapshot()
+			end := nextBoundary(e.lines[e.row], e.col)
+			e.lines[e.row] = e.lines[e.row][:e.col] + e.lines[e.row][end:]
+			e.modified = true
+		}
+	case k == 127 || k == 8: // Backspace
+		if e.col > 0 {
+			e.saveSnapshot()
+			start := e.backspaceStart(e.lines[e.row], e.col)
+			e.lines[e.row] = e.lines[e.row][:start] + e.lines[e.row][e.col:]
+			e.col = start
+			e.modified = true
+		} else if e.row > 0 {
+			// Join with previous line
+			e.saveSnapshot()
+			prevLen := len(e.lines[e.row-1])
+			e.lines[e.row-1] = e.lines[e.row-1] + e.lines[e.row]
+			e.lines = append(e.lines[:e.row], e.lines[e.row+1:]...)
+			e.row--
+			e.col = prevLen
+			e.modified = true
 		}
-		col = min(col, len(lines[row]))
+	case k == '\r' || k == '\n':
+		e.saveSnapshot()
+		rest := e.lines[e.row][e.col:]
+		indent := e.autoIndent(e.lines[e.row][:e.col], !strings.HasPrefix(strings.TrimLeft(rest, " \t"), "}"))
+		e.lines[e.row] = e.lines[e.row][:e.col]
+		newLines := make([]string, len(e.lines)+1)
+		copy(newLines, e.lines[:e.row+1])
+		newLines[e.row+1] = indent + rest
+		copy(newLines[e.row+2:], e.lines[e.row+1:])
+		e.lines = newLines
+		e.row++
+		e.col = len(indent)
+		e.modified = true
+	case k == '\t':
+		e.saveSnapshot()
+		tab := "\t"
+		if e.opts.expandtab {
+			tab = strings.Repeat(" ", e.opts.tabstop)
+		}
+		e.lines[e.row] = e.lines[e.row][:e.col] + tab + e.lines[e.row][e.col:]
+		e.col += len(tab)
+		e.modified = true
+	case k == '}' && e.opts.smartindent && strings.TrimLeft(e.lines[e.row][:e.col], " \t") == "":
+		// a closing brace starting a line goes back a level
+		e.saveSnapshot()
+		indent := e.shiftLine(e.lines[e.row][:e.col], false)
+		e.lines[e.row] = indent + "}" + e.lines[e.row][e.col:]
+		e.col = len(indent) + 1
+		e.modified = true
+	case isInsertable(k):
+		e.saveSnapshot()
+		e.lines[e.row] = e.lines[e.row][:e.col] + string(k) + e.lines[e.row][e.col:]
+		e.col += utf8.RuneLen(k)
+		e.modified = true
 	}
 }
 
-func contains(slice []int, val int) bool {
-	for _, v := range slice {
-		if v == val {
-			return true
+func (e *editor) handleCmd(k rune) {
+	if k == '\r' || k == '\n' {
+		cmdStr := strings.TrimSpace(e.cmd)
+		e.mode = "NORMAL"
+		e.status = ""
+		e.cmd = ""
+		if err := e.execEx(cmdStr); err != nil {
+			e.status = err.Error()
 		}
+		return
+	}
+	if k == keyEsc {
+		e.setMode("NORMAL")
+		e.cmd = ""
+		return
 	}
-	return false
+	if k == 127 || k == 8 {
+		if len(e.cmd) > 1 {
+			e.cmd = dropLastRune(e.cmd)
+		}
+	} else if isInsertable(k) {
+		e.cmd += string(k)
+	}
+	e.status = e.cmd
 }
 
-func clearScreen() { fmt.Print("\x1b[2J\x1b[H") }
+// draw repaints every window and the status bar
+func (e *editor) draw() {
+	height := e.textHeight()
+	hlRe := e.highlightRe()
+	if e.diff != nil {
+		e.syncDiff(height)
+	}
+	for _, w := range e.wins {
+		if s := e.diffSide(w); s >= 0 {
+			e.drawDiff(w, s, height, hlRe)
+		} else {
+			e.scrollIntoView(w)
+			e.drawWindow(w, height, hlRe)
+		}
+		if w.x+w.w < e.width {
+			for y := 0; y <= height; y++ {
+				e.scr.setText(y, w.x+w.w, "|", attrReverse)
+			}
+		}
+	}
 
-func printLineScroll(s string, width, leftCol int) {
-	display := expandTabs(s)
-	if leftCol > len(display) {
-		display = ""
+	// Status bar: one segment per window, or the whole row while a command is typed
+	if e.mode == "CMD" || e.mode == "SEARCH" {
+		e.scr.setLine(height, e.status, 0, nil)
 	} else {
-		display = display[leftCol:]
-	}
-	if len(display) > width {
-		display = display[:width]
+		for _, w := range e.wins {
+			attrs := make([]string, w.w)
+			paint(attrs, 0, 0, w.w, attrReverse)
+			e.scr.setSpan(height, w.x, w.w, e.statusLine(w), 0, attrs)
+		}
 	}
-	// Pad to width to clear previous content
-	if len(display) < width {
-		display += strings.Repeat(" ", width-len(display))
+
+	rows := e.screenRows(e.window, height)
+	if e.hex != nil {
+		e.scr.setCursor(e.hexCursor(e.window))
+	} else if e.diffSide(e.window) >= 0 {
+		e.scr.setCursor(e.diffCursor())
+	} else if y := e.cursorRow(e.window, rows); y >= 0 {
+		x := visualCol(e.lines[e.row], e.col) - rows[y].start
+		e.scr.setCursor(y, e.x+e.gutterWidth(e.window)+min(x, e.textWidth(e.window)-1))
 	}
-	fmt.Print(display + "\r\n")
+	e.scr.flush()
 }
 
-func printLineHighlightedScroll(s string, width, col, leftCol int) {
-	display := expandTabs(s)
-	if len(display) == 0 {
-		display = " "
+// drawWindow paints the text rows of w, with line numbers in front when
+// number or relativenumber is set
+func (e *editor) drawWindow(w *window, height int, hlRe *regexp.Regexp) {
+	if w.hex != nil {
+		e.drawHex(w, height)
+		return
 	}
-	if leftCol > len(display) {
-		display = ""
-	} else {
-		display = display[leftCol:]
+	active := w == e.window
+	inVisual := active && e.inVisual()
+	sel := e.selection()
+	gutter := e.gutterWidth(w)
+	x, width := w.x+gutter, e.textWidth(w)
+	rows := e.screenRows(w, height)
+	for i := 0; i < height; i++ {
+		if i >= len(rows) {
+			e.scr.setSpan(i, w.x, w.w, "~", 0, nil)
+			continue
+		}
+		lineIdx, start := rows[i].line, rows[i].start
+		line := w.lines[lineIdx]
+		if gutter > 0 {
+			num := ""
+			if i == 0 || rows[i-1].line != lineIdx {
+				num = e.lineNumber(w, lineIdx)
+			}
+			e.scr.setSpan(i, w.x, gutter, fmt.Sprintf("%*s ", gutter-1, num), 0, nil)
+			e.scr.setText(i, w.x, fmt.Sprintf("%*s", gutter-1, num), attrLineNr)
+		}
+		attrs := make([]string, width)
+		if active && !inVisual && lineIdx == w.row {
+			paint(attrs, start, 0, start+width, attrReverse)
+		}
+		if hlRe != nil {
+			paintMatches(attrs, line, start, hlRe)
+		}
+		if inVisual {
+			if from, to, ok := sel.span(line, lineIdx); ok {
+				paint(attrs, start, from, to, attrReverse)
+			}
+		}
+		e.scr.setSpan(i, x, width, line, start, attrs)
+		if e.opts.list && (i+1 == len(rows) || rows[i+1].line != lineIdx) {
+			if end := displayWidth(line) - start; end >= 0 && end < width {
+				e.scr.setText(i, x+end, "$", attrs[end])
+			}
+		}
+	}
+}
+
+// lineNumber is the gutter text for line: its number, or with
+// relativenumber its distance from the cursor line
+func (e *editor) lineNumber(w *window, line int) string {
+	if !e.opts.relativeNumber || (line == w.row && e.opts.number) {
+		return w.lineLabel(line)
 	}
-	if len(display) > width {
-		display = display[:width]
+	return strconv.Itoa(max(line-w.row, w.row-line))
+}
+
+// lineLabel is the number of line for display. In a large file it counts
+// from the start of the file, and is ? until the index gets there.
+func (b *buffer) lineLabel(line int) string {
+	if b.pg == nil {
+		return strconv.Itoa(line + 1)
 	}
-	// Pad to width
-	if len(display) < width {
-		display += strings.Repeat(" ", width-len(display))
+	first, ok := b.firstLine()
+	if !ok {
+		return "?"
 	}
-	fmt.Print("\x1b[7m")
-	fmt.Print(display)
-	fmt.Print("\x1b[0m\r\n")
+	return strconv.Itoa(first + line + 1)
 }
 
-func expandTabs(s string) string {
-	return strings.ReplaceAll(s, "\t", strings.Repeat(" ", tabWidth))
+// ruler is the cursor line and line count shown in w's status; + marks a
+// count that will grow as a large file is indexed. Hex mode shows the
+// cursor's offset and the size instead.
+func (w *window) ruler() string {
+	if w.hex != nil {
+		return w.hex.ruler()
+	}
+	n, done := w.lineCount()
+	more := ""
+	if !done {
+		more = "+"
+	}
+	return fmt.Sprintf("%s/%d%s", w.lineLabel(w.row), n, more)
 }
 
-func visualCol(s string, col int) int {
-	if col > len(s) {
-		col = len(s)
+// statusLine is the status bar text for w; the current window also shows the
+// mode and the last message. With ruler set it ends with the cursor line.
+func (e *editor) statusLine(w *window) string {
+	modIndicator := ""
+	if w.readonly {
+		modIndicator = " [RO]"
+	}
+	if w.modified {
+		modIndicator += " [+]"
+	}
+	fileName := filepath.Base(w.filename)
+	if w != e.window {
+		if !e.opts.ruler {
+			return fileName + modIndicator
+		}
+		return fmt.Sprintf("%s%s %s", fileName, modIndicator, w.ruler())
+	}
+	status := e.status
+	if e.recording != 0 {
+		status = strings.TrimSpace("recording @" + string(e.recording) + " " + status)
+	}
+	line := fmt.Sprintf("--%s-- %s%s | %s", e.mode, status, modIndicator, fileName)
+	if e.opts.ruler {
+		line += ":" + w.ruler()
 	}
-	return len(expandTabs(s[:col]))
+	return line
 }
 
 func min(a, b int) int {
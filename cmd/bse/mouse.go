@@ -0,0 +1,170 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// xterm mouse tracking: report presses, releases and drags (1002) in the SGR
+// encoding (1006), which has no upper limit on coordinates
+const (
+	mouseOn  = "\x1b[?1000h\x1b[?1002h\x1b[?1006h"
+	mouseOff = "\x1b[?1006l\x1b[?1002l\x1b[?1000l"
+)
+
+// Button codes in an SGR mouse report, after the modifier bits are masked off
+const (
+	mouseLeft      = 0
+	mouseMotion    = 32
+	mouseWheelUp   = 64
+	mouseWheelDown = 65
+	mouseModifiers = 4 | 8 | 16 // shift, meta, control
+	wheelLines     = 3
+)
+
+// mouseEvent is one decoded SGR report; x and y are 0-based screen cells
+type mouseEvent struct {
+	button  int
+	x, y    int
+	release bool
+}
+
+// What a held left button is dragging
+const (
+	dragNone = iota
+	dragText
+	dragBorder
+)
+
+// mouseDrag tracks a press of the left button until it is released
+type mouseDrag struct {
+	kind      int
+	win       *window // the window clicked in, or left of the border
+	anchorRow int
+	anchorCol int
+}
+
+// parseMouse decodes the parameters of an SGR mouse report, CSI < b;x;y M
+// (press or motion) or m (release)
+func parseMouse(params string, final byte) (mouseEvent, bool) {
+	fields := strings.Split(strings.TrimPrefix(params, "<"), ";")
+	if len(fields) != 3 || (final != 'M' && final != 'm') {
+		return mouseEvent{}, false
+	}
+	var n [3]int
+	for i, f := range fields {
+		v, err := strconv.Atoi(f)
+		if err != nil {
+			return mouseEvent{}, false
+		}
+		n[i] = v
+	}
+	return mouseEvent{button: n[0] &^ mouseModifiers, x: n[1] - 1, y: n[2] - 1, release: final == 'm'}, true
+}
+
+// handleMouse acts on the last mouse report: clicks place the cursor or
+// focus a window, dragging selects text or moves a split border, and the
+// wheel scrolls the window under the pointer
+func (e *editor) handleMouse(ev mouseEvent) {
+	if e.mode == "CMD" || e.mode == "SEARCH" {
+		return
+	}
+	height := e.textHeight()
+	if e.hexMouse(ev, height) {
+		return
+	}
+	switch {
+	case ev.button == mouseWheelUp || ev.button == mouseWheelDown:
+		w, _ := e.windowAt(ev.x)
+		n := wheelLines
+		if ev.button == mouseWheelUp {
+			n = -n
+		}
+		if e.diffSide(w) >= 0 {
+			e.diffScroll(w, n, height)
+		} else {
+			w.scroll(n, height)
+		}
+	case ev.release:
+		e.drag = mouseDrag{}
+	case ev.button == mouseLeft:
+		e.mousePress(ev, height)
+	case ev.button == mouseLeft|mouseMotion:
+		e.mouseDragTo(ev, height)
+	}
+}
+
+func (e *editor) mousePress(ev mouseEvent, height int) {
+	w, border := e.windowAt(ev.x)
+	if border {
+		e.drag = mouseDrag{kind: dragBorder, win: w}
+		return
+	}
+	e.focus(w)
+	if ev.y >= height {
+		// the status line only focuses its window
+		return
+	}
+	if e.inVisual() {
+		e.endVisual()
+	}
+	e.placeCursor(ev.x, ev.y)
+	e.drag = mouseDrag{kind: dragText, win: w, anchorRow: e.row, anchorCol: e.col}
+}
+
+func (e *editor) mouseDragTo(ev mouseEvent, height int) {
+	switch e.drag.kind {
+	case dragBorder:
+		i := 0
+		for i < len(e.wins)-1 && e.wins[i] != e.drag.win {
+			i++
+		}
+		if i == len(e.wins)-1 {
+			return
+		}
+		left, right := e.wins[i], e.wins[i+1]
+		// keep both windows at least one column wide
+		edge := min(max(ev.x, left.x+1), right.x+right.w-2)
+		right.w += left.x + left.w - edge
+		left.w = edge - left.x
+		right.x = edge + 1
+	case dragText:
+		if e.drag.win != e.window || e.mode == "INSERT" {
+			return
+		}
+		// dragging past the top or bottom edge scrolls
+		y := ev.y
+		if y < 0 {
+			e.scroll(-1, height)
+			y = 0
+		} else if y >= height {
+			e.scroll(1, height)
+			y = height - 1
+		}
+		if !e.inVisual() {
+			row, col := e.row, e.col
+			e.row, e.col = e.drag.anchorRow, e.drag.anchorCol
+			e.startVisual(visualChar)
+			e.row, e.col = row, col
+		}
+		e.placeCursor(ev.x, y)
+	}
+}
+
+// placeCursor moves the cursor to the character at screen cell x, y of the
+// current window
+func (e *editor) placeCursor(x, y int) {
+	if e.diffSide(e.window) >= 0 {
+		e.diffPlaceCursor(x, y)
+		return
+	}
+	rows := e.screenRows(e.window, e.textHeight())
+	if len(rows) == 0 {
+		return
+	}
+	// below the end of the buffer means its last row
+	r := rows[min(max(y, 0), len(rows)-1)]
+	e.row = r.line
+	x -= e.x + e.gutterWidth(e.window)
+	e.col = byteColAtVisual(e.lines[e.row], r.start+min(max(x, 0), e.textWidth(e.window)-1))
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// options are the settings changed with :set
+type options struct {
+	number         bool
+	relativeNumber bool
+	tabstop        int
+	shiftwidth     int
+	expandtab      bool
+	autoindent     bool
+	smartindent    bool
+	ignorecase     bool
+	smartcase      bool
+	wrap           bool
+	list           bool
+	hlsearch       bool
+	ruler          bool
+}
+
+// defaultOptions match how bse behaved before it had options
+var defaultOptions = options{
+	tabstop:    4,
+	shiftwidth: 4,
+	expandtab:  true,
+	ignorecase: true,
+	smartcase:  true,
+	hlsearch:   true,
+	ruler:      true,
+}
+
+// option describes one :set option: its names and where it lives in options.
+// Exactly one of flag and num is set.
+type option struct {
+	name, short string
+	flag        func(*options) *bool
+	num         func(*options) *int
+}
+
+var optionList = []option{
+	{name: "autoindent", short: "ai", flag: func(o *options) *bool { return &o.autoindent }},
+	{name: "expandtab", short: "et", flag: func(o *options) *bool { return &o.expandtab }},
+	{name: "hlsearch", short: "hls", flag: func(o *options) *bool { return &o.hlsearch }},
+	{name: "ignorecase", short: "ic", flag: func(o *options) *bool { return &o.ignorecase }},
+	{name: "list", short: "list", flag: func(o *options) *bool { return &o.list }},
+	{name: "number", short: "nu", flag: func(o *options) *bool { return &o.number }},
+	{name: "relativenumber", short: "rnu", flag: func(o *options) *bool { return &o.relativeNumber }},
+	{name: "ruler", short: "ru", flag: func(o *options) *bool { return &o.ruler }},
+	{name: "shiftwidth", short: "sw", num: func(o *options) *int { return &o.shiftwidth }},
+	{name: "smartcase", short: "scs", flag: func(o *options) *bool { return &o.smartcase }},
+	{name: "smartindent", short: "si", flag: func(o *options) *bool { return &o.smartindent }},
+	{name: "tabstop", short: "ts", num: func(o *options) *int { return &o.tabstop }},
+	{name: "wrap", short: "wrap", flag: func(o *options) *bool { return &o.wrap }},
+}
+
+func findOption(name string) *option {
+	for i := range optionList {
+		if o := &optionList[i]; o.name == name || o.short == name {
+			return o
+		}
+	}
+	return nil
+}
+
+// show formats an option's current value the way :set opt? prints it
+func (o *option) show(opts *options) string {
+	if o.num != nil {
+		return fmt.Sprintf("%s=%d", o.name, *o.num(opts))
+	}
+	if *o.flag(opts) {
+		return o.name
+	}
+	return "no" + o.name
+}
+
+// exSet implements :set with any number of space-separated arguments: opt,
+// noopt, invopt, opt!, opt&, opt?, opt=N (also opt+=N and opt-=N)
+func (e *editor) exSet(arg string) error {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || arg == "all" {
+		var shown []string
+		for i := range optionList {
+			o := &optionList[i]
+			if arg == "all" || o.show(&e.opts) != o.show(&defaultOptions) {
+				shown = append(shown, o.show(&e.opts))
+			}
+		}
+		e.status = strings.Join(shown, " ")
+		return nil
+	}
+	var shown []string
+	for _, f := range fields {
+		s, err := e.setOne(f)
+		if err != nil {
+			return err
+		}
+		if s != "" {
+			shown = append(shown, s)
+		}
+	}
+	e.status = strings.Join(shown, " ")
+	return nil
+}
+
+// setOne applies a single :set argument, returning text to show for opt?
+func (e *editor) setOne(arg string) (string, error) {
+	name, val, hasVal := arg, "", false
+	op := byte('=')
+	if i := strings.IndexAny(arg, "=:"); i > 0 {
+		name, val, hasVal = arg[:i], arg[i+1:], true
+		if c := name[len(name)-1]; c == '+' || c == '-' || c == '^' {
+			op, name = c, name[:len(name)-1]
+		}
+	}
+	suffix := byte(0)
+	if n := len(name); n > 0 && strings.ContainsRune("!&?", rune(name[n-1])) {
+		suffix, name = name[n-1], name[:n-1]
+	}
+	o := findOption(name)
+	negate, invert := false, false
+	if o == nil && strings.HasPrefix(name, "no") {
+		o, negate = findOption(name[2:]), true
+	}
+	if o == nil && strings.HasPrefix(name, "inv") {
+		o, invert = findOption(name[3:]), true
+	}
+	if o == nil {
+		return "", fmt.Errorf("E518: Unknown option: %s", arg)
+	}
+	switch {
+	case suffix == '?' || (o.num != nil && !hasVal && suffix == 0):
+		return o.show(&e.opts), nil
+	case suffix == '&':
+		if o.num != nil {
+			*o.num(&e.opts) = *o.num(&defaultOptions)
+		} else {
+			*o.flag(&e.opts) = *o.flag(&defaultOptions)
+		}
+	case o.num != nil:
+		n, err := strconv.Atoi(val)
+		if err != nil || negate || invert || suffix != 0 {
+			return "", fmt.Errorf("E521: Number required after =: %s", arg)
+		}
+		p := o.num(&e.opts)
+		switch op {
+		case '+':
+			n = *p + n
+		case '-':
+			n = *p - n
+		case '^':
+			n = *p * n
+		}
+		if n <= 0 {
+			return "", fmt.Errorf("E487: Argument must be positive: %s", arg)
+		}
+		*p = min(n, 64)
+	default:
+		if hasVal {
+			return "", fmt.Errorf("E474: Invalid argument: %s", arg)
+		}
+		p := o.flag(&e.opts)
+		*p = !negate
+		if invert || suffix == '!' {
+			*p = !*p
+		}
+	}
+	e.applyOptions()
+	return "", nil
+}
+
+// applyOptions pushes the options that the rendering helpers read into the
+// package-level settings they use
+func (e *editor) applyOptions() {
+	tabWidth = e.opts.tabstop
+	showList = e.opts.list
+	if e.scr != nil {
+		e.scr.invalidate()
+	}
+}
+
+// indentUnit is what one level of indentation inserts
+func (e *editor) indentUnit() string {
+	if e.opts.expandtab {
+		return strings.Repeat(" ", e.opts.shiftwidth)
+	}
+	return "\t"
+}
+
+// rcPath is the startup file: $BSERC, or ~/.bserc
+func rcPath() string {
+	if p := os.Getenv("BSERC"); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".bserc")
+}
+
+// loadRC runs each line of the startup file as an ex command. Blank lines and
+// lines starting with " are skipped. Errors don't stop the rest of the file;
+// they are printed on stderr, which is still there after bse exits, and the
+// first is left in the status bar.
+func (e *editor) loadRC(name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "bse: %v\n", err)
+		}
+		return
+	}
+	defer f.Close()
+	first := ""
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "\"") {
+			continue
+		}
+		if err := e.execEx(line); err != nil {
+			msg := fmt.Sprintf("%s line %d: %v", name, n, err)
+			fmt.Fprintln(os.Stderr, "bse: "+msg)
+			if first == "" {
+				first = msg
+			}
+		}
+	}
+	e.status = first
+}
+
+// keymap is one :map entry
+type keymap struct {
+	lhs, rhs []rune
+}
+
+// mapModes are the mode letters each :map command applies to
+var mapModes = map[string]string{
+	"map": "nv", "no": "nv", "noremap": "nv",
+	"nm": "n", "nmap": "n", "nn": "n", "nnoremap": "n",
+	"vm": "v", "vmap": "v", "xm": "v", "xmap": "v", "vn": "v", "vnoremap": "v",
+	"im": "i", "imap": "i", "ino": "i", "inoremap": "i",
+}
+
+// unmapModes are the same for the :unmap commands
+var unmapModes = map[string]string{
+	"unm": "nv", "unmap": "nv", "nun": "n", "nunmap": "n",
+	"vu": "v", "vunmap": "v", "iu": "i", "iunmap": "i",
+}
+
+// mapMode returns the mode letter whose mappings apply right now
+func (e *editor) mapMode() byte {
+	switch {
+	case e.mode == "NORMAL":
+		return 'n'
+	case e.mode == "INSERT":
+		return 'i'
+	case e.inVisual():
+		return 'v'
+	}
+	return 0
+}
+
+// exMap implements :map, :nmap, :imap and friends. With no right-hand side
+// it lists the matching mappings. Mapped keys are never themselves remapped,
+// so every :map acts like :noremap.
+func (e *editor) exMap(c *exCmd, modes string) error {
+	lhsText, rhsText, _ := strings.Cut(c.arg, " ")
+	rhsText = strings.TrimLeft(rhsText, " \t")
+	if rhsText == "" {
+		e.status = e.listMaps(modes, parseKeys(lhsText))
+		return nil
+	}
+	if e.maps == nil {
+		e.maps = map[byte][]keymap{}
+	}
+	lhs, rhs := parseKeys(lhsText), parseKeys(rhsText)
+	for i := 0; i < len(modes); i++ {
+		e.removeMap(modes[i], lhs)
+		e.maps[modes[i]] = append(e.maps[modes[i]], keymap{lhs, rhs})
+	}
+	return nil
+}
+
+// exUnmap implements :unmap, :nunmap, :vunmap and :iunmap
+func (e *editor) exUnmap(c *exCmd, modes string) error {
+	if c.arg == "" {
+		return errors.New("E474: Invalid argument")
+	}
+	lhs := parseKeys(c.arg)
+	found := false
+	for i := 0; i < len(modes); i++ {
+		found = e.removeMap(modes[i], lhs) || found
+	}
+	if !found {
+		return errors.New("E31: No such mapping")
+	}
+	return nil
+}
+
+func (e *editor) removeMap(mode byte, lhs []rune) bool {
+	maps := e.maps[mode]
+	for i, km := range maps {
+		if string(km.lhs) == string(lhs) {
+			e.maps[mode] = append(maps[:i], maps[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// listMaps describes the mappings in modes whose lhs starts with prefix
+func (e *editor) listMaps(modes string, prefix []rune) string {
+	var out []string
+	for i := 0; i < len(modes); i++ {
+		for _, km := range e.maps[modes[i]] {
+			if strings.HasPrefix(string(km.lhs), string(prefix)) {
+				out = append(out, fmt.Sprintf("%c %s %s", modes[i], keyNotation(km.lhs), keyNotation(km.rhs)))
+			}
+		}
+	}
+	if len(out) == 0 {
+		return "No mapping found"
+	}
+	sort.Strings(out)
+	return strings.Join(out, " | ")
+}
+
+// keyNames are the <...> key notations understood in mappings
+var keyNames = map[string]rune{
+	"cr": '\r', "enter": '\r', "return": '\r', "esc": keyEsc, "tab": '\t',
+	"space": ' ', "bs": 127, "lt": '<', "bar": '|', "bslash": '\\', "nl": '\n',
+	"up": keyUp, "down": keyDown, "left": keyLeft, "right": keyRight,
+	"home": keyHome, "end": keyEnd, "del": keyDelete, "pageup": keyPgUp,
+	"pagedown": keyPgDn, "nop": -1,
+}
+
+// keyDisplay is how keyNotation writes the keys that need a <...> name
+var keyDisplay = map[rune]string{
+	'\r': "<CR>", keyEsc: "<Esc>", '\t': "<Tab>", ' ': "<Space>", 127: "<BS>",
+	'<': "<lt>", '\n': "<NL>", keyUp: "<Up>", keyDown: "<Down>", keyLeft: "<Left>",
+	keyRight: "<Right>", keyHome: "<Home>", keyEnd: "<End>", keyDelete: "<Del>",
+	keyPgUp: "<PageUp>", keyPgDn: "<PageDown>",
+}
+
+// parseKeys turns a mapping's text into keys, decoding <CR>, <C-x> and the like
+func parseKeys(s string) []rune {
+	var keys []rune
+	for i := 0; i < len(s); {
+		if s[i] == '<' {
+			if j := strings.IndexByte(s[i:], '>'); j > 1 {
+				name := strings.ToLower(s[i+1 : i+j])
+				if k, ok := keyNames[name]; ok {
+					if k >= 0 {
+						keys = append(keys, k)
+					}
+					i += j + 1
+					continue
+				}
+				if len(name) == 3 && name[:2] == "c-" && name[2] >= '@' && name[2] <= 'z' {
+					keys = append(keys, rune(name[2]&0x1f))
+					i += j + 1
+					continue
+				}
+			}
+		}
+		r, n := utf8.DecodeRuneInString(s[i:])
+		keys = append(keys, r)
+		i += n
+	}
+	return keys
+}
+
+// keyNotation is the inverse of parseKeys, for listing mappings
+func keyNotation(keys []rune) string {
+	var b strings.Builder
+	for _, k := range keys {
+		switch name, ok := keyDisplay[k]; {
+		case ok:
+			b.WriteString(name)
+		case k < 0x20:
+			b.WriteString("<C-" + string(k|0x60) + ">")
+		default:
+			b.WriteRune(k)
+		}
+	}
+	return b.String()
+}
+
+// mapTimeout is how long a key that starts a mapping waits for the rest of it
+const mapTimeout = time.Second
+
+// readMapped reads a key through the mappings of the current mode. Keys that
+// came from the right-hand side of a mapping are not mapped again.
+func (e *editor) readMapped() rune {
+	k := e.readKey()
+	mode := e.mapMode()
+	if e.keyNoremap || len(e.maps[mode]) == 0 {
+		return k
+	}
+	seq := []rune{k}
+	for {
+		var exact *keymap
+		longer := false
+		for i, km := range e.maps[mode] {
+			switch {
+			case string(km.lhs) == string(seq):
+				exact = &e.maps[mode][i]
+			case strings.HasPrefix(string(km.lhs), string(seq)):
+				longer = true
+			}
+		}
+		if exact != nil && !longer {
+			return e.expandMap(exact.rhs)
+		}
+		if !longer {
+			break
+		}
+		next, ok := e.readKeyWithin(mapTimeout)
+		if !ok {
+			if exact != nil {
+				return e.expandMap(exact.rhs)
+			}
+			break
+		}
+		seq = append(seq, next)
+	}
+	// no mapping: the first key stands for itself and the rest are looked at again
+	for i := len(seq) - 1; i > 0; i-- {
+		e.unreadKey(seq[i])
+	}
+	return seq[0]
+}
+
+// expandMap queues a mapping's right-hand side in place of its keys
+func (e *editor) expandMap(rhs []rune) rune {
+	e.pending = append(append([]rune{}, rhs...), e.pending...)
+	e.noremapKeys += len(rhs)
+	return e.readMapped()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+)
+
+// Bracketed paste: the terminal wraps pasted text in ESC[200~ ... ESC[201~
+// so it can be told apart from typing
+const (
+	pasteOn  = "\x1b[?2004h"
+	pasteOff = "\x1b[?2004l"
+	pasteEnd = "\x1b[201~"
+	maxPaste = 64 << 20 // bytes; longer pastes are cut short
+)
+
+// readPaste reads the body of a bracketed paste, up to its closing sequence
+func (e *editor) readPaste() string {
+	var b strings.Builder
+	for {
+		c, err := e.in.ReadByte()
+		if err != nil {
+			break
+		}
+		b.WriteByte(c)
+		if c == '~' && strings.HasSuffix(b.String(), pasteEnd) {
+			s := b.String()
+			return s[:len(s)-len(pasteEnd)]
+		}
+		if b.Len() > maxPaste {
+			// a missing end marker mustn't swallow the rest of the session
+			break
+		}
+	}
+	return b.String()
+}
+
+// handlePaste inserts pasted text as it is, without autoindent, tab
+// expansion or mappings, as a single change that one u undoes. In normal
+// mode it goes in before the cursor; on the command line only its first line
+// is used.
+func (e *editor) handlePaste(text string) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	switch {
+	case e.mode == "CMD" || e.mode == "SEARCH":
+		line, _, _ := strings.Cut(text, "\n")
+		e.cmd += line
+		e.status = e.cmd
+		if e.mode == "SEARCH" {
+			e.incrementalSearch()
+		}
+	case e.hex != nil && (e.mode == "INSERT" || e.mode == "REPLACE" || e.mode == "NORMAL"):
+		e.hexPaste(text)
+	case e.mode == "INSERT" || e.mode == "NORMAL":
+		if text == "" {
+			return
+		}
+		e.saveSnapshot()
+		tail := len(e.lines[e.row]) - e.col
+		e.insertText(e.row, e.col, text)
+		e.modified = true
+		if e.mode == "INSERT" {
+			// the cursor goes after the text, ready to type on
+			e.col = len(e.lines[e.row]) - tail
+		}
+	}
+}
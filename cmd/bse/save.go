@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	swapInterval = 4 * time.Second // idle time before the swap file is refreshed
+	swapChanges  = 200             // changes before the swap file is refreshed
+)
+
+// umask is the process umask, which new files are created with
+var umask = processUmask()
+
+// fileFormat records how a file's lines were terminated so that writing it
+// back reproduces them
+type fileFormat struct {
+	crlf bool // lines end in \r\n
+	eol  bool // the last line has a line ending
+}
+
+// encodeLines joins lines back into file contents in the given format
+func encodeLines(lines []string, f fileFormat) []byte {
+	if len(lines) == 1 && lines[0] == "" && !f.eol {
+		return nil
+	}
+	nl := "\n"
+	if f.crlf {
+		nl = "\r\n"
+	}
+	out := strings.Join(lines, nl)
+	if f.eol {
+		out += nl
+	}
+	return []byte(out)
+}
+
+// atomicWrite replaces name with data without ever leaving a truncated file:
+// the data goes to a temporary file in the same directory which is synced and
+// renamed over the original. The original's mode and owner are kept, and
+// symlinks are written through. Files with several hard links are rewritten
+// in place so the links stay shared.
+func atomicWrite(name string, data []byte) error {
+	return atomicWriteFrom(name, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}, true)
+}
+
+// atomicWriteFrom is atomicWrite with the contents produced by write. When
+// inPlace is unset the file is never rewritten in place, which matters when
+// write is reading the old file.
+func atomicWriteFrom(name string, write func(io.Writer) error, inPlace bool) error {
+	path := name
+	if real, err := filepath.EvalSymlinks(name); err == nil {
+		path = real
+	}
+	perm := 0666 &^ umask
+	info, statErr := os.Stat(path)
+	if statErr == nil {
+		perm = info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if linkCount(info) > 1 {
+			if !inPlace {
+				return fmt.Errorf("%s has several hard links and can't be replaced", name)
+			}
+			return writeInPlace(path, write, perm)
+		}
+	}
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".bse-*")
+	if err != nil {
+		if statErr == nil && os.IsPermission(err) && inPlace {
+			// the file is writable but its directory is not
+			return writeInPlace(path, write, perm)
+		}
+		return err
+	}
+	tmpName := tmp.Name()
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	bw := bufio.NewWriterSize(tmp, 1<<16)
+	if err := write(bw); err != nil {
+		return fail(err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return fail(err)
+	}
+	if statErr == nil {
+		keepOwner(tmp, info)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+func writeInPlace(path string, write func(io.Writer) error, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// swapPath returns the swap file used while editing name: .name.swp beside it
+func swapPath(name string) string {
+	dir, base := filepath.Split(name)
+	return filepath.Join(dir, "."+base+".swp")
+}
+
+// maybeWriteSwap journals the buffer to the swap file when it has changed
+// enough, or (with idle set) when it has changed at all since the last write
+func (e *editor) maybeWriteSwap(idle bool) {
+	if e.swapFile == "" || e.changes == e.swapChanges || !e.modified || e.hex != nil {
+		return
+	}
+	if !idle && e.changes-e.swapChanges < swapChanges && time.Since(e.swapTime) < swapInterval {
+		return
+	}
+	if err := e.writeSwap(e.row); err != nil {
+		e.status = "swap write failed: " + err.Error()
+	}
+}
+
+// writeSwap writes the swap file: a short header, a blank line, then the buffer
+func (b *buffer) writeSwap(row int) error {
+	var sb strings.Builder
+	abs, _ := filepath.Abs(b.filename)
+	fmt.Fprintf(&sb, "bse-swap 1\nfile: %s\npid: %d\nrow: %d\ncrlf: %t\neol: %t\n\n", abs, os.Getpid(), row, b.format.crlf, b.format.eol)
+	for _, l := range b.lines {
+		sb.WriteString(l + "\n")
+	}
+	tmp := b.swapFile + ".new"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.swapFile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	b.swapChanges = b.changes
+	b.swapTime = time.Now()
+	return nil
+}
+
+// removeSwap deletes the swap file once the buffer is safely on disk
+func (b *buffer) removeSwap() {
+	if b.swapFile == "" {
+		return
+	}
+	os.Remove(b.swapFile)
+	b.swapChanges = b.changes
+}
+
+// swapContents is what a swap file holds
+type swapContents struct {
+	pid    int
+	row    int
+	format fileFormat
+	lines  []string
+}
+
+func readSwap(path string) (*swapContents, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	header, body, ok := strings.Cut(string(data), "\n\n")
+	if !ok || !strings.HasPrefix(header, "bse-swap 1\n") {
+		return nil, fmt.Errorf("%s: not a bse swap file", path)
+	}
+	sc := &swapContents{}
+	for _, line := range strings.Split(header, "\n")[1:] {
+		key, val, _ := strings.Cut(line, ": ")
+		switch key {
+		case "pid":
+			sc.pid, _ = strconv.Atoi(val)
+		case "row":
+			sc.row, _ = strconv.Atoi(val)
+		case "crlf":
+			sc.format.crlf = val == "true"
+		case "eol":
+			sc.format.eol = val == "true"
+		}
+	}
+	sc.lines = strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	return sc, nil
+}
+
+// checkSwap looks for a swap file left by an earlier session and asks what to
+// do with it before the terminal goes raw. It returns false to quit.
+func (e *editor) checkSwap(in *bufio.Reader) bool {
+	info, err := os.Stat(e.swapFile)
+	if err != nil {
+		return true
+	}
+	sc, err := readSwap(e.swapFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bse: ignoring unreadable swap file %s\n", e.swapFile)
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "bse: found swap file %s\n", e.swapFile)
+	fmt.Fprintf(os.Stderr, "     modified: %s, %d lines\n", info.ModTime().Format(time.RFC1123), len(sc.lines))
+	if sc.pid > 0 && sc.pid != os.Getpid() && processRunning(sc.pid) {
+		fmt.Fprintf(os.Stderr, "     process %d (still running) may be editing this file\n", sc.pid)
+	}
+	for {
+		fmt.Fprint(os.Stderr, "[R]ecover, [E]dit anyway, [D]elete swap, [Q]uit: ")
+		answer, err := in.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "r":
+			e.lines = sc.lines
+			e.format = sc.format
+			e.row = min(sc.row, len(e.lines)-1)
+			e.modified = true
+			e.changes++
+			e.status = "recovered from " + filepath.Base(e.swapFile) + "; :w to keep, :e! to discard"
+			return true
+		case "e":
+			return true
+		case "d":
+			os.Remove(e.swapFile)
+			return true
+		case "q":
+			return false
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Without unix file ownership, hard link counts or directory fsync, files
+// are replaced with the mode alone kept.
+
+func processUmask() os.FileMode {
+	return 0022
+}
+
+func linkCount(info os.FileInfo) int {
+	return 1
+}
+
+func keepOwner(f *os.File, info os.FileInfo) {}
+
+func syncDir(dir string) {}
+
+// processRunning can't tell, so says no
+func processRunning(pid int) bool {
+	return false
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func processUmask() os.FileMode {
+	m := syscall.Umask(0)
+	syscall.Umask(m)
+	return os.FileMode(m)
+}
+
+// linkCount returns how many hard links a file has
+func linkCount(info os.FileInfo) int {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Nlink)
+	}
+	return 1
+}
+
+// keepOwner gives f the owner and group of the file it replaces
+func keepOwner(f *os.File, info os.FileInfo) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		// only root can give a file away; keeping our own ownership is fine
+		f.Chown(int(st.Uid), int(st.Gid))
+	}
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+func processRunning(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// cell is one character position on the terminal. The second half of a wide
+// character has ch == "".
+type cell struct {
+	ch   string
+	attr string
+}
+
+// screen is a virtual copy of the terminal. Drawing fills cur and flush sends
+// only the cells that differ from what the terminal already shows.
+type screen struct {
+	width, height int
+	cur, prev     [][]cell
+	cursorY       int
+	cursorX       int
+	full          bool
+	out           *bufio.Writer
+}
+
+func newScreen(out io.Writer, width, height int) *screen {
+	s := &screen{out: bufio.NewWriter(out)}
+	s.resize(width, height)
+	return s
+}
+
+// resize reallocates the buffers and forces the next flush to repaint everything
+func (s *screen) resize(width, height int) {
+	s.width, s.height = width, height
+	s.cur = makeCells(width, height)
+	s.prev = makeCells(width, height)
+	s.full = true
+}
+
+func makeCells(width, height int) [][]cell {
+	rows := make([][]cell, height)
+	for y := range rows {
+		rows[y] = make([]cell, width)
+	}
+	return rows
+}
+
+// setLine lays text out on row y starting at visual column leftCol, with
+// per-cell attributes (attrs may be nil)
+func (s *screen) setLine(y int, text string, leftCol int, attrs []string) {
+	s.setSpan(y, 0, s.width, text, leftCol, attrs)
+}
+
+// setSpan is setLine confined to the cells [x, x+width) of row y
+func (s *screen) setSpan(y, x, width int, text string, leftCol int, attrs []string) {
+	if y < 0 || y >= s.height || x >= s.width {
+		return
+	}
+	width = min(width, s.width-x)
+	cells := layoutLine(text, leftCol, width)
+	row := s.cur[y][x : x+width]
+	for i := range row {
+		a := ""
+		if attrs != nil {
+			a = attrs[i]
+		}
+		row[i] = cell{ch: cells[i], attr: a}
+	}
+}
+
+// setText writes text at row y, column x without touching the rest of the row
+func (s *screen) setText(y, x int, text, attr string) {
+	if y < 0 || y >= s.height {
+		return
+	}
+	cells := layoutLine(text, 0, max(s.width-x, 0))
+	for i, c := range cells {
+		if x+i >= s.width || i >= displayWidth(text) {
+			break
+		}
+		s.cur[y][x+i] = cell{ch: c, attr: attr}
+	}
+}
+
+// invalidate makes the next flush repaint everything
+func (s *screen) invalidate() {
+	s.full = true
+}
+
+func (s *screen) setCursor(y, x int) {
+	s.cursorY, s.cursorX = y, x
+}
+
+// flush writes the difference between cur and prev to the terminal
+func (s *screen) flush() {
+	w := s.out
+	w.WriteString("\x1b[?25l")
+	if s.full {
+		w.WriteString("\x1b[0m\x1b[2J")
+	}
+	attr, cy, cx := "\x00", -1, -1
+	for y, row := range s.cur {
+		changed := make([]bool, len(row))
+		for x := len(row) - 1; x >= 0; x-- {
+			if s.full || row[x] != s.prev[y][x] {
+				changed[x] = true
+			}
+			// redrawing either half of a wide character means redrawing its first half
+			if changed[x] && row[x].ch == "" && x > 0 {
+				changed[x-1] = true
+			}
+		}
+		for x := 0; x < len(row); x++ {
+			c := row[x]
+			if !changed[x] || c.ch == "" {
+				continue
+			}
+			if cy != y || cx != x {
+				fmt.Fprintf(w, "\x1b[%d;%dH", y+1, x+1)
+			}
+			if c.attr != attr {
+				w.WriteString("\x1b[0m" + c.attr)
+				attr = c.attr
+			}
+			w.WriteString(c.ch)
+			cy, cx = y, x+1
+			if x+1 < len(row) && row[x+1].ch == "" {
+				cx++
+			}
+		}
+		copy(s.prev[y], row)
+	}
+	s.full = false
+	if attr != "" {
+		w.WriteString("\x1b[0m")
+	}
+	fmt.Fprintf(w, "\x1b[%d;%dH\x1b[?25h", s.cursorY+1, s.cursorX+1)
+	w.Flush()
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	attrSearch  = "\x1b[30;43m"
+	attrReverse = "\x1b[7m"
+	attrLineNr  = "\x1b[33m"
+)
+
+// searchState is the pattern being typed after / or ?, plus everything the
+// editor remembers between searches
+type searchState struct {
+	forward  bool
+	history  []string
+	histIdx  int
+	origRow  int
+	origCol  int
+	noHL     bool
+	cachePat string
+	cacheRe  *regexp.Regexp
+}
+
+// compileSearch compiles a Go regexp search pattern. \c anywhere makes it
+// case-insensitive and \C case-sensitive; otherwise case is ignored with the
+// ignorecase option, unless smartcase is also set and the pattern contains an
+// upper-case letter.
+func compileSearch(pat string, o *options) (*regexp.Regexp, error) {
+	fold := o.ignorecase
+	switch {
+	case strings.Contains(pat, `\c`):
+		pat = strings.ReplaceAll(pat, `\c`, "")
+		fold = true
+	case strings.Contains(pat, `\C`):
+		pat = strings.ReplaceAll(pat, `\C`, "")
+		fold = false
+	case fold && o.smartcase:
+		for _, r := range pat {
+			if unicode.IsUpper(r) {
+				fold = false
+				break
+			}
+		}
+	}
+	if fold {
+		pat = "(?i)" + pat
+	}
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		return nil, fmt.Errorf("E383: Invalid pattern: %v", err)
+	}
+	return re, nil
+}
+
+func (e *editor) startSearch(forward bool) {
+	e.mode = "SEARCH"
+	e.search.forward = forward
+	e.search.origRow, e.search.origCol = e.row, e.col
+	e.search.histIdx = len(e.search.history)
+	e.cmd = "/"
+	if !forward {
+		e.cmd = "?"
+	}
+	e.status = e.cmd
+}
+
+func (e *editor) handleSearch(k rune) {
+	switch {
+	case k == '\r' || k == '\n':
+		pat := e.cmd[1:]
+		if pat == "" {
+			pat = e.searchQuery
+		}
+		e.setMode("NORMAL")
+		e.row, e.col = e.search.origRow, e.search.origCol
+		if pat == "" {
+			e.status = "E35: No previous regular expression"
+			return
+		}
+		e.addSearchHistory(pat)
+		e.searchQuery = pat
+		e.search.noHL = false
+		e.performSearch(pat, e.search.forward)
+		return
+	case k == keyEsc:
+		e.setMode("NORMAL")
+		e.row, e.col = e.search.origRow, e.search.origCol
+		e.cmd = ""
+		return
+	case k == keyUp || k == keyDown:
+		h := e.search.history
+		if k == keyUp && e.search.histIdx > 0 {
+			e.search.histIdx--
+		} else if k == keyDown && e.search.histIdx < len(h) {
+			e.search.histIdx++
+		}
+		e.cmd = e.cmd[:1]
+		if e.search.histIdx < len(h) {
+			e.cmd += h[e.search.histIdx]
+		}
+	case k == 127 || k == 8:
+		if len(e.cmd) > 1 {
+			e.cmd = dropLastRune(e.cmd)
+		}
+	case isInsertable(k):
+		e.cmd += string(k)
+	}
+	e.status = e.cmd
+	e.incrementalSearch()
+}
+
+// incrementalSearch moves the cursor to the first match of the pattern typed
+// so far, or back to where the search started when there is none
+func (e *editor) incrementalSearch() {
+	e.row, e.col = e.search.origRow, e.search.origCol
+	pat := e.cmd[1:]
+	if pat == "" || e.hex != nil {
+		return
+	}
+	re, err := compileSearch(pat, &e.opts)
+	if err != nil {
+		return
+	}
+	if r, c, _, ok := e.findMatch(re, e.row, e.col, e.search.forward); ok {
+		e.row, e.col = r, c
+	}
+}
+
+func (e *editor) addSearchHistory(pat string) {
+	h := e.search.history
+	for i, p := range h {
+		if p == pat {
+			h = append(h[:i], h[i+1:]...)
+			break
+		}
+	}
+	e.search.history = append(h, pat)
+}
+
+// performSearch moves to the next match of query after the cursor
+func (e *editor) performSearch(query string, forward bool) {
+	if query == "" {
+		return
+	}
+	var re *regexp.Regexp
+	var err error
+	if e.hex == nil {
+		if re, err = compileSearch(query, &e.opts); err != nil {
+			e.status = err.Error()
+			return
+		}
+	}
+	var wrapped, ok bool
+	if e.hex != nil {
+		// patterns are bytes in hex mode
+		wrapped, ok, err = e.hexSearch(query, forward)
+	} else if e.pg != nil {
+		// record the jump first so that a page switch carries it along
+		e.pushJump()
+		wrapped, ok, err = e.findMatchLarge(re, forward)
+	} else {
+		var r, c int
+		if r, c, wrapped, ok = e.findMatch(re, e.row, e.col, forward); ok {
+			e.pushJump()
+			e.row, e.col = r, c
+		}
+	}
+	if err == nil && !ok {
+		err = errors.New("E486: Pattern not found: " + query)
+	}
+	if err != nil {
+		e.status = err.Error()
+		e.abortKeys()
+		return
+	}
+	e.status = ""
+	if wrapped && forward {
+		e.status = "search hit BOTTOM, continuing at TOP"
+	} else if wrapped {
+		e.status = "search hit TOP, continuing at BOTTOM"
+	}
+}
+
+// findMatch finds the first match of re strictly after (or before) row, col,
+// wrapping around the end of the buffer
+func (e *editor) findMatch(re *regexp.Regexp, row, col int, forward bool) (int, int, bool, bool) {
+	n := len(e.lines)
+	for i := 0; i <= n; i++ {
+		r := row + i
+		if !forward {
+			r = row - i
+		}
+		wrapped := r >= n || r < 0
+		r = (r%n + n) % n
+		matches := re.FindAllStringIndex(e.lines[r], -1)
+		if forward {
+			for _, m := range matches {
+				if i > 0 || m[0] > col {
+					if i == n && m[0] > col {
+						break
+					}
+					return r, m[0], wrapped, true
+				}
+			}
+		} else {
+			for j := len(matches) - 1; j >= 0; j-- {
+				m := matches[j]
+				if i > 0 || m[0] < col {
+					if i == n && m[0] < col {
+						break
+					}
+					return r, m[0], wrapped, true
+				}
+			}
+		}
+	}
+	return 0, 0, false, false
+}
+
+// searchWord implements * and #: search for the whole word under the cursor
+func (e *editor) searchWord(forward bool) {
+	line := e.lines[e.row]
+	isWord := func(i int) bool {
+		r, _ := utf8.DecodeRuneInString(line[i:])
+		return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+	start := e.col
+	for start < len(line) && !isWord(start) {
+		start = nextBoundary(line, start)
+	}
+	end := start
+	for end < len(line) && isWord(end) {
+		end = nextBoundary(line, end)
+	}
+	for start > 0 && isWord(prevBoundary(line, start)) {
+		start = prevBoundary(line, start)
+	}
+	if start == end {
+		e.status = "E348: No string under cursor"
+		return
+	}
+	word := line[start:end]
+	pat := regexp.QuoteMeta(word)
+	if isASCII(word) {
+		pat = `\b` + pat + `\b`
+	}
+	pat = `\C` + pat
+	e.addSearchHistory(pat)
+	e.searchQuery = pat
+	e.search.forward = forward
+	e.search.noHL = false
+	e.col = start
+	e.performSearch(pat, forward)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// highlightRe returns the pattern whose matches should be highlighted, if any
+func (e *editor) highlightRe() *regexp.Regexp {
+	pat := e.searchQuery
+	if e.mode == "SEARCH" {
+		pat = e.cmd[1:]
+	} else if e.search.noHL || !e.opts.hlsearch {
+		return nil
+	}
+	if pat == "" {
+		return nil
+	}
+	if pat != e.search.cachePat {
+		re, err := compileSearch(pat, &e.opts)
+		if err != nil {
+			return nil
+		}
+		e.search.cachePat, e.search.cacheRe = pat, re
+	}
+	return e.search.cacheRe
+}
+
+// paint sets the attribute of the visual cells [from, to) of a row drawn from leftCol
+func paint(attrs []string, leftCol, from, to int, attr string) {
+	for v := max(from, leftCol); v < to && v-leftCol < len(attrs); v++ {
+		attrs[v-leftCol] = attr
+	}
+}
+
+// paintMatches highlights the matches of re in line
+func paintMatches(attrs []string, line string, leftCol int, re *regexp.Regexp) {
+	for _, m := range re.FindAllStringIndex(line, -1) {
+		if m[0] == m[1] {
+			continue
+		}
+		paint(attrs, leftCol, visualCol(line, m[0]), visualCol(line, m[1]), attrSearch)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// shellCommand builds a command that runs line in the user's shell: $SHELL,
+// or highway when that isn't set, falling back to /bin/sh
+func shellCommand(line string) *exec.Cmd {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+		if p, err := exec.LookPath("highway"); err == nil {
+			shell = p
+		}
+	}
+	return exec.Command(shell, "-c", line)
+}
+
+// expandShellCmd substitutes the current file name for an unescaped % and
+// the previous command for ! in a :! command line, like vim
+func (e *editor) expandShellCmd(line string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && i+1 < len(line) && (line[i+1] == '%' || line[i+1] == '!'):
+			b.WriteByte(line[i+1])
+			i++
+		case c == '%':
+			b.WriteString(e.filename)
+		case c == '!':
+			if e.lastShellCmd == "" {
+				return "", errors.New("E34: No previous command")
+			}
+			b.WriteString(e.lastShellCmd)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if strings.TrimSpace(b.String()) == "" {
+		return "", errors.New("E471: Argument required")
+	}
+	e.lastShellCmd = b.String()
+	return b.String(), nil
+}
+
+// runShell runs line with input on stdin and returns what it wrote to stdout.
+// A command that fails reports its exit status and the start of its stderr.
+func runShell(line string, input []byte) ([]byte, error) {
+	cmd := shellCommand(line)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if i := strings.IndexByte(msg, '\n'); i >= 0 {
+			msg = msg[:i]
+		}
+		if ee, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("shell returned %d", ee.ExitCode())
+		}
+		if msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return stdout.Bytes(), err
+	}
+	return stdout.Bytes(), nil
+}
+
+// outputLines splits command output into buffer lines
+func outputLines(out []byte) []string {
+	s := strings.ReplaceAll(string(out), "\r\n", "\n")
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// exBang implements :!cmd, and :{range}!cmd which filters the lines through
+// cmd and replaces them with its output
+func (e *editor) exBang(c *exCmd) error {
+	line, err := e.expandShellCmd(c.arg)
+	if err != nil {
+		return err
+	}
+	if len(c.addrs) == 0 {
+		return e.showShell(line)
+	}
+	first, last := e.lineRange(c, false)
+	input := encodeLines(e.lines[first:last+1], fileFormat{eol: true})
+	out, err := runShell(line, input)
+	if err != nil {
+		// a failing filter leaves the text alone rather than replace it with an error
+		return err
+	}
+	lines := outputLines(out)
+	e.saveSnapshot()
+	e.lines = append(e.lines[:first], append(lines, e.lines[last+1:]...)...)
+	if len(e.lines) == 0 {
+		e.lines = []string{""}
+	}
+	e.row = min(first, len(e.lines)-1)
+	e.col = 0
+	e.moveCursor('^')
+	e.modified = true
+	e.status = fmt.Sprintf("%d lines filtered", last-first+1)
+	return nil
+}
+
+// showShell runs a command for its output. One line fits in the status bar;
+// more are shown on the normal screen until a key is pressed, as vim does.
+// The command's stdin is empty: the editor is still reading the terminal.
+func (e *editor) showShell(line string) error {
+	out, err := runShell(line, nil)
+	lines := outputLines(out)
+	if len(lines) == 0 {
+		return err
+	}
+	if e.scr == nil {
+		// headless: the output goes straight to stdout
+		os.Stdout.Write(out)
+		return err
+	}
+	if len(lines) == 1 && err == nil {
+		e.status = lines[0]
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString(pasteOff + mouseOff + "\x1b[?1049l\r\n:!" + line + "\r\n")
+	for _, l := range lines {
+		b.WriteString(l + "\r\n")
+	}
+	if err != nil {
+		b.WriteString(err.Error() + "\r\n")
+	}
+	b.WriteString("Press any key to continue")
+	os.Stdout.WriteString(b.String())
+	e.readKey()
+	os.Stdout.WriteString("\r\n\x1b[?1049h" + mouseOn + pasteOn)
+	e.scr.invalidate()
+	return nil
+}
+
+// exReadCmd implements :r !cmd, inserting the command's output below the
+// addressed line
+func (e *editor) exReadCmd(c *exCmd, cmdline string) error {
+	line, err := e.expandShellCmd(cmdline)
+	if err != nil {
+		return err
+	}
+	out, err := runShell(line, nil)
+	if err != nil {
+		return err
+	}
+	lines := outputLines(out)
+	if len(lines) == 0 {
+		return nil
+	}
+	after := e.row + 1
+	if len(c.addrs) > 0 {
+		after = c.addrs[len(c.addrs)-1]
+	}
+	e.insertLines(after, lines)
+	return nil
+}
+
+// filterMotion implements !{motion}: like vim it opens the command line with
+// the range the motion covers, ready for the filter command to be typed
+func (e *editor) filterMotion(count int) {
+	row, col := e.row, e.col
+	target := row
+	switch k := e.readKey(); k {
+	case '!':
+		target = row + count - 1
+	case 'G':
+		target = len(e.lines) - 1
+	case 'g':
+		if e.readKey() != 'g' {
+			return
+		}
+		target = 0
+	default:
+		for i := 0; i < count; i++ {
+			if !e.moveCursor(k) {
+				return
+			}
+		}
+		target = e.row
+	}
+	e.row, e.col = row, col
+	target = min(max(target, 0), len(e.lines)-1)
+	e.mode = "CMD"
+	switch {
+	case target == row:
+		e.cmd = ":.!"
+	case target > row:
+		e.cmd = fmt.Sprintf(":.,.+%d!", target-row)
+	default:
+		e.cmd = fmt.Sprintf(":.-%d,.!", row-target)
+	}
+	e.status = e.cmd
+}
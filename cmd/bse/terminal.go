@@ -0,0 +1,250 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// startTerminal puts the terminal in raw mode on the alternate screen and
+// starts reading keys in the background
+func (e *editor) startTerminal() {
+	fd := int(os.Stdin.Fd())
+	e.oldState, _ = term.MakeRaw(fd)
+	os.Stdout.WriteString("\x1b[?1049h" + mouseOn + pasteOn)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-sigCh
+		// keep unsaved work in the swap file for recovery on the next open
+		for _, w := range e.wins {
+			if w.modified && w.swapFile != "" && w.hex == nil {
+				w.writeSwap(w.row)
+			}
+		}
+		e.stopTerminal()
+		os.Exit(0)
+	}()
+
+	e.winch = make(chan os.Signal, 1)
+	notifyResize(e.winch)
+	e.scr = newScreen(os.Stdout, 0, 0)
+	e.resize()
+
+	e.keys = make(chan rune)
+	e.mouse = make(chan mouseEvent)
+	e.pasted = make(chan string)
+	go func() {
+		for {
+			k, ev := e.decodeKey()
+			text := ""
+			if k == keyPaste {
+				text = e.readPaste()
+			}
+			e.keys <- k
+			if k == keyMouse {
+				e.mouse <- ev
+			}
+			if k == keyPaste {
+				e.pasted <- text
+			}
+			if k == keyNone {
+				return
+			}
+		}
+	}()
+}
+
+// stopTerminal leaves the alternate screen, restoring the shell's scrollback,
+// and puts the terminal back in cooked mode
+func (e *editor) stopTerminal() {
+	os.Stdout.WriteString(pasteOff + mouseOff + "\x1b[0m\x1b[?25h\x1b[?1049l")
+	if e.oldState != nil {
+		term.Restore(int(os.Stdin.Fd()), e.oldState)
+	}
+}
+
+// resize picks up the current terminal size and re-lays out the screen
+func (e *editor) resize() {
+	w, h, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || w <= 0 || h <= 1 {
+		w, h = 80, 24
+	}
+	e.width, e.height = w, h
+	e.scr.resize(w, h)
+	e.layout()
+}
+
+// readKey returns the next key. Keys pushed back with unreadKey are returned
+// first; while waiting on the terminal, window resizes are handled and redrawn.
+func (e *editor) readKey() rune {
+	k, _ := e.readKeyWithin(0)
+	return k
+}
+
+// readKeyWithin is readKey giving up after timeout, if it is nonzero
+func (e *editor) readKeyWithin(timeout time.Duration) (rune, bool) {
+	if len(e.pending) > 0 {
+		k := e.pending[0]
+		e.pending = e.pending[1:]
+		e.keyNoremap = e.noremapKeys > 0
+		if e.keyNoremap {
+			e.noremapKeys--
+		}
+		return k, true
+	}
+	e.keyNoremap = false
+	if e.feeding {
+		// keys fed by :normal never wait on the terminal
+		return keyEsc, timeout == 0
+	}
+	idle := time.NewTimer(swapInterval)
+	defer idle.Stop()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	// keep the status line's line count moving while a large file is indexed
+	var tick <-chan time.Time
+	if e.indexing() {
+		t := time.NewTicker(indexTick)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case k := <-e.keys:
+			switch {
+			case k == keyMouse:
+				e.mouseEv = <-e.mouse
+			case k == keyPaste:
+				e.pasteText = <-e.pasted
+				if e.recording != 0 {
+					// a macro types the text back in
+					e.recorded = append(e.recorded, []rune(e.pasteText)...)
+				}
+			case e.recording != 0:
+				e.recorded = append(e.recorded, k)
+			}
+			return k, true
+		case <-e.winch:
+			e.resize()
+			e.draw()
+		case <-idle.C:
+			e.maybeWriteSwap(true)
+		case <-tick:
+			e.draw()
+			if !e.indexing() {
+				tick = nil
+			}
+		case <-expired:
+			return 0, false
+		}
+	}
+}
+
+// decodeKey reads one key from the terminal, decoding arrow and editing keys
+// and mouse reports from their escape sequences
+func (e *editor) decodeKey() (rune, mouseEvent) {
+	b, err := e.in.ReadByte()
+	if err != nil {
+		return keyNone, mouseEvent{}
+	}
+	if b >= 0x80 {
+		return e.readUTF8(b), mouseEvent{}
+	}
+	if b != 0x1b || e.in.Buffered() == 0 {
+		return rune(b), mouseEvent{}
+	}
+	next, _ := e.in.ReadByte()
+	if next != '[' && next != 'O' {
+		e.in.UnreadByte()
+		return keyEsc, mouseEvent{}
+	}
+	// CSI/SS3: parameter bytes followed by a single final byte
+	params := ""
+	for {
+		c, err := e.in.ReadByte()
+		if err != nil {
+			return keyEsc, mouseEvent{}
+		}
+		if c >= 0x40 && c <= 0x7e {
+			if strings.HasPrefix(params, "<") {
+				if ev, ok := parseMouse(params, c); ok {
+					return keyMouse, ev
+				}
+			}
+			return decodeCSI(params, c), mouseEvent{}
+		}
+		params += string(c)
+	}
+}
+
+// readUTF8 reads the continuation bytes of a multi-byte character
+func (e *editor) readUTF8(lead byte) rune {
+	n := 0
+	switch {
+	case lead&0xe0 == 0xc0:
+		n = 1
+	case lead&0xf0 == 0xe0:
+		n = 2
+	case lead&0xf8 == 0xf0:
+		n = 3
+	}
+	buf := []byte{lead}
+	for i := 0; i < n; i++ {
+		c, err := e.in.ReadByte()
+		if err != nil {
+			break
+		}
+		if c&0xc0 != 0x80 {
+			e.in.UnreadByte()
+			break
+		}
+		buf = append(buf, c)
+	}
+	r, _ := utf8.DecodeRune(buf)
+	return r
+}
+
+// decodeCSI maps a CSI sequence to a special key
+func decodeCSI(params string, final byte) rune {
+	switch final {
+	case 'A':
+		return keyUp
+	case 'B':
+		return keyDown
+	case 'C':
+		return keyRight
+	case 'D':
+		return keyLeft
+	case 'H':
+		return keyHome
+	case 'F':
+		return keyEnd
+	case '~':
+		switch params {
+		case "1", "7":
+			return keyHome
+		case "4", "8":
+			return keyEnd
+		case "3":
+			return keyDelete
+		case "5":
+			return keyPgUp
+		case "6":
+			return keyPgDn
+		case "200":
+			return keyPaste
+		}
+	}
+	return keyEsc
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Visual selection kinds; also used as the shape of a register
+const (
+	visualChar = iota
+	visualLine
+	visualBlock
+)
+
+var visualModes = map[int]string{
+	visualChar:  "VISUAL",
+	visualLine:  "V-LINE",
+	visualBlock: "V-BLOCK",
+}
+
+// register holds yanked or deleted text and the shape it was taken in
+type register struct {
+	lines []string
+	kind  int
+}
+
+// visualState is the anchor of a selection; the other end is the cursor
+type visualState struct {
+	kind      int
+	anchorRow int
+	anchorCol int
+	row, col  int  // cursor end, kept when the selection is closed for gv
+	toEOL     bool // blockwise selection extended with $
+	valid     bool
+}
+
+// selection is a visual selection normalised so start comes before end.
+// Columns are byte offsets (inclusive) for charwise selections and visual
+// cells (inclusive) for blockwise ones.
+type selection struct {
+	kind     int
+	startRow int
+	startCol int
+	endRow   int
+	endCol   int
+	toEOL    bool
+}
+
+// blockInsert tracks a blockwise I/A/c so the text typed on the first line
+// can be repeated on the others when insert mode ends
+type blockInsert struct {
+	top, bottom int
+	vcol        int
+	at          int
+	orig        string
+	numLines    int
+	pad         bool
+	toEOL       bool
+}
+
+func (e *editor) inVisual() bool {
+	return e.mode == "VISUAL" || e.mode == "V-LINE" || e.mode == "V-BLOCK"
+}
+
+func (e *editor) startVisual(kind int) {
+	e.visual = visualState{kind: kind, anchorRow: e.row, anchorCol: e.col, valid: true}
+	e.mode = visualModes[kind]
+	e.status = ""
+}
+
+// endVisual leaves visual mode, remembering the selection for gv
+func (e *editor) endVisual() {
+	sel := e.selection()
+	e.marks['<'] = mark{sel.startRow, e.selStartCol(sel)}
+	e.marks['>'] = mark{sel.endRow, 0}
+	e.visual.row, e.visual.col = e.row, e.col
+	e.lastVisual = e.visual
+	e.setMode("NORMAL")
+}
+
+func (e *editor) reselectVisual() {
+	if !e.lastVisual.valid {
+		e.status = "no previous visual selection"
+		return
+	}
+	e.visual = e.lastVisual
+	e.row = min(e.visual.row, len(e.lines)-1)
+	e.col = min(e.visual.col, len(e.lines[e.row]))
+	e.visual.anchorRow = min(e.visual.anchorRow, len(e.lines)-1)
+	e.mode = visualModes[e.visual.kind]
+	e.status = ""
+}
+
+// selection returns the current visual selection in normalised form
+func (e *editor) selection() selection {
+	v := e.visual
+	s := selection{kind: v.kind, startRow: v.anchorRow, startCol: v.anchorCol, endRow: e.row, endCol: e.col, toEOL: v.toEOL}
+	if s.kind == visualBlock {
+		aLine := e.lines[min(v.anchorRow, len(e.lines)-1)]
+		cLine := e.lines[e.row]
+		aFrom, aTo := cellRange(aLine, v.anchorCol)
+		cFrom, cTo := cellRange(cLine, e.col)
+		s.startCol = min(aFrom, cFrom)
+		s.endCol = max(aTo, cTo)
+		s.startRow, s.endRow = min(v.anchorRow, e.row), max(v.anchorRow, e.row)
+		return s
+	}
+	if s.endRow < s.startRow || (s.endRow == s.startRow && s.endCol < s.startCol) {
+		s.startRow, s.startCol, s.endRow, s.endCol = s.endRow, s.endCol, s.startRow, s.startCol
+	}
+	return s
+}
+
+// cellRange returns the first and last visual cell of the character at col
+func cellRange(s string, col int) (int, int) {
+	from := visualCol(s, col)
+	if col >= len(s) {
+		return from, from
+	}
+	return from, visualCol(s, nextBoundary(s, col)) - 1
+}
+
+// bytes returns the selected byte range [from, to) of line row
+func (s selection) bytes(line string, row int) (int, int, bool) {
+	if row < s.startRow || row > s.endRow {
+		return 0, 0, false
+	}
+	switch s.kind {
+	case visualLine:
+		return 0, len(line), true
+	case visualBlock:
+		from := byteColAtVisual(line, s.startCol)
+		to := byteColAtVisual(line, s.endCol+1)
+		if s.toEOL {
+			to = len(line)
+		}
+		return from, max(from, to), true
+	}
+	from, to := 0, len(line)
+	if row == s.startRow {
+		from = min(s.startCol, len(line))
+	}
+	if row == s.endRow {
+		to = nextBoundary(line, min(s.endCol, len(line)))
+	}
+	return from, max(from, to), true
+}
+
+// span returns the selected visual cells [from, to) of line row for drawing
+func (s selection) span(line string, row int) (int, int, bool) {
+	from, to, ok := s.bytes(line, row)
+	if !ok {
+		return 0, 0, false
+	}
+	vfrom, vto := visualCol(line, from), visualCol(line, to)
+	// Show empty lines inside a charwise or linewise selection
+	if vfrom == vto && s.kind != visualBlock {
+		vto++
+	}
+	return vfrom, vto, true
+}
+
+func (e *editor) handleVisual(k rune) {
+	if k == '$' || k == keyEnd {
+		e.moveCursor(k)
+		e.visual.toEOL = true
+		return
+	}
+	if e.moveCursor(k) {
+		if k != 'j' && k != 'k' && k != keyUp && k != keyDown {
+			e.visual.toEOL = false
+		}
+		return
+	}
+	switch k {
+	case keyEsc:
+		e.endVisual()
+	case ':':
+		e.endVisual()
+		e.mode = "CMD"
+		e.cmd = ":'<,'>"
+		e.status = e.cmd
+	case '!':
+		e.endVisual()
+		e.mode = "CMD"
+		e.cmd = ":'<,'>!"
+		e.status = e.cmd
+	case 'v', 'V', 0x16:
+		kind := map[rune]int{'v': visualChar, 'V': visualLine, 0x16: visualBlock}[k]
+		if kind == e.visual.kind {
+			e.endVisual()
+			return
+		}
+		e.visual.kind = kind
+		e.mode = visualModes[kind]
+	case 'o':
+		e.visual.anchorRow, e.row = e.row, e.visual.anchorRow
+		e.visual.anchorCol, e.col = e.col, e.visual.anchorCol
+	case 'g':
+		if next := e.readKey(); next == 'g' {
+			e.pushJump()
+			e.gotoLine(0)
+			e.col = 0
+		} else {
+			e.unreadKey(next)
+		}
+	case 'y':
+		sel := e.selection()
+		e.reg = e.yankSelection(sel)
+		e.endVisual()
+		e.row, e.col = sel.startRow, e.selStartCol(sel)
+		e.status = "yanked"
+	case 'd', 'x', keyDelete:
+		sel := e.selection()
+		e.endVisual()
+		e.saveSnapshot()
+		e.reg = e.yankSelection(sel)
+		e.deleteSelection(sel)
+	case 'c', 's':
+		sel := e.selection()
+		e.endVisual()
+		e.saveSnapshot()
+		e.reg = e.yankSelection(sel)
+		e.changeSelection(sel)
+	case '>', '<':
+		sel := e.selection()
+		e.endVisual()
+		e.saveSnapshot()
+		for r := sel.startRow; r <= sel.endRow; r++ {
+			e.lines[r] = e.shiftLine(e.lines[r], k == '>')
+		}
+		e.row = sel.startRow
+		e.moveCursor('^')
+		e.modified = true
+	case '~', 'u', 'U':
+		sel := e.selection()
+		e.endVisual()
+		e.saveSnapshot()
+		conv := map[rune]func(string) string{'~': toggleCase, 'u': strings.ToLower, 'U': strings.ToUpper}[k]
+		for r := sel.startRow; r <= sel.endRow; r++ {
+			line := e.lines[r]
+			from, to, _ := sel.bytes(line, r)
+			e.lines[r] = line[:from] + conv(line[from:to]) + line[to:]
+		}
+		e.row, e.col = sel.startRow, e.selStartCol(sel)
+		e.modified = true
+	case 'I', 'A':
+		sel := e.selection()
+		e.endVisual()
+		if sel.kind != visualBlock {
+			if k == 'I' {
+				e.row, e.col = sel.startRow, 0
+				if sel.kind == visualChar {
+					e.col = sel.startCol
+				}
+			} else {
+				e.row, e.col = sel.endRow, len(e.lines[sel.endRow])
+				if sel.kind == visualChar {
+					e.col = nextBoundary(e.lines[e.row], min(sel.endCol, len(e.lines[e.row])))
+				}
+			}
+			e.setMode("INSERT")
+			return
+		}
+		if k == 'I' {
+			e.startBlockInsert(sel, sel.startCol, false)
+		} else {
+			e.startBlockInsert(sel, sel.endCol+1, true)
+		}
+	}
+}
+
+// selStartCol is the byte column at the top-left corner of sel
+func (e *editor) selStartCol(sel selection) int {
+	switch sel.kind {
+	case visualLine:
+		return 0
+	case visualBlock:
+		return byteColAtVisual(e.lines[sel.startRow], sel.startCol)
+	}
+	return min(sel.startCol, len(e.lines[sel.startRow]))
+}
+
+// yankSelection copies the selected text into a register
+func (e *editor) yankSelection(sel selection) register {
+	reg := register{kind: sel.kind}
+	for r := sel.startRow; r <= sel.endRow; r++ {
+		line := e.lines[r]
+		from, to, _ := sel.bytes(line, r)
+		reg.lines = append(reg.lines, line[from:to])
+	}
+	return reg
+}
+
+// deleteSelection removes the selected text and leaves the cursor at its start
+func (e *editor) deleteSelection(sel selection) {
+	e.modified = true
+	switch sel.kind {
+	case visualLine:
+		e.lines = append(e.lines[:sel.startRow], e.lines[sel.endRow+1:]...)
+		if len(e.lines) == 0 {
+			e.lines = []string{""}
+		}
+		e.row = min(sel.startRow, len(e.lines)-1)
+		e.col = 0
+	case visualBlock:
+		for r := sel.startRow; r <= sel.endRow; r++ {
+			line := e.lines[r]
+			from, to, _ := sel.bytes(line, r)
+			e.lines[r] = line[:from] + line[to:]
+		}
+		e.row = sel.startRow
+		e.col = byteColAtVisual(e.lines[e.row], sel.startCol)
+	default:
+		first := e.lines[sel.startRow]
+		last := e.lines[sel.endRow]
+		from, _, _ := sel.bytes(first, sel.startRow)
+		_, to, _ := sel.bytes(last, sel.endRow)
+		joined := first[:from] + last[to:]
+		e.lines = append(e.lines[:sel.startRow], append([]string{joined}, e.lines[sel.endRow+1:]...)...)
+		e.row = sel.startRow
+		e.col = from
+	}
+}
+
+// changeSelection deletes the selection and starts insert mode in its place
+func (e *editor) changeSelection(sel selection) {
+	switch sel.kind {
+	case visualLine:
+		e.lines = append(e.lines[:sel.startRow], append([]string{""}, e.lines[sel.endRow+1:]...)...)
+		e.row, e.col = sel.startRow, 0
+		e.modified = true
+		e.setMode("INSERT")
+	case visualBlock:
+		e.deleteSelection(sel)
+		if sel.toEOL {
+			sel.toEOL = false
+		}
+		e.startBlockInsert(sel, sel.startCol, false)
+	default:
+		e.deleteSelection(sel)
+		e.setMode("INSERT")
+	}
+}
+
+// startBlockInsert enters insert mode at visual column vcol of the block's
+// first line; finishBlockInsert copies what was typed to the other lines
+func (e *editor) startBlockInsert(sel selection, vcol int, appending bool) {
+	line := e.lines[sel.startRow]
+	if appending && !sel.toEOL {
+		line = padToVisual(line, vcol)
+	}
+	at := byteColAtVisual(line, vcol)
+	if appending && sel.toEOL {
+		at = len(line)
+	}
+	if line != e.lines[sel.startRow] {
+		e.saveSnapshot()
+		e.lines[sel.startRow] = line
+	}
+	e.blockInsert = &blockInsert{
+		top:      sel.startRow,
+		bottom:   sel.endRow,
+		vcol:     vcol,
+		at:       at,
+		orig:     line,
+		numLines: len(e.lines),
+		pad:      appending,
+		toEOL:    appending && sel.toEOL,
+	}
+	e.row, e.col = sel.startRow, at
+	e.setMode("INSERT")
+}
+
+func (e *editor) finishBlockInsert() {
+	bi := e.blockInsert
+	e.blockInsert = nil
+	if len(e.lines) != bi.numLines {
+		return // a line break was typed; vim gives up on the block too
+	}
+	line := e.lines[bi.top]
+	n := len(line) - len(bi.orig)
+	if n <= 0 || line[:bi.at] != bi.orig[:bi.at] || line[bi.at+n:] != bi.orig[bi.at:] {
+		return
+	}
+	text := line[bi.at : bi.at+n]
+	e.saveSnapshot()
+	for r := bi.top + 1; r <= bi.bottom; r++ {
+		l := e.lines[r]
+		switch {
+		case bi.toEOL:
+			e.lines[r] = l + text
+			continue
+		case bi.pad:
+			l = padToVisual(l, bi.vcol)
+		case displayWidth(l) < bi.vcol:
+			continue // short lines are skipped by blockwise I
+		}
+		at := byteColAtVisual(l, bi.vcol)
+		e.lines[r] = l[:at] + text + l[at:]
+	}
+	e.row, e.col = bi.top, bi.at
+	e.modified = true
+}
+
+// shiftLine indents or dedents a line by one shiftwidth
+func (e *editor) shiftLine(line string, right bool) string {
+	if right {
+		if line == "" {
+			return line
+		}
+		return e.indentUnit() + line
+	}
+	if strings.HasPrefix(line, "\t") {
+		return line[1:]
+	}
+	n := 0
+	for n < e.opts.shiftwidth && n < len(line) && line[n] == ' ' {
+		n++
+	}
+	return line[n:]
+}
+
+func toggleCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Columns in bse are byte offsets into a line that always sit on a grapheme
+// boundary; the helpers here step between boundaries and work out how many
+// terminal cells each grapheme takes.
+
+// tabWidth and showList mirror the tabstop and list options for the drawing
+// helpers below
+var (
+	tabWidth = defaultOptions.tabstop
+	showList bool
+)
+
+// wideRanges are the East Asian Wide and Fullwidth code points, plus the
+// emoji that terminals draw two cells wide
+var wideRanges = [][2]rune{
+	{0x1100, 0x115F}, {0x231A, 0x231B}, {0x2329, 0x232A}, {0x23E9, 0x23EC},
+	{0x23F0, 0x23F0}, {0x23F3, 0x23F3}, {0x25FD, 0x25FE}, {0x2614, 0x2615},
+	{0x2648, 0x2653}, {0x267F, 0x267F}, {0x2693, 0x2693}, {0x26A1, 0x26A1},
+	{0x26AA, 0x26AB}, {0x26BD, 0x26BE}, {0x26C4, 0x26C5}, {0x26CE, 0x26CE},
+	{0x26D4, 0x26D4}, {0x26EA, 0x26EA}, {0x26F2, 0x26F3}, {0x26F5, 0x26F5},
+	{0x26FA, 0x26FA}, {0x26FD, 0x26FD}, {0x2705, 0x2705}, {0x270A, 0x270B},
+	{0x2728, 0x2728}, {0x274C, 0x274C}, {0x274E, 0x274E}, {0x2753, 0x2755},
+	{0x2757, 0x2757}, {0x2795, 0x2797}, {0x27B0, 0x27B0}, {0x27BF, 0x27BF},
+	{0x2B1B, 0x2B1C}, {0x2B50, 0x2B50}, {0x2B55, 0x2B55}, {0x2E80, 0x303E},
+	{0x3041, 0x33FF}, {0x3400, 0x4DBF}, {0x4E00, 0x9FFF}, {0xA000, 0xA4CF},
+	{0xA960, 0xA97F}, {0xAC00, 0xD7A3}, {0xF900, 0xFAFF}, {0xFE10, 0xFE19},
+	{0xFE30, 0xFE6F}, {0xFF00, 0xFF60}, {0xFFE0, 0xFFE6}, {0x16FE0, 0x16FE4},
+	{0x17000, 0x18AFF}, {0x1B000, 0x1B2FF}, {0x1F004, 0x1F004}, {0x1F0CF, 0x1F0CF},
+	{0x1F18E, 0x1F18E}, {0x1F191, 0x1F19A}, {0x1F200, 0x1F251}, {0x1F300, 0x1F64F},
+	{0x1F680, 0x1F6FF}, {0x1F7E0, 0x1F7EB}, {0x1F90C, 0x1F9FF}, {0x1FA70, 0x1FAFF},
+	{0x20000, 0x2FFFD}, {0x30000, 0x3FFFD},
+}
+
+func isWide(r rune) bool {
+	i := sort.Search(len(wideRanges), func(i int) bool { return wideRanges[i][1] >= r })
+	return i < len(wideRanges) && wideRanges[i][0] <= r
+}
+
+// isExtend reports whether r attaches to the preceding character instead of
+// starting a new grapheme
+func isExtend(r rune) bool {
+	switch {
+	case r == 0x200D: // zero width joiner
+		return true
+	case r >= 0xFE00 && r <= 0xFE0F, r >= 0xE0100 && r <= 0xE01EF: // variation selectors
+		return true
+	case r >= 0x1F3FB && r <= 0x1F3FF: // emoji skin tone modifiers
+		return true
+	case r >= 0xE0020 && r <= 0xE007F: // emoji tag sequences
+		return true
+	}
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc)
+}
+
+func isRegionalIndicator(r rune) bool { return r >= 0x1F1E6 && r <= 0x1F1FF }
+
+// nextBoundary returns the byte offset of the grapheme after the one at i
+func nextBoundary(s string, i int) int {
+	if i >= len(s) {
+		return len(s)
+	}
+	r, n := utf8.DecodeRuneInString(s[i:])
+	j := i + n
+	if r == utf8.RuneError && n == 1 {
+		return j
+	}
+	if isRegionalIndicator(r) {
+		if r2, n2 := utf8.DecodeRuneInString(s[j:]); isRegionalIndicator(r2) {
+			j += n2
+		}
+	}
+	for j < len(s) {
+		r2, n2 := utf8.DecodeRuneInString(s[j:])
+		if !isExtend(r2) {
+			break
+		}
+		j += n2
+		if r2 == 0x200D && j < len(s) {
+			// ZWJ glues the following character into the same grapheme
+			_, n3 := utf8.DecodeRuneInString(s[j:])
+			j += n3
+		}
+	}
+	return j
+}
+
+// prevBoundary returns the byte offset of the grapheme before offset i
+func prevBoundary(s string, i int) int {
+	prev := 0
+	for j := 0; j < i && j < len(s); {
+		prev = j
+		j = nextBoundary(s, j)
+	}
+	return prev
+}
+
+// graphemeStart returns the start of the grapheme containing byte offset i
+func graphemeStart(s string, i int) int {
+	if i >= len(s) {
+		return len(s)
+	}
+	start := 0
+	for j := 0; j <= i; {
+		start = j
+		j = nextBoundary(s, j)
+	}
+	return start
+}
+
+// graphemeCells returns what to draw for the grapheme g, one string per
+// terminal cell; the second cell of a wide character is "".
+func graphemeCells(g string) []string {
+	r, _ := utf8.DecodeRuneInString(g)
+	switch {
+	case r == '\t' && !showList:
+		cells := make([]string, tabWidth)
+		for i := range cells {
+			cells[i] = " "
+		}
+		return cells
+	case r < 0x20 || r == 0x7f:
+		return []string{"^", string(r ^ 0x40)}
+	case r == utf8.RuneError && len(g) == 1, r >= 0x80 && r < 0xa0:
+		return []string{"�"}
+	case isWide(r) || (strings.ContainsRune(g, 0xFE0F) && r >= 0x2000):
+		return []string{g, ""}
+	case isExtend(r):
+		// a combining mark with nothing to combine with
+		return []string{" " + g}
+	}
+	return []string{g}
+}
+
+func graphemeWidth(g string) int {
+	return len(graphemeCells(g))
+}
+
+// visualCol returns the screen column of byte offset col in s
+func visualCol(s string, col int) int {
+	if col > len(s) {
+		col = len(s)
+	}
+	v := 0
+	for i := 0; i < col; {
+		j := nextBoundary(s, i)
+		v += graphemeWidth(s[i:j])
+		i = j
+	}
+	return v
+}
+
+// displayWidth returns the number of cells s takes on screen
+func displayWidth(s string) int {
+	return visualCol(s, len(s))
+}
+
+// byteColAtVisual returns the byte offset of the character covering visual column vcol
+func byteColAtVisual(s string, vcol int) int {
+	v := 0
+	for i := 0; i < len(s); {
+		j := nextBoundary(s, i)
+		w := graphemeWidth(s[i:j])
+		if v+w > vcol {
+			return i
+		}
+		v += w
+		i = j
+	}
+	return len(s)
+}
+
+// padToVisual pads s with spaces until it is at least vcol cells wide
+func padToVisual(s string, vcol int) string {
+	if w := displayWidth(s); w < vcol {
+		s += strings.Repeat(" ", vcol-w)
+	}
+	return s
+}
+
+// truncateWidth cuts s down to at most width cells
+func truncateWidth(s string, width int) string {
+	v := 0
+	for i := 0; i < len(s); {
+		j := nextBoundary(s, i)
+		v += graphemeWidth(s[i:j])
+		if v > width {
+			return s[:i]
+		}
+		i = j
+	}
+	return s
+}
+
+// layoutLine lays s out on a row of width cells starting at visual column
+// leftCol. Wide characters cut by either edge are shown as blanks.
+func layoutLine(s string, leftCol, width int) []string {
+	cells := make([]string, width)
+	for i := range cells {
+		cells[i] = " "
+	}
+	v := 0
+	for i := 0; i < len(s) && v < leftCol+width; {
+		j := nextBoundary(s, i)
+		gc := graphemeCells(s[i:j])
+		wide := len(gc) == 2 && gc[1] == ""
+		clipped := wide && (v < leftCol || v+1 >= leftCol+width)
+		for c, text := range gc {
+			x := v + c - leftCol
+			if x < 0 || x >= width {
+				continue
+			}
+			if clipped {
+				text = " "
+			}
+			cells[x] = text
+		}
+		v += len(gc)
+		i = j
+	}
+	return cells
+}
+
+// isInsertable reports whether k is text that insert mode should add to the buffer
+func isInsertable(k rune) bool {
+	if k < 0x20 || k == 0x7f || k >= keyUp || (k >= 0x80 && k < 0xa0) {
+		return false
+	}
+	return unicode.IsPrint(k) || unicode.Is(unicode.Cf, k) || k == ' '
+}
+
+// dropLastRune removes the final rune of s
+func dropLastRune(s string) string {
+	_, n := utf8.DecodeLastRuneInString(s)
+	return s[:len(s)-n]
+}
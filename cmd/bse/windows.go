@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// buffer is the text of one file. Several windows may show the same buffer.
+type buffer struct {
+	filename string
+	lines    []string
+	modified bool
+	readonly bool
+	format   fileFormat
+	pg       *pager   // set in large-file mode, when lines is one page of the file
+	hex      *hexView // set in hex mode, when the buffer is bytes and lines is unused
+
+	undoStack []snapshot
+	redoStack []snapshot
+	marks     map[rune]mark
+
+	swapFile    string
+	changes     int
+	swapChanges int
+	swapTime    time.Time
+}
+
+// window is a view of a buffer: its own cursor, scroll position and visual
+// selection, laid out in the screen columns [x, x+w)
+type window struct {
+	*buffer
+	row, col   int
+	topLine    int
+	leftCol    int
+	visual     visualState
+	lastVisual visualState
+	jumps      []mark
+	jumpIdx    int
+	x, w       int
+}
+
+// openBuffer loads name, or starts an empty buffer if it can't be read. With
+// paged set a large file is paged through rather than read in whole.
+func openBuffer(name string, paged bool) *buffer {
+	b := &buffer{
+		filename: name,
+		lines:    []string{""},
+		format:   fileFormat{eol: true},
+		marks:    map[rune]mark{},
+		swapFile: swapPath(name),
+	}
+	if info, err := os.Stat(name); err == nil && paged && (info.Size() >= largeFileSize || isDevice(info)) {
+		if b.openLarge(name) {
+			return b
+		}
+	}
+	if lines, format, err := readLines(name); err == nil {
+		b.lines, b.format = lines, format
+	}
+	return b
+}
+
+// layout shares the screen width out evenly between the windows, with a
+// one-column border between neighbours
+func (e *editor) layout() {
+	n := len(e.wins)
+	avail := e.width - (n - 1)
+	x := 0
+	for i, w := range e.wins {
+		w.x = x
+		w.w = avail / n
+		if i < avail%n {
+			w.w++
+		}
+		w.w = max(w.w, 1)
+		x += w.w + 1
+	}
+}
+
+// textHeight is the number of text rows in each window
+func (e *editor) textHeight() int {
+	return max(e.height-1, 1)
+}
+
+// focus makes w the current window
+func (e *editor) focus(w *window) {
+	if w == e.window {
+		return
+	}
+	if e.inVisual() {
+		e.endVisual()
+	}
+	e.maybeWriteSwap(true)
+	e.window = w
+	e.clampRow()
+	e.col = min(e.col, len(e.lines[e.row]))
+}
+
+// winIndex returns the position of the current window in e.wins
+func (e *editor) winIndex() int {
+	for i, w := range e.wins {
+		if w == e.window {
+			return i
+		}
+	}
+	return 0
+}
+
+// splitWindow opens name (or the current buffer again) in a new window to
+// the right of the current one
+func (e *editor) splitWindow(name string) error {
+	if e.width/(len(e.wins)+1) < 2 {
+		return errors.New("E36: Not enough room")
+	}
+	b := e.buffer
+	status := ""
+	if name != "" && name != b.filename {
+		b = nil
+		for _, w := range e.wins {
+			if w.filename == name {
+				b = w.buffer
+			}
+		}
+		if b == nil && e.binary {
+			b = openHexBuffer(name)
+			b.readonly = e.readonly
+		} else if b == nil {
+			b = openBuffer(name, true)
+			b.readonly = e.readonly
+			if _, err := os.Stat(b.swapFile); err == nil {
+				// leave another session's journal alone; opening the file on
+				// its own offers to recover it
+				status = "E325: swap file " + b.swapFile + " exists; not journalling this window"
+				b.swapFile = ""
+			}
+		}
+	}
+	if status == "" {
+		status = fmt.Sprintf("\"%s\" %s", filepath.Base(b.filename), b.sizeLabel())
+	}
+	w := &window{buffer: b, row: e.row, col: e.col, topLine: e.topLine}
+	if b != e.buffer {
+		w.row, w.col, w.topLine = 0, 0, 0
+	}
+	i := e.winIndex() + 1
+	e.wins = append(e.wins[:i], append([]*window{w}, e.wins[i:]...)...)
+	e.layout()
+	e.focus(w)
+	e.status = status
+	return nil
+}
+
+// closeWindow closes the current window, quitting when it is the last one.
+// A buffer's unsaved changes only stop the close if no other window shows it.
+func (e *editor) closeWindow(force bool) error {
+	shared := false
+	for _, w := range e.wins {
+		if w != e.window && w.buffer == e.buffer {
+			shared = true
+		}
+	}
+	if e.modified && !force && !shared {
+		return errors.New("No write since last change (use :q! to force quit)")
+	}
+	if len(e.wins) == 1 {
+		e.quit = true
+		return nil
+	}
+	if !shared {
+		e.removeSwap()
+		if e.pg != nil {
+			e.pg.file.close()
+		}
+		if e.hex != nil {
+			e.hex.close()
+		}
+	}
+	i := e.winIndex()
+	e.wins = append(e.wins[:i], e.wins[i+1:]...)
+	e.setMode("NORMAL")
+	e.window = e.wins[max(i-1, 0)]
+	e.clampRow()
+	e.layout()
+	return nil
+}
+
+// quitAll implements :qa, refusing while any buffer has unsaved changes
+func (e *editor) quitAll(force bool) error {
+	for _, w := range e.wins {
+		if w.modified && !force {
+			e.focus(w)
+			return fmt.Errorf("E162: No write since last change for buffer \"%s\"", w.filename)
+		}
+	}
+	e.quit = true
+	return nil
+}
+
+// windowCommand handles the key after Ctrl-W
+func (e *editor) windowCommand(k rune) {
+	i := e.winIndex()
+	n := len(e.wins)
+	switch k {
+	case 'w', 0x17:
+		e.focus(e.wins[(i+1)%n])
+	case 'W', 'p':
+		e.focus(e.wins[(i+n-1)%n])
+	case 'l', keyRight:
+		e.focus(e.wins[min(i+1, n-1)])
+	case 'h', keyLeft:
+		e.focus(e.wins[max(i-1, 0)])
+	case 'v':
+		if err := e.splitWindow(""); err != nil {
+			e.status = err.Error()
+		}
+	case 'q', 'c':
+		if err := e.closeWindow(false); err != nil {
+			e.status = err.Error()
+		}
+	case '=':
+		e.layout()
+	}
+}
+
+// windowAt returns the window covering screen column x, and whether x is the
+// border to its right instead
+func (e *editor) windowAt(x int) (*window, bool) {
+	for _, w := range e.wins {
+		if x < w.x+w.w {
+			return w, false
+		}
+		if x == w.x+w.w {
+			return w, true
+		}
+	}
+	return e.wins[len(e.wins)-1], false
+}
+
+// screenRow is one row of a window's text area: which line it shows, and
+// the visual column of that line its first cell holds
+type screenRow struct {
+	line  int
+	start int
+}
+
+// gutterWidth is the width of w's line number column, with its trailing space
+func (e *editor) gutterWidth(w *window) int {
+	if !e.opts.number && !e.opts.relativeNumber {
+		return 0
+	}
+	n, _ := w.lineCount()
+	return min(max(len(strconv.Itoa(n)), 3)+1, w.w-1)
+}
+
+// textWidth is the number of columns w has for text
+func (e *editor) textWidth(w *window) int {
+	return max(w.w-e.gutterWidth(w), 1)
+}
+
+// wrapStarts returns the visual column each screen row of s starts at when it
+// is wrapped at width; a wide character that doesn't fit moves to the next row
+func wrapStarts(s string, width int) []int {
+	starts := []int{0}
+	v := 0
+	for i := 0; i < len(s); {
+		j := nextBoundary(s, i)
+		gw := graphemeWidth(s[i:j])
+		if row := starts[len(starts)-1]; v+gw > row+width && v > row {
+			starts = append(starts, v)
+		}
+		v += gw
+		i = j
+	}
+	return starts
+}
+
+// screenRows lays out up to height rows of w from its top line. Without wrap
+// every line takes one row scrolled to leftCol.
+func (e *editor) screenRows(w *window, height int) []screenRow {
+	var rows []screenRow
+	for line := w.topLine; line < len(w.lines) && len(rows) < height; line++ {
+		if !e.opts.wrap {
+			rows = append(rows, screenRow{line, w.leftCol})
+			continue
+		}
+		for _, st := range wrapStarts(w.lines[line], e.textWidth(w)) {
+			rows = append(rows, screenRow{line, st})
+		}
+	}
+	return rows[:min(len(rows), height)]
+}
+
+// cursorRow returns the index in rows of the row holding w's cursor, or -1
+func (e *editor) cursorRow(w *window, rows []screenRow) int {
+	start := w.leftCol
+	if e.opts.wrap {
+		vcol := visualCol(w.lines[w.row], w.col)
+		for _, st := range wrapStarts(w.lines[w.row], e.textWidth(w)) {
+			if st <= vcol {
+				start = st
+			}
+		}
+	}
+	for i, r := range rows {
+		if r.line == w.row && r.start == start {
+			return i
+		}
+	}
+	return -1
+}
+
+// scrollIntoView adjusts w's scroll position so its cursor is visible
+func (e *editor) scrollIntoView(w *window) {
+	height, width := e.textHeight(), e.textWidth(w)
+	w.row = min(max(w.row, 0), len(w.lines)-1)
+	if w.row < w.topLine {
+		w.topLine = w.row
+	}
+	if w.row >= w.topLine+height {
+		w.topLine = w.row - height + 1
+	}
+	line := w.lines[w.row]
+	w.col = min(w.col, len(line))
+	if e.opts.wrap {
+		w.leftCol = 0
+		// scroll until the whole cursor line fits, or it is the top line
+		segments := len(wrapStarts(line, width))
+		for w.topLine < w.row {
+			shown := 0
+			for _, r := range e.screenRows(w, height) {
+				if r.line == w.row {
+					shown++
+				}
+			}
+			if shown == segments {
+				break
+			}
+			w.topLine++
+		}
+		return
+	}
+	cursorVisCol := visualCol(line, w.col)
+	if cursorVisCol < w.leftCol {
+		w.leftCol = cursorVisCol
+	}
+	cursorEnd := cursorVisCol
+	if w.col < len(line) {
+		cursorEnd = visualCol(line, nextBoundary(line, w.col)) - 1
+	}
+	if cursorEnd >= w.leftCol+width {
+		w.leftCol = cursorEnd - width + 1
+	}
+}
+
+// scroll moves w's view by n lines, dragging the cursor along when it would
+// leave the window
+func (w *window) scroll(n, height int) {
+	w.topLine = min(max(w.topLine+n, 0), max(len(w.lines)-height, 0))
+	vcol := visualCol(w.lines[min(w.row, len(w.lines)-1)], w.col)
+	row := min(min(max(w.row, w.topLine), w.topLine+height-1), len(w.lines)-1)
+	if row != w.row {
+		w.row = row
+		w.col = byteColAtVisual(w.lines[row], vcol)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -12,7 +14,26 @@ import (
 
 // highway: a minimal interactive shell with job control, pipes, and builtins
 func main() {
-	// Set up signal handling for SIGCHLD
+	if len(os.Args) > 2 && os.Args[1] == "-c" {
+		// run a command line given as an argument, as sh -c does, exiting
+		// with the status of the last command
+		execScript(strings.NewReader(os.Args[2]))
+		os.Exit(lastStatus)
+	}
+	if len(os.Args) > 1 {
+		scriptFile := os.Args[1]
+		f, err := os.Open(scriptFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "highway: cannot open script:", err)
+			os.Exit(1)
+		}
+		execScript(f)
+		f.Close()
+		os.Exit(lastStatus)
+	}
+	// Set up signal handling for SIGCHLD. Only when interactive: reaping
+	// any child could take the one a command is waiting on, and with it the
+	// status -c and scripts exit with.
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGCHLD)
 	go func() {
@@ -28,17 +49,6 @@ func main() {
 		}
 	}()
 
-	if len(os.Args) > 1 {
-		scriptFile := os.Args[1]
-		f, err := os.Open(scriptFile)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "highway: cannot open script:", err)
-			os.Exit(1)
-		}
-		defer f.Close()
-		execScript(f)
-		return
-	}
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		dir, _ := os.Getwd()
@@ -61,7 +71,7 @@ func main() {
 }
 
 // execScript reads and executes each line of a script file
-func execScript(f *os.File) {
+func execScript(f io.Reader) {
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -79,10 +89,28 @@ func execScript(f *os.File) {
 // aliasMap stores user-defined aliases
 var aliasMap = make(map[string]string)
 
+// lastStatus is the exit status of the last command, as $? is in sh
+var lastStatus int
+
+// runStatus returns the exit status of a command that ran with err: its
+// exit code, 128 plus the signal that killed it, or 126 if it couldn't run
+func runStatus(err error) int {
+	var ee *exec.ExitError
+	if err == nil {
+		return 0
+	} else if !errors.As(err, &ee) {
+		return 126
+	}
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ee.ExitCode()
+}
+
 // handleBuiltins processes built-in commands, returns true if handled
 func handleBuiltins(line string) bool {
 	if line == "exit" || line == "quit" {
-		os.Exit(0)
+		os.Exit(lastStatus)
 	}
 	if line == "clear" {
 		fmt.Print("\033[2J\033[H")
@@ -92,8 +120,10 @@ func handleBuiltins(line string) bool {
 		dir, err := os.Getwd()
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "pwd:", err)
+			lastStatus = 1
 		} else {
 			fmt.Println(dir)
+			lastStatus = 0
 		}
 		return true
 	}
@@ -108,8 +138,10 @@ func handleBuiltins(line string) bool {
 		} else {
 			dir = args[1]
 		}
+		lastStatus = 0
 		if err := os.Chdir(dir); err != nil {
 			fmt.Fprintln(os.Stderr, "cd:", err)
+			lastStatus = 1
 		}
 		return true
 	}
@@ -141,8 +173,10 @@ func handleBuiltins(line string) bool {
 		path, err := exec.LookPath(cmd)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s not found\n", cmd)
+			lastStatus = 1
 		} else {
 			fmt.Println(path)
+			lastStatus = 0
 		}
 		return true
 	}
@@ -343,13 +377,14 @@ func execOrChain(cmds []string) {
 		cmdPath, err := exec.LookPath(args[0])
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "highway: command not found:", args[0])
+			lastStatus = 127
 			continue
 		}
 		c := exec.Command(cmdPath, args[1:]...)
 		c.Stdin = os.Stdin
 		c.Stdout = os.Stdout
 		c.Stderr = os.Stderr
-		if err := c.Run(); err == nil {
+		if lastStatus = runStatus(c.Run()); lastStatus == 0 {
 			return // Success, stop executing
 		}
 	}
@@ -412,13 +447,15 @@ func execAndChain(cmds []string) {
 		cmdPath, err := exec.LookPath(args[0])
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "highway: command not found:", args[0])
+			lastStatus = 127
 			return
 		}
 		c := exec.Command(cmdPath, args[1:]...)
 		c.Stdin = os.Stdin
 		c.Stdout = os.Stdout
 		c.Stderr = os.Stderr
-		if err := c.Run(); err != nil {
+		err = c.Run()
+		if lastStatus = runStatus(err); err != nil {
 			fmt.Fprintln(os.Stderr, "Error:", err)
 			return
 		}
@@ -441,6 +478,7 @@ func execPipeline(cmds []string) {
 		cmdPath, err := exec.LookPath(args[0])
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "highway: command not found:", args[0])
+			lastStatus = 127
 			return
 		}
 		cmd := exec.Command(cmdPath, args[1:]...)
@@ -457,7 +495,7 @@ func execPipeline(cmds []string) {
 			var outBuf strings.Builder
 			cmd.Stdout = &outBuf
 			err = cmd.Run()
-			if err != nil {
+			if lastStatus = runStatus(err); err != nil {
 				fmt.Fprintln(os.Stderr, "Error:", err)
 				return
 			}
@@ -467,7 +505,7 @@ func execPipeline(cmds []string) {
 
 		cmd.Stderr = os.Stderr
 		err = cmd.Run()
-		if err != nil {
+		if lastStatus = runStatus(err); err != nil {
 			fmt.Fprintln(os.Stderr, "Error:", err)
 			return
 		}
@@ -483,13 +521,15 @@ func execSingle(cmdStr string) {
 	cmdPath, err := exec.LookPath(args[0])
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "highway: command not found:", args[0])
+		lastStatus = 127
 		return
 	}
 	cmd := exec.Command(cmdPath, args[1:]...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	err = cmd.Run()
+	if lastStatus = runStatus(err); err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
 	}
 }
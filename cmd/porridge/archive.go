@@ -0,0 +1,399 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Packages come in .zip, .tar, .tar.gz (or .tgz) and .porridge archives.
+// A .porridge is a gzipped tar, the format porridge repo build writes, as
+// tar keeps the symlinks, modes and ownership that zip loses.
+//
+// Every entry is extracted under the folder it is meant for, which it
+// must not get out of: its name has to stay inside lexically, nothing is
+// ever written through a symlink already there, and links may only point
+// at things inside the package, following the symlinks in it. As a link
+// extracted later can change where an earlier one leads, every symlink is
+// checked again once the whole archive is out. Ownership is kept when
+// running as root.
+const porridgeSuffix = ".porridge"
+
+// modeBits are the parts of a mode an extracted file keeps
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// archiveFormat returns zip, tar or tar.gz for the name of an archive, or
+// "" for anything else
+func archiveFormat(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"), strings.HasSuffix(name, porridgeSuffix):
+		return "tar.gz"
+	}
+	return ""
+}
+
+// extractArchive extracts the entries that keep accepts under folder in
+// the archive called name into dest. An empty folder means all of them.
+func extractArchive(name string, data []byte, folder, dest string, keep func(string) bool) error {
+	x := &extractor{root: dest, folder: folder, keep: keep, chown: os.Geteuid() == 0}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	var err error
+	switch archiveFormat(name) {
+	case "zip":
+		err = x.zip(data)
+	case "tar":
+		err = x.tar(bytes.NewReader(data))
+	case "tar.gz":
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			err = x.tar(zr)
+		}
+	default:
+		return fmt.Errorf("don't know how to unpack %s", filepath.Base(name))
+	}
+	if err != nil {
+		return err
+	}
+	return x.finish()
+}
+
+// extractor puts the entries of an archive under root
+type extractor struct {
+	root   string
+	folder string
+	keep   func(string) bool
+	chown  bool
+	dirs   []dirEntry // given their modes last, as they may not be writable
+	links  []string   // the symlinks made, to check again at the end
+}
+
+// entry is a file, folder or link in an archive
+type entry struct {
+	name     string
+	mode     os.FileMode
+	link     string // the target of a symlink or hard link
+	hardlink bool
+	owned    bool // whether uid and gid are known
+	uid, gid int
+	mtime    time.Time
+}
+
+type dirEntry struct {
+	path string
+	e    entry
+}
+
+func (x *extractor) zip(data []byte) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		e := entry{name: f.Name, mode: f.Mode(), mtime: f.Modified}
+		if e.mode&os.ModeSymlink != 0 {
+			target, err := io.ReadAll(io.LimitReader(rc, 4096))
+			if err != nil {
+				rc.Close()
+				return err
+			}
+			e.link = string(target)
+		}
+		err = x.add(e, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		e := entry{name: h.Name, mode: h.FileInfo().Mode(), link: h.Linkname, hardlink: h.Typeflag == tar.TypeLink,
+			owned: true, uid: h.Uid, gid: h.Gid, mtime: h.ModTime}
+		if err := x.add(e, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// rel returns the name of an entry relative to the folder being
+// extracted, and whether it is in it. A name that gets out of the archive
+// is an error.
+func (x *extractor) rel(name string) (string, bool, error) {
+	n := path.Clean(name)
+	if n != "." && !filepath.IsLocal(filepath.FromSlash(n)) {
+		return "", false, fmt.Errorf("%s is outside the archive", name)
+	}
+	if x.folder != "" {
+		var ok bool
+		if n, ok = strings.CutPrefix(n, x.folder+"/"); !ok {
+			return "", false, nil
+		}
+	}
+	return n, n != ".", nil
+}
+
+// resolve returns where under root the entry rel goes. It refuses names
+// that get out of root and paths through a symlink.
+func (x *extractor) resolve(rel string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("%s is outside the package", rel)
+	}
+	dir := x.root
+	parts := strings.Split(rel, "/")
+	for _, p := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, p)
+		if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is under the symlink %s", rel, rootRelTo(x.root, dir))
+		}
+	}
+	return filepath.Join(x.root, filepath.FromSlash(rel)), nil
+}
+
+// inside reports whether target, the target of a symlink in the folder
+// dir under root, leads somewhere under root. Symlinks already in the tree
+// are followed on the way; what isn't there yet is taken as written.
+func (x *extractor) inside(dir, target string) bool {
+	if target == "" || path.IsAbs(filepath.ToSlash(target)) {
+		return false
+	}
+	var cur []string
+	if dir != "." {
+		cur = strings.Split(dir, "/")
+	}
+	todo := strings.Split(filepath.ToSlash(target), "/")
+	for hops := 0; len(todo) > 0; {
+		c := todo[0]
+		todo = todo[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(cur) == 0 {
+				return false
+			}
+			cur = cur[:len(cur)-1]
+			continue
+		}
+		cur = append(cur, c)
+		p := filepath.Join(x.root, filepath.FromSlash(strings.Join(cur, "/")))
+		info, err := os.Lstat(p)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		link, err := os.Readlink(p)
+		if hops++; err != nil || hops > 40 || link == "" || path.IsAbs(filepath.ToSlash(link)) {
+			return false
+		}
+		cur = cur[:len(cur)-1]
+		todo = append(strings.Split(filepath.ToSlash(link), "/"), todo...)
+	}
+	return true
+}
+
+func rootRelTo(root, path string) string {
+	rel, _ := filepath.Rel(root, path)
+	return filepath.ToSlash(rel)
+}
+
+// add extracts one entry, reading a file's contents from r
+func (x *extractor) add(e entry, r io.Reader) error {
+	rel, ok, err := x.rel(e.name)
+	if err != nil || !ok || !x.keep(rel) {
+		return err
+	}
+	dest, err := x.resolve(rel)
+	if err != nil {
+		return err
+	}
+	switch {
+	case e.mode.IsDir():
+		if info, err := os.Lstat(dest); err == nil && !info.IsDir() {
+			os.Remove(dest)
+		}
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		x.dirs = append(x.dirs, dirEntry{dest, e})
+		return nil
+	case e.hardlink:
+		lrel, ok, err := x.rel(e.link)
+		if err != nil || !ok {
+			return fmt.Errorf("%s links to %s, outside the package", rel, e.link)
+		}
+		src, err := x.resolve(lrel)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Lstat(src); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("%s links to %s, which is not a file in the package", rel, e.link)
+		}
+		if err := x.clear(dest); err != nil {
+			return err
+		}
+		return os.Link(src, dest)
+	case e.mode&os.ModeSymlink != 0:
+		if !x.inside(path.Dir(rel), e.link) {
+			return fmt.Errorf("symlink %s -> %s points outside the package", rel, e.link)
+		}
+		if err := x.clear(dest); err != nil {
+			return err
+		}
+		if err := os.Symlink(e.link, dest); err != nil {
+			return err
+		}
+		x.links = append(x.links, rel)
+		x.own(dest, e)
+		return nil
+	case e.mode.IsRegular():
+		if err := x.clear(dest); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		x.own(dest, e)
+		if err := os.Chmod(dest, e.mode&modeBits); err != nil {
+			return err
+		}
+		return os.Chtimes(dest, e.mtime, e.mtime)
+	}
+	// devices, fifos and the like have no place in a package
+	return nil
+}
+
+// clear makes way for a file at dest, making its folder and taking out
+// whatever is there. It won't replace a folder.
+func (x *extractor) clear(dest string) error {
+	if info, err := os.Lstat(dest); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s is a folder", rootRelTo(x.root, dest))
+		}
+		if err := os.Remove(dest); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(filepath.Dir(dest), 0755)
+}
+
+// own gives a file the owner it has in the archive, when running as root.
+// It comes before the mode, as changing the owner drops setuid.
+func (x *extractor) own(dest string, e entry) {
+	if x.chown && e.owned {
+		os.Lchown(dest, e.uid, e.gid)
+	}
+}
+
+// finish checks the symlinks again, now that the tree is complete, and
+// gives the folders their modes and times, deepest first
+func (x *extractor) finish() error {
+	for _, rel := range x.links {
+		link, err := os.Readlink(filepath.Join(x.root, filepath.FromSlash(rel)))
+		if err != nil {
+			// replaced by a later entry
+			continue
+		}
+		if !x.inside(path.Dir(rel), link) {
+			return fmt.Errorf("symlink %s -> %s points outside the package", rel, link)
+		}
+	}
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		d := x.dirs[i]
+		if info, err := os.Lstat(d.path); err != nil || !info.IsDir() {
+			continue
+		}
+		x.own(d.path, d.e)
+		if err := os.Chmod(d.path, d.e.mode&modeBits); err != nil {
+			return err
+		}
+		os.Chtimes(d.path, d.e.mtime, d.e.mtime)
+	}
+	return nil
+}
+
+// tarFolder packs dir into a gzipped tar, in a folder named top, keeping
+// symlinks, modes and ownership
+func tarFolder(dir, top string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		h, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		h.Name = top
+		if rel != "." {
+			h.Name += "/" + filepath.ToSlash(rel)
+		}
+		if info.IsDir() {
+			h.Name += "/"
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	return buf.Bytes(), err
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/traefik/yaegi/interp"
+	"github.com/traefik/yaegi/stdlib"
+)
+
+// recipeName is the file that makes a package folder a recipe: the package
+// is built from source when it is installed. It has the keys of a PORRIDGE
+// file and these:
+//
+//	source = "https://example.com/hello-1.2.tar.gz" # or a file in the folder
+//	sha256 = "9f86d0..."                            # needed for a URL
+//	module = "example.com/hello@v1.2.0"             # instead of source
+//	main = "./cmd/hello"                            # the package to build
+//	build = ["make", "cp hello $DEST/bin/"]         # instead of go build
+//
+// A source may be any archive archive.go reads, or a single .go file. A
+// module is fetched with go mod download, which checks it against the Go
+// checksum database. The program is built with go build, or when there is
+// no go command, checked with yaegi and installed as source along with a
+// launcher that runs it through porridge run.
+const recipeName = "porridge-build"
+
+type recipe struct {
+	m      *manifest
+	source string
+	sha256 string
+	module string
+	main   string
+	build  []string
+}
+
+// parseRecipe reads a porridge-build file
+func parseRecipe(data []byte) (*recipe, error) {
+	r := &recipe{main: "."}
+	m, err := parseManifestFile(recipeName, data, func(key string, p *tomlParser) (bool, error) {
+		var err error
+		switch key {
+		case "source":
+			r.source, err = p.str()
+		case "sha256":
+			r.sha256, err = p.str()
+		case "module":
+			r.module, err = p.str()
+		case "main":
+			r.main, err = p.str()
+		case "build":
+			r.build, err = p.array()
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.m = m
+	switch {
+	case (r.source == "") == (r.module == ""):
+		return nil, fmt.Errorf("%s needs one of source and module", recipeName)
+	case r.module != "" && !strings.Contains(r.module, "@"):
+		return nil, fmt.Errorf("%s: module needs a version, as in %s@v1.0.0", recipeName, r.module)
+	case strings.Contains(r.source, "://") && r.sha256 == "":
+		return nil, fmt.Errorf("%s: a source URL needs its sha256", recipeName)
+	}
+	return r, nil
+}
+
+// buildPackage builds the recipe of a candidate and puts the result in
+// stage
+func buildPackage(c *candidate, stage string) error {
+	work, err := os.MkdirTemp(inRoot(stateDir), ".build-"+c.m.Name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+	dir := c.path
+	if c.source != "local" {
+		data, err := archiveData(c)
+		if err != nil {
+			return err
+		}
+		dir = filepath.Join(work, "recipe")
+		if err := extractArchive(c.source, data, c.path, dir, func(string) bool { return true }); err != nil {
+			return err
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, recipeName))
+	if err != nil {
+		return err
+	}
+	r, err := parseRecipe(data)
+	if err != nil {
+		return err
+	}
+	src := filepath.Join(work, "src")
+	if err := fetchRecipeSource(r, dir, src); err != nil {
+		return err
+	}
+	out := filepath.Join(work, "out")
+	if err := r.compile(src, out); err != nil {
+		return err
+	}
+	if err := copyTree(out, stage, r.m.installs); err != nil {
+		return err
+	}
+	return r.m.checkFiles(stage)
+}
+
+// fetchRecipeSource puts the source of a recipe in src, unpacked
+func fetchRecipeSource(r *recipe, dir, src string) error {
+	if r.module != "" {
+		return fetchModule(r.module, src)
+	}
+	name := filepath.Base(r.source)
+	var data []byte
+	var err error
+	if strings.Contains(r.source, "://") {
+		p := newProgress(name)
+		data, err = fetchCached(r.source, r.sha256, 0, p)
+		p.finish()
+		if err != nil {
+			return err
+		}
+	} else {
+		path := filepath.Join(dir, filepath.FromSlash(r.source))
+		if !filepath.IsLocal(filepath.FromSlash(r.source)) {
+			return fmt.Errorf("%s: source %s is outside the recipe", recipeName, r.source)
+		}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return copyTree(path, src, func(string) bool { return true })
+		}
+		if data, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	if r.sha256 != "" && !strings.EqualFold(sha256Hex(data), r.sha256) {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", r.source, sha256Hex(data), r.sha256)
+	}
+	if err := os.MkdirAll(src, 0755); err != nil {
+		return err
+	}
+	if strings.HasSuffix(name, ".go") {
+		return os.WriteFile(filepath.Join(src, name), data, 0644)
+	}
+	if err := extractArchive(name, data, "", src, func(string) bool { return true }); err != nil {
+		return fmt.Errorf("unpacking %s: %v", name, err)
+	}
+	return stripTopDir(src)
+}
+
+// fetchModule copies a Go module, downloaded by the go command, to src
+func fetchModule(module, src string) error {
+	if _, err := exec.LookPath("go"); err != nil {
+		return fmt.Errorf("fetching module %s needs the go command", module)
+	}
+	fmt.Printf("porridge: fetching %s\n", module)
+	var stdout bytes.Buffer
+	cmd := exec.Command("go", "mod", "download", "-json", module)
+	cmd.Stdout, cmd.Stderr = &stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("go mod download %s: %v", module, err)
+	}
+	var info struct{ Dir, Error string }
+	if err := json.Unmarshal(stdout.Bytes(), &info); err != nil {
+		return err
+	}
+	if info.Error != "" {
+		return errors.New(info.Error)
+	}
+	return copyTree(info.Dir, src, func(string) bool { return true })
+}
+
+// stripTopDir moves the contents of the one folder a tarball unpacked to,
+// as in hello-1.2/, up into src
+func stripTopDir(src string) error {
+	files, err := os.ReadDir(src)
+	if err != nil || len(files) != 1 || !files[0].IsDir() {
+		return err
+	}
+	top := filepath.Join(src, files[0].Name())
+	tmp := src + ".top"
+	if err := os.Rename(top, tmp); err != nil {
+		return err
+	}
+	if err := os.Remove(src); err != nil {
+		return err
+	}
+	return os.Rename(tmp, src)
+}
+
+// compile builds the program in src, putting what is to be installed in
+// out
+func (r *recipe) compile(src, out string) error {
+	if err := os.MkdirAll(filepath.Join(out, "bin"), 0755); err != nil {
+		return err
+	}
+	if len(r.build) > 0 {
+		fmt.Printf("porridge: building %s %s\n", r.m.Name, r.m.Version)
+		for _, step := range r.build {
+			cmd := exec.Command("sh", "-c", step)
+			cmd.Dir = src
+			cmd.Env = append(os.Environ(), "DEST="+out, "CGO_ENABLED=0")
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("build step %q: %v", step, err)
+			}
+		}
+		return nil
+	}
+	dir := filepath.Join(src, filepath.FromSlash(r.main))
+	if _, err := exec.LookPath("go"); err != nil {
+		return r.compileYaegi(dir, out)
+	}
+	fmt.Printf("porridge: building %s %s with go build\n", r.m.Name, r.m.Version)
+	args := []string{"build", "-trimpath", "-o", filepath.Join(out, "bin", r.m.Name)}
+	cmd := exec.Command("go")
+	if _, err := os.Stat(filepath.Join(src, "go.mod")); err == nil {
+		cmd.Dir = src
+		args = append(args, "./"+filepath.ToSlash(filepath.Clean(r.main)))
+	} else {
+		// no module: name the files, as go build only takes those
+		files, err := goFiles(dir)
+		if err != nil {
+			return err
+		}
+		cmd.Dir = dir
+		args = append(args, files...)
+	}
+	cmd.Args = append(cmd.Args, args...)
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("go build: %v", err)
+	}
+	return nil
+}
+
+// compileYaegi checks a one-file program with yaegi and installs it as
+// source, with a launcher in bin
+func (r *recipe) compileYaegi(dir, out string) error {
+	files, err := goFiles(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 {
+		return fmt.Errorf("no go command, and yaegi only builds programs of one file; %s has %d", r.main, len(files))
+	}
+	fmt.Printf("porridge: building %s %s with yaegi\n", r.m.Name, r.m.Version)
+	path := filepath.Join(dir, files[0])
+	i := interp.New(interp.Options{})
+	i.Use(stdlib.Symbols)
+	if _, err := i.CompilePath(path); err != nil {
+		return fmt.Errorf("yaegi: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lib := filepath.Join(out, "lib")
+	os.MkdirAll(lib, 0755)
+	if err := os.WriteFile(filepath.Join(lib, r.m.Name+".go"), data, 0644); err != nil {
+		return err
+	}
+	// the path the installed system will see the source at
+	prog := "/" + rootRel(filepath.Join(instDir, r.m.Name, "lib", r.m.Name+".go"))
+	launcher := fmt.Sprintf("#!/bin/sh\nexec porridge run %s \"$@\"\n", prog)
+	return os.WriteFile(filepath.Join(out, "bin", r.m.Name), []byte(launcher), 0755)
+}
+
+// goFiles lists the .go files of a package other than its tests
+func goFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".go") && !strings.HasSuffix(e.Name(), "_test.go") {
+			files = append(files, e.Name())
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .go files in %s", dir)
+	}
+	return files, nil
+}
+
+// runCommand runs a Go program from source with yaegi, as the launchers of
+// programs built without a go command do
+func runCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("porridge: run <file.go> [args]")
+		os.Exit(2)
+	}
+	i := interp.New(interp.Options{Args: args})
+	i.Use(stdlib.Symbols)
+	if _, err := i.EvalPath(args[0]); err != nil {
+		fmt.Fprintln(os.Stderr, "porridge: run:", err)
+		os.Exit(1)
+	}
+}
+
+// fetchGo fetches a one-file Go program and installs it, through a recipe
+// written to the repo so that it can be rebuilt and upgraded later
+func fetchGo(url string, force bool) {
+	name := strings.TrimSuffix(filepath.Base(url), ".go")
+	if !validName(name) {
+		fmt.Printf("porridge: bad package name '%s' from %s\n", name, url)
+		return
+	}
+	dir := filepath.Join(repoDir, name)
+	if _, err := os.Stat(dir); err == nil && !force {
+		fmt.Printf("porridge: '%s' is already in the repo (use --force to fetch it again)\n", name)
+		return
+	}
+	data, err := fetchSigned(url)
+	if err != nil {
+		fmt.Printf("porridge: failed to download '%s': %v\n", url, err)
+		return
+	}
+	m := &manifest{Name: name, Version: time.Now().UTC().Format("0.20060102.150405"), Description: "fetched from " + url}
+	rec := fmt.Sprintf("name = %q\nversion = %q\ndescription = %q\nsource = %q\nsha256 = %q\n",
+		m.Name, m.Version, m.Description, name+".go", sha256Hex(data))
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Printf("porridge: %v\n", err)
+		return
+	}
+	os.WriteFile(filepath.Join(dir, name+".go"), data, 0644)
+	os.WriteFile(filepath.Join(dir, recipeName), []byte(rec), 0644)
+	t := &transaction{Op: "install", Started: time.Now().UTC()}
+	t.Steps = append(t.Steps, newStep(&candidate{m: m, source: "local", path: dir, recipe: true}, true, readRecord(name)))
+	if err := t.run(); err != nil {
+		fmt.Printf("porridge: %v\n", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// configFile sets where porridge keeps things. Every key is optional:
+//
+//	root = "/"                  # the system packages are installed into
+//	dir = "/var/lib/porridge"   # state, inside the root
+//	bin = "/usr/bin"            # where binaries go, inside the root
+//	binaries = "symlink"        # or "copy"
+//	keys = "/etc/porridge/keys" # trusted keys, on this machine
+//
+// The state, the package database included, lives inside the root, so a
+// mounted rootfs carries its own. --root DIR overrides root.
+const configFile = "/etc/porridge.conf"
+
+var (
+	rootDir      = "/"
+	stateDir     = "/var/lib/porridge"
+	binDir       = "/usr/bin"
+	copyBinaries = false
+	keysDir      = "/etc/porridge/keys"
+
+	// set by setPaths, under the state dir
+	repoDir     string
+	instDir     string
+	sourcesFile string
+	cacheDir    string
+	dbDir       string
+)
+
+// loadConfig reads configFile, if there is one
+func loadConfig() error {
+	data, err := os.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if j := strings.IndexByte(line, '#'); j >= 0 {
+			line = line[:j]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if uq, err := strconv.Unquote(val); err == nil {
+			val = uq
+		}
+		if !ok || val == "" {
+			return fmt.Errorf("%s line %d: expected key = value", configFile, i+1)
+		}
+		switch key {
+		case "root":
+			rootDir = val
+		case "dir":
+			stateDir = val
+		case "bin":
+			binDir = val
+		case "binaries":
+			if val != "symlink" && val != "copy" {
+				return fmt.Errorf("%s line %d: binaries is symlink or copy", configFile, i+1)
+			}
+			copyBinaries = val == "copy"
+		case "keys":
+			keysDir = val
+		default:
+			return fmt.Errorf("%s line %d: unknown key %s", configFile, i+1, key)
+		}
+	}
+	return nil
+}
+
+// globalArgs takes --root DIR or --root=DIR out of the arguments,
+// returning the root given, if any, to be set once the config is read
+func globalArgs(args []string) ([]string, string, error) {
+	var out []string
+	root := ""
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "--root":
+			if i+1 == len(args) {
+				return nil, "", fmt.Errorf("--root needs a directory")
+			}
+			i++
+			root = args[i]
+		case strings.HasPrefix(a, "--root="):
+			root = strings.TrimPrefix(a, "--root=")
+		default:
+			out = append(out, a)
+		}
+	}
+	return out, root, nil
+}
+
+// setPaths works out the paths porridge uses once the root is known
+func setPaths() error {
+	abs, err := filepath.Abs(rootDir)
+	if err != nil {
+		return err
+	}
+	rootDir = abs
+	base := inRoot(stateDir)
+	repoDir = filepath.Join(base, "repo")
+	instDir = filepath.Join(base, "installed")
+	sourcesFile = filepath.Join(base, "sources.txt")
+	cacheDir = filepath.Join(base, "cache")
+	dbDir = filepath.Join(base, "db")
+	return nil
+}
+
+// oldLayout is what porridge kept in the current folder before it had a
+// state dir
+var oldLayout = []string{"porridge_installed", "porridge_db", "porridge_repo", "porridge_sources.txt", "porridge_cache"}
+
+// warnOldLayout says so when the current folder has state in the old
+// layout and the state dir has none, as the packages installed then are
+// unknown now. Nothing is moved, as their records don't say where their
+// files go under the root.
+func warnOldLayout() {
+	var found []string
+	for _, name := range oldLayout {
+		if _, err := os.Lstat(name); err == nil {
+			found = append(found, name)
+		}
+	}
+	if len(found) == 0 {
+		return
+	}
+	if _, err := os.Stat(sourcesFile); err == nil {
+		return
+	}
+	if records, _ := os.ReadDir(dbDir); len(records) > 0 {
+		return
+	}
+	fmt.Printf("porridge: found state in the old layout here (%s); it is now kept in %s\n",
+		strings.Join(found, ", "), inRoot(stateDir))
+	if slices.Contains(found, "porridge_sources.txt") {
+		fmt.Printf("porridge: move porridge_sources.txt to %s, ", sourcesFile)
+	} else {
+		fmt.Print("porridge: ")
+	}
+	fmt.Println("install the packages again, then delete the old state")
+}
+
+// inRoot returns where a path of the installed system is on this machine
+func inRoot(path string) string {
+	return filepath.Join(rootDir, path)
+}
+
+// rootRel returns a path on this machine as the installed system sees it,
+// without the leading slash
+func rootRel(path string) string {
+	rel, err := filepath.Rel(rootDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
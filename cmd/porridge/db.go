@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// record is what the database knows of an installed package, kept in
+// dbDir as NAME.json. File paths are as the installed system sees them,
+// without the leading slash, and listed parents first.
+type record struct {
+	Manifest  *manifest   `json:"manifest"`
+	Source    string      `json:"source"`
+	Installed time.Time   `json:"installed"`
+	Explicit  bool        `json:"explicit"`
+	Files     []fileEntry `json:"files"`
+}
+
+// fileEntry is one installed file, or a folder when Dir is set, or a
+// symlink to Link
+type fileEntry struct {
+	Path   string `json:"path"`
+	Dir    bool   `json:"dir,omitempty"`
+	Link   string `json:"link,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func recordPath(name string) string {
+	return filepath.Join(dbDir, name+".json")
+}
+
+// readRecord returns the record of an installed package, or nil if there
+// is none or the name isn't one a package can have
+func readRecord(name string) *record {
+	if !validName(name) {
+		return nil
+	}
+	data, err := os.ReadFile(recordPath(name))
+	if err != nil {
+		return nil
+	}
+	var r record
+	if err := json.Unmarshal(data, &r); err != nil || r.Manifest == nil {
+		fmt.Printf("porridge: bad record for '%s': %v\n", name, err)
+		return nil
+	}
+	return &r
+}
+
+// writeRecord saves a record, replacing the old one in a single rename
+func writeRecord(r *record) error {
+	data, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		return err
+	}
+	tmp := recordPath(r.Manifest.Name) + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, recordPath(r.Manifest.Name))
+}
+
+// allRecords returns the record of every installed package, by name
+func allRecords() map[string]*record {
+	out := map[string]*record{}
+	files, _ := os.ReadDir(dbDir)
+	for _, f := range files {
+		name, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if r := readRecord(name); r != nil {
+			out[name] = r
+		}
+	}
+	return out
+}
+
+// recordInstall walks what was just installed for a package, puts its
+// binaries in binDir and records it all along with the hash of every file
+func recordInstall(m *manifest, source string, explicit bool) error {
+	r := &record{Manifest: m, Source: source, Installed: time.Now().UTC().Truncate(time.Second), Explicit: explicit}
+	err := filepath.Walk(filepath.Join(instDir, m.Name), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		e := fileEntry{Path: rootRel(path), Dir: info.IsDir()}
+		if info.Mode()&os.ModeSymlink != 0 {
+			e.Link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		} else if !info.IsDir() {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			e.SHA256 = sha256Hex(data)
+		}
+		r.Files = append(r.Files, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bins, err := installBinaries(m.Name)
+	r.Files = append(r.Files, bins...)
+	if err != nil {
+		return err
+	}
+	return writeRecord(r)
+}
+
+// installBinaries symlinks or copies the files in the bin folder of a
+// package into binDir. A file there that porridge didn't put there is left
+// alone.
+func installBinaries(name string) ([]fileEntry, error) {
+	files, _ := os.ReadDir(filepath.Join(instDir, name, "bin"))
+	if len(files) == 0 {
+		return nil, nil
+	}
+	dir := inRoot(binDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var out []fileEntry
+	for _, f := range files {
+		if !f.Type().IsRegular() {
+			continue
+		}
+		src := filepath.Join(instDir, name, "bin", f.Name())
+		dest := filepath.Join(dir, f.Name())
+		if _, err := os.Lstat(dest); err == nil {
+			fmt.Printf("porridge: not replacing '%s'\n", "/"+rootRel(dest))
+			continue
+		}
+		e := fileEntry{Path: rootRel(dest)}
+		if copyBinaries {
+			data, err := os.ReadFile(src)
+			if err != nil {
+				return out, err
+			}
+			if err := os.WriteFile(dest, data, 0755); err != nil {
+				return out, err
+			}
+			e.SHA256 = sha256Hex(data)
+		} else {
+			// relative, so the link works from inside the root too
+			e.Link, _ = filepath.Rel(dir, src)
+			if err := os.Symlink(e.Link, dest); err != nil {
+				return out, err
+			}
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// removeInstalled deletes the files recorded for a package, leaving any
+// that were changed since, then the folders that are left empty. Of a
+// package installed before there was a database only a single file can be
+// removed, as there is no telling what else is its.
+func removeInstalled(name string) error {
+	if !validName(name) {
+		return fmt.Errorf("bad package name '%s'", name)
+	}
+	r := readRecord(name)
+	if r == nil {
+		path := filepath.Join(instDir, name)
+		if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("no record of what '%s' installed", name)
+		}
+		return os.Remove(path)
+	}
+	for i := len(r.Files) - 1; i >= 0; i-- {
+		e := r.Files[i]
+		path := inRoot(e.Path)
+		if e.Dir {
+			// only goes if nothing else is left in it
+			os.Remove(path)
+			continue
+		}
+		if e.Link != "" {
+			if target, err := os.Readlink(path); err == nil && target == e.Link {
+				os.Remove(path)
+			}
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if sha256Hex(data) != e.SHA256 {
+			fmt.Printf("porridge: keeping modified '/%s'\n", e.Path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return os.Remove(recordPath(name))
+}
+
+// changedFiles compares a package's files with its record, returning a line
+// for each one that is missing or modified
+func (r *record) changedFiles() []string {
+	var bad []string
+	for _, e := range r.Files {
+		path := inRoot(e.Path)
+		info, err := os.Lstat(path)
+		switch {
+		case err != nil:
+			bad = append(bad, "missing /"+e.Path)
+		case e.Dir != info.IsDir() || (e.Link != "") != (info.Mode()&os.ModeSymlink != 0):
+			bad = append(bad, "replaced /"+e.Path)
+		case e.Link != "":
+			if target, _ := os.Readlink(path); target != e.Link {
+				bad = append(bad, "modified /"+e.Path)
+			}
+		case !e.Dir:
+			data, err := os.ReadFile(path)
+			if err != nil || sha256Hex(data) != e.SHA256 {
+				bad = append(bad, "modified /"+e.Path)
+			}
+		}
+	}
+	return bad
+}
+
+// filesCommand lists the files a package installed
+func filesCommand(name string) {
+	if !validName(name) {
+		fmt.Printf("porridge: bad package name '%s'\n", name)
+		return
+	}
+	r := readRecord(name)
+	if r == nil {
+		fmt.Printf("porridge: package '%s' not installed\n", name)
+		return
+	}
+	for _, e := range r.Files {
+		if !e.Dir {
+			fmt.Println("/" + e.Path)
+		}
+	}
+}
+
+// ownsCommand finds the package that installed a file. The path may be
+// one on this machine under the root, or one as the installed system sees
+// it.
+func ownsCommand(path string) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Printf("porridge: %v\n", err)
+		return
+	}
+	rel := rootRel(abs)
+	if rel == "" {
+		rel = strings.TrimPrefix(filepath.ToSlash(abs), "/")
+	}
+	if rel != "" {
+		for name, r := range allRecords() {
+			for _, e := range r.Files {
+				if e.Path == rel {
+					fmt.Printf("%s is owned by %s %s\n", path, name, r.Manifest.Version)
+					return
+				}
+			}
+		}
+	}
+	fmt.Printf("porridge: no package owns '%s'\n", path)
+}
+
+// verifyCommand checks the files of the packages named, or of every
+// installed package, against the database
+func verifyCommand(names []string) {
+	recs := allRecords()
+	if len(names) == 0 {
+		for name := range recs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	bad := 0
+	for _, name := range names {
+		r, ok := recs[name]
+		if !ok {
+			fmt.Printf("porridge: package '%s' not installed\n", name)
+			bad++
+			continue
+		}
+		for _, line := range r.changedFiles() {
+			fmt.Printf("%s: %s\n", name, line)
+			bad++
+		}
+	}
+	if bad == 0 {
+		fmt.Println("porridge: all files intact")
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Archives are downloaded into the cache through a .part file beside their
+// place in it. A download that breaks off is retried, carrying on from the
+// end of the .part with a Range request, and so is one cut short by an
+// earlier run.
+const (
+	fetchWorkers  = 4
+	fetchAttempts = 5
+	stallTimeout  = 30 * time.Second
+	partSuffix    = ".part"
+)
+
+var httpClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	ResponseHeaderTimeout: stallTimeout,
+}}
+
+// fetchCached returns the file at url from the cache, downloading it if
+// the cached copy doesn't match sum. size is 0 if it isn't known.
+func fetchCached(url, sum string, size int64, p *progress) ([]byte, error) {
+	cached := filepath.Join(cacheDir, filepath.Base(url))
+	if data, err := os.ReadFile(cached); err == nil && strings.EqualFold(sha256Hex(data), sum) {
+		now := time.Now()
+		os.Chtimes(cached, now, now)
+		return data, nil
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := fetchTo(url, cached, size, p); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(cached)
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 && int64(len(data)) != size {
+		os.Remove(cached)
+		return nil, fmt.Errorf("%s is %d bytes, expected %d", url, len(data), size)
+	}
+	if got := sha256Hex(data); !strings.EqualFold(got, sum) {
+		os.Remove(cached)
+		return nil, fmt.Errorf("checksum mismatch for %s: got %s, want %s", url, got, sum)
+	}
+	return data, nil
+}
+
+// fetchTo downloads url into dest, resuming from dest.part
+func fetchTo(url, dest string, size int64, p *progress) error {
+	if p == nil {
+		fmt.Printf("porridge: fetching %s\n", url)
+	}
+	if path, ok := strings.CutPrefix(url, "file://"); ok {
+		data, err := os.ReadFile(filepath.FromSlash(path))
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(dest, data, 0644)
+	}
+	part := dest + partSuffix
+	if size > 0 {
+		p.expect(size)
+	}
+	if info, err := os.Stat(part); err == nil {
+		p.add(info.Size())
+	}
+	var err error
+	for attempt := 1; attempt <= fetchAttempts; attempt++ {
+		var retry bool
+		if retry, err = fetchPart(url, part, &size, p); err == nil {
+			return os.Rename(part, dest)
+		} else if !retry {
+			break
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	return err
+}
+
+// fetchPart adds what the server has past the end of part to it, learning
+// the size if it isn't known. It reports whether a failure is worth trying
+// again.
+func fetchPart(url, part string, size *int64, p *progress) (bool, error) {
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	off, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	if *size > 0 && off >= *size {
+		if off == *size {
+			return false, nil
+		}
+		// longer than it can be: start again
+		f.Truncate(0)
+		p.add(-off)
+		off, _ = f.Seek(0, io.SeekStart)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+	if off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if off > 0 {
+			// the server won't resume
+			f.Truncate(0)
+			p.add(-off)
+			off, _ = f.Seek(0, io.SeekStart)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the part is all there is; the checksum has the last word
+		return false, nil
+	default:
+		return resp.StatusCode >= 500, fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	}
+	if *size == 0 && resp.ContentLength > 0 {
+		*size = off + resp.ContentLength
+		p.expect(*size)
+	}
+	// a stalled connection is dropped, to be resumed on the next attempt
+	watchdog := time.AfterFunc(stallTimeout, cancel)
+	defer watchdog.Stop()
+	body := &stallReader{r: resp.Body, watchdog: watchdog}
+	if _, err := io.Copy(f, io.TeeReader(body, p)); err != nil {
+		return true, err
+	}
+	return false, f.Close()
+}
+
+// stallReader restarts its watchdog whenever data arrives
+type stallReader struct {
+	r        io.Reader
+	watchdog *time.Timer
+}
+
+func (s *stallReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if n > 0 {
+		s.watchdog.Reset(stallTimeout)
+	}
+	return n, err
+}
+
+// prefetch downloads the archives of several packages at once, a few at a
+// time. Failures are left for the install of each package to report.
+func prefetch(cs []*candidate) {
+	var todo []*candidate
+	for _, c := range cs {
+		if c.sum != "" {
+			todo = append(todo, c)
+		}
+	}
+	if len(todo) < 2 {
+		return
+	}
+	p := newProgress(fmt.Sprintf("%d packages", len(todo)))
+	jobs := make(chan *candidate)
+	var wg sync.WaitGroup
+	for i := 0; i < fetchWorkers && i < len(todo); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				fetchCached(c.source, c.sum, c.size, p)
+			}
+		}()
+	}
+	for _, c := range todo {
+		jobs <- c
+	}
+	close(jobs)
+	wg.Wait()
+	p.finish()
+}
+
+// progress draws a bar for downloads on the terminal. A nil progress, as
+// newProgress gives when output isn't a terminal, draws nothing.
+type progress struct {
+	mu          sync.Mutex
+	label       string
+	total, done int64
+	drawn       time.Time
+}
+
+func newProgress(label string) *progress {
+	if info, err := os.Stdout.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return &progress{label: label}
+}
+
+// expect adds n bytes to what is to come
+func (p *progress) expect(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.total += n
+	p.mu.Unlock()
+}
+
+// add counts n bytes as arrived, redrawing now and then
+func (p *progress) add(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	if time.Since(p.drawn) >= 100*time.Millisecond {
+		p.draw()
+	}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.add(int64(len(b)))
+	return len(b), nil
+}
+
+// finish draws the bar a last time and ends its line
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.drawn.IsZero() {
+		p.draw()
+		fmt.Println()
+	}
+}
+
+func (p *progress) draw() {
+	p.drawn = time.Now()
+	const width = 30
+	if p.total <= 0 {
+		fmt.Printf("\rporridge: %s %s   ", p.label, formatSize(p.done))
+		return
+	}
+	done := min(p.done, p.total)
+	n := int(done * width / p.total)
+	fmt.Printf("\rporridge: %s [%s%s] %3d%% %s/%s   ", p.label, strings.Repeat("=", n), strings.Repeat(" ", width-n),
+		done*100/p.total, formatSize(done), formatSize(p.total))
+}
+
+// formatSize gives a number of bytes in the largest unit it fills
+func formatSize(n int64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f, i := float64(n)/1024, 0
+	for ; f >= 1024 && i < len(units)-1; i++ {
+		f /= 1024
+	}
+	return fmt.Sprintf("%.1f %ciB", f, units[i])
+}
+
+// parseSize reads a size like 500M, 2GiB or 4096, in binary units
+func parseSize(s string) (int64, error) {
+	u := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	mult := int64(1)
+	if u != "" {
+		if i := strings.IndexByte("KMGT", u[len(u)-1]); i >= 0 {
+			mult = 1 << (10 * (i + 1))
+			u = u[:len(u)-1]
+		}
+	}
+	n, err := strconv.ParseInt(u, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * mult, nil
+}
+
+// parseAge reads a duration like 12h, or 30d for days
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("bad age %q", s)
+	}
+	return d, nil
+}
+
+// cleanCommand handles porridge clean [--older-than AGE] [--max-size SIZE]:
+// deleting the cached archives not used for AGE, then the least recently
+// used until the cache is under SIZE. With neither it deletes them all.
+// Source indexes are kept.
+func cleanCommand(args []string) {
+	var age time.Duration
+	maxSize := int64(-1)
+	for i := 0; i < len(args); i++ {
+		var err error
+		switch {
+		case args[i] == "--older-than" && i+1 < len(args):
+			i++
+			age, err = parseAge(args[i])
+		case args[i] == "--max-size" && i+1 < len(args):
+			i++
+			maxSize, err = parseSize(args[i])
+		default:
+			err = fmt.Errorf("clean [--older-than <age>] [--max-size <size>]")
+		}
+		if err != nil {
+			fmt.Printf("porridge: %v\n", err)
+			return
+		}
+	}
+	if age == 0 && maxSize < 0 {
+		maxSize = 0
+	}
+	entries, _ := os.ReadDir(cacheDir)
+	var files []os.FileInfo
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || strings.HasPrefix(name, "index-") || strings.HasSuffix(name, "."+indexName) {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			files = append(files, info)
+		}
+	}
+	// oldest first
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	var total, freed int64
+	for _, f := range files {
+		total += f.Size()
+	}
+	removed := 0
+	for _, f := range files {
+		if (age == 0 || time.Since(f.ModTime()) < age) && (maxSize < 0 || total <= maxSize) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(cacheDir, f.Name())); err != nil {
+			fmt.Printf("porridge: %v\n", err)
+			continue
+		}
+		total -= f.Size()
+		freed += f.Size()
+		removed++
+	}
+	fmt.Printf("porridge: removed %d cached files, freeing %s; %s left\n", removed, formatSize(freed), formatSize(total))
+}
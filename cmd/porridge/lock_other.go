@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile does nothing where there is no flock; the lock file is still
+// written, naming the process
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on f, saying so if it has to wait
+func lockFile(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+		return nil
+	}
+	fmt.Println("porridge: waiting for another porridge to finish")
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
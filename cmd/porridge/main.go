@@ -12,18 +12,13 @@ import (
 	"time"
 )
 
-const (
-	repoDir              = "porridge_repo"
-	instDir              = "porridge_installed"
-	sourcesFile          = "porridge_sources.txt"
-	installedSourcesFile = "porridge_installed_sources.txt"
-	downloadedGoDir      = "downloaded_go"
-	cacheDir             = "porridge_cache"
-)
-
-// downloadFile downloads a file from a URL and returns its contents or an error
+// downloadFile downloads a file from a URL and returns its contents or an
+// error. A file:// URL is read from disk.
 func downloadFile(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+	if path, ok := strings.CutPrefix(url, "file://"); ok {
+		return os.ReadFile(filepath.FromSlash(path))
+	}
+	resp, err := httpClient.Get(url)
 	if err != nil {
 		return nil, err
 	}
@@ -34,316 +29,350 @@ func downloadFile(url string) ([]byte, error) {
 	return io.ReadAll(resp.Body)
 }
 
-// getInstalledSource returns the source URL for a package, if any
-func getInstalledSource(pkg string) string {
-	data, err := os.ReadFile(installedSourcesFile)
-	if err != nil {
-		return ""
-	}
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		parts := strings.SplitN(line, " ", 2)
-		if len(parts) == 2 && parts[0] == pkg {
-			return parts[1]
+// copyTree copies the files under src that keep accepts to dest
+func copyTree(src, dest string, keep func(string) bool) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
-	}
-	return ""
+		rel, _ := filepath.Rel(src, path)
+		if rel == "." {
+			return os.MkdirAll(dest, 0755)
+		}
+		if !keep(filepath.ToSlash(rel)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		out := filepath.Join(dest, rel)
+		if info.IsDir() {
+			return os.MkdirAll(out, 0755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		os.MkdirAll(filepath.Dir(out), 0755)
+		return os.WriteFile(out, data, info.Mode().Perm())
+	})
 }
 
-// setInstalledSource records the source URL for a package
-func setInstalledSource(pkg, url string) {
-	data, _ := os.ReadFile(installedSourcesFile)
-	lines := strings.Split(string(data), "\n")
-	found := false
-	for i, line := range lines {
-		if strings.HasPrefix(line, pkg+" ") {
-			lines[i] = pkg + " " + url
-			found = true
+// readZipSources calls fn with each source zip, downloading it into the cache
+// the first time
+func readZipSources(fn func(src string, r *zip.Reader)) {
+	for _, src := range sourceList() {
+		if !isZipSource(src) {
+			continue
 		}
+		r, err := loadSource(src, false)
+		if err != nil {
+			fmt.Printf("porridge: skipping source %s: %v\n", src, err)
+			continue
+		}
+		fn(src, r)
 	}
-	if !found {
-		lines = append(lines, pkg+" "+url)
-	}
-	out := strings.Join(lines, "\n")
-	_ = os.WriteFile(installedSourcesFile, []byte(out), 0644)
 }
 
-// unzipFolderFromZip extracts a folder from a zip archive in memory to a destination directory
-func unzipFolderFromZip(zipData []byte, folder, dest string) error {
-	r, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+// sourceList returns the URLs in the sources file: zips, or repositories
+func sourceList() []string {
+	data, err := os.ReadFile(sourcesFile)
 	if err != nil {
-		return err
+		return nil
 	}
-	for _, f := range r.File {
-		if !strings.HasPrefix(f.Name, folder+"/") {
-			continue
-		}
-		relPath := strings.TrimPrefix(f.Name, folder+"/")
-		if relPath == "" {
-			continue
+	var out []string
+	for _, src := range strings.Split(string(data), "\n") {
+		if src = strings.TrimSpace(src); src != "" {
+			out = append(out, src)
 		}
-		// Prevent path traversal
-		if strings.Contains(relPath, "..") {
-			continue
-		}
-		outPath := filepath.Join(dest, relPath)
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(outPath, 0755)
-			continue
+	}
+	return out
+}
+
+// loadSource opens a source zip, checked against the source's index. The
+// index is fetched when there is none in the cache or refresh is set, and
+// the zip whenever the cached one doesn't match it.
+func loadSource(src string, refresh bool) (*zip.Reader, error) {
+	os.MkdirAll(cacheDir, 0755)
+	if _, err := os.Stat(cachedIndexPath(src)); err != nil || refresh {
+		if err := fetchIndex(src); err != nil {
+			return nil, err
 		}
-		os.MkdirAll(filepath.Dir(outPath), 0755)
-		inFile, err := f.Open()
+	}
+	cacheZip := filepath.Join(cacheDir, filepath.Base(src))
+	zipData, err := os.ReadFile(cacheZip)
+	if err != nil || verifyArchive(src, zipData) != nil {
+		p := newProgress(filepath.Base(src))
+		err = fetchTo(src, cacheZip, 0, p)
+		p.finish()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		outFile, err := os.Create(outPath)
-		if err != nil {
-			inFile.Close()
-			return err
+		if zipData, err = os.ReadFile(cacheZip); err != nil {
+			return nil, err
+		}
+		if err := verifyArchive(src, zipData); err != nil {
+			os.Remove(cacheZip)
+			return nil, err
 		}
-		io.Copy(outFile, inFile)
-		inFile.Close()
-		outFile.Close()
+	} else {
+		now := time.Now()
+		os.Chtimes(cacheZip, now, now)
 	}
-	return nil
+	return zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
 }
 
-// getZipPackages returns a map of package name to zip URL for all sources, and caches zips
-func getZipPackages() map[string]string {
-	pkgs := make(map[string]string)
-	os.MkdirAll(cacheDir, 0755)
-	data, err := os.ReadFile(sourcesFile)
-	if err != nil {
-		return pkgs
-	}
-	sources := strings.Split(string(data), "\n")
-	for _, src := range sources {
-		src = strings.TrimSpace(src)
-		if src == "" {
-			continue
+// installPackages installs packages from the repo and the zip sources along
+// with everything they depend on, dependencies first. Names may carry
+// version conditions, as in "hello >= 1.2".
+func installPackages(names []string) {
+	installed := installedManifests()
+	var want []string
+	for _, n := range names {
+		d, err := parseDep(n)
+		if err != nil {
+			fmt.Printf("porridge: %v\n", err)
+			return
 		}
-		cacheZip := filepath.Join(cacheDir, filepath.Base(src))
-		var zipData []byte
-		if _, err := os.Stat(cacheZip); err == nil {
-			zipData, _ = os.ReadFile(cacheZip)
-		} else {
-			zipData, err = downloadFile(src)
-			if err != nil {
-				continue
+		if m, ok := installed[d.name]; ok && d.allows(m.Version) {
+			if r := readRecord(d.name); r != nil && !r.Explicit {
+				r.Explicit = true
+				writeRecord(r)
 			}
-			os.WriteFile(cacheZip, zipData, 0644)
-		}
-		r, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
-		if err != nil {
+			fmt.Printf("porridge: package '%s' already installed\n", d.name)
 			continue
 		}
-		for _, f := range r.File {
-			if f.FileInfo().IsDir() && !strings.Contains(f.Name, "/") {
-				pkgName := strings.TrimSuffix(f.Name, "/")
-				pkgs[pkgName] = src
+		want = append(want, n)
+	}
+	if len(want) == 0 {
+		return
+	}
+	order, err := plan(loadCatalog(), installed, want)
+	if err != nil {
+		fmt.Printf("porridge: %v\n", err)
+		return
+	}
+	var names2 []string
+	t := &transaction{Op: "install", Started: time.Now().UTC()}
+	for _, c := range order {
+		names2 = append(names2, c.String())
+		explicit := false
+		for _, n := range want {
+			if d, _ := parseDep(n); satisfies(c.m, d) {
+				explicit = true
 			}
 		}
+		t.Steps = append(t.Steps, newStep(c, explicit, nil))
+	}
+	fmt.Printf("porridge: installing %s\n", strings.Join(names2, ", "))
+	if err := t.run(); err != nil {
+		fmt.Printf("porridge: %v\n", err)
+	}
+}
+
+// installURL installs a single file from a URL as a package named after it
+func installURL(url string) error {
+	parts := strings.Split(url, "/")
+	name := parts[len(parts)-1]
+	instPkg := filepath.Join(instDir, name)
+	if _, err := os.Stat(instPkg); err == nil {
+		return fmt.Errorf("package '%s' already installed", name)
+	}
+	data, err := fetchSigned(url)
+	if err != nil {
+		return fmt.Errorf("failed to download '%s': %v", url, err)
+	}
+	if err := writeFileAtomic(instPkg, data, 0644); err != nil {
+		return err
+	}
+	if err := recordInstall(bareManifest(name), url, true); err != nil {
+		return err
+	}
+	fmt.Printf("porridge: installed '%s' from url\n", name)
+	return nil
+}
+
+// writeFileAtomic writes a file through a temporary one beside it, so it is
+// never seen half written
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
 	}
-	return pkgs
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
 }
 
 // porridge: minimal functional Portage-like package manager
 func main() {
-	os.MkdirAll(repoDir, 0755)
-	os.MkdirAll(instDir, 0755)
-	os.MkdirAll(downloadedGoDir, 0755)
+	args, root, err := globalArgs(os.Args[1:])
+	if err == nil && len(args) > 0 && args[0] == "run" {
+		runCommand(args[1:])
+		return
+	}
+	if err == nil {
+		err = loadConfig()
+	}
+	if root != "" {
+		rootDir = root
+	}
+	if err == nil {
+		err = setPaths()
+	}
+	for _, dir := range []string{repoDir, instDir} {
+		if err == nil {
+			err = os.MkdirAll(dir, 0755)
+		}
+	}
+	if err != nil {
+		fmt.Printf("porridge: %v\n", err)
+		os.Exit(1)
+	}
+	warnOldLayout()
+	os.Args = append(os.Args[:1], args...)
+	if len(os.Args) > 1 {
+		// these only read the state
+		readOnly := false
+		switch os.Args[1] {
+		case "files", "owns", "verify":
+			readOnly = true
+		case "key", "repo":
+			readOnly = len(os.Args) == 3 && os.Args[2] == "list"
+		}
+		if !readOnly {
+			unlock, err := lockState()
+			if err != nil {
+				fmt.Printf("porridge: %v\n", err)
+				os.Exit(1)
+			}
+			defer unlock()
+			if t, err := pendingTransaction(); err != nil || (t != nil && os.Args[1] != "recover") {
+				if err == nil {
+					err = fmt.Errorf("an interrupted %s needs 'porridge recover' first", t.Op)
+				}
+				fmt.Printf("porridge: %v\n", err)
+				return
+			}
+		}
+	}
 
 	if len(os.Args) < 2 {
 		fmt.Println("porridge: a Portage-like package manager")
-		fmt.Println("Usage: porridge <command> [args]")
-		fmt.Println("Commands: install, remove, search, sync, update, upgrade, fetchgo")
+		fmt.Println("Usage: porridge [--root DIR] <command> [args]")
+		fmt.Println("Commands: install, remove, search, sync, update, upgrade, fetchgo, run, files, owns, verify, key, repo, clean, recover")
 		os.Exit(0)
 	}
 	cmd := os.Args[1]
 	switch cmd {
 	case "install":
 		if len(os.Args) < 3 {
-			fmt.Println("porridge: install <package|url>")
+			fmt.Println("porridge: install <package|url>...")
 			return
 		}
 		pkg := os.Args[2]
-		if strings.HasPrefix(pkg, "http://") || strings.HasPrefix(pkg, "https://") {
-			// Install from URL
-			parts := strings.Split(pkg, "/")
-			name := parts[len(parts)-1]
-			instPkg := filepath.Join(instDir, name)
-			if _, err := os.Stat(instPkg); err == nil {
-				fmt.Printf("porridge: package '%s' already installed\n", name)
-				return
-			}
-			data, err := downloadFile(pkg)
-			if err != nil {
-				fmt.Printf("porridge: failed to download '%s': %v\n", pkg, err)
-				return
+		if strings.HasPrefix(pkg, "http://") || strings.HasPrefix(pkg, "https://") || strings.HasPrefix(pkg, "file://") {
+			if err := installURL(pkg); err != nil {
+				fmt.Printf("porridge: %v\n", err)
 			}
-			os.WriteFile(instPkg, data, 0644)
-			setInstalledSource(name, pkg)
-			fmt.Printf("porridge: installed '%s' from url\n", name)
 			return
 		}
-		repoPkg := filepath.Join(repoDir, pkg)
-		if _, err := os.Stat(repoPkg); err != nil {
-			// Try zip sources
-			zipPkgs := getZipPackages()
-			if url, ok := zipPkgs[pkg]; ok {
-				cacheZip := filepath.Join(cacheDir, filepath.Base(url))
-				zipData, err := os.ReadFile(cacheZip)
-				if err != nil {
-					fmt.Printf("porridge: failed to read cached zip for '%s': %v\n", pkg, err)
-					return
-				}
-				instPkgDir := filepath.Join(instDir, pkg)
-				if _, err := os.Stat(instPkgDir); err == nil {
-					fmt.Printf("porridge: package '%s' already installed\n", pkg)
-					return
-				}
-				os.MkdirAll(instPkgDir, 0755)
-				err = unzipFolderFromZip(zipData, pkg, instPkgDir)
-				if err != nil {
-					fmt.Printf("porridge: failed to extract '%s' from zip: %v\n", pkg, err)
-					return
-				}
-				setInstalledSource(pkg, url)
-				fmt.Printf("porridge: installed '%s' from zip source\n", pkg)
-				return
-			}
-			fmt.Printf("porridge: package '%s' not found in repo or zip sources\n", pkg)
-			return
-		}
-		instPkg := filepath.Join(instDir, pkg)
-		if _, err := os.Stat(instPkg); err == nil {
-			fmt.Printf("porridge: package '%s' already installed\n", pkg)
-			return
-		}
-		data, _ := os.ReadFile(repoPkg)
-		os.WriteFile(instPkg, data, 0644)
-		setInstalledSource(pkg, "local")
-		fmt.Printf("porridge: installed '%s'\n", pkg)
+		installPackages(os.Args[2:])
 	case "upgrade":
-		if len(os.Args) < 3 {
-			fmt.Println("porridge: upgrade <package>")
-			return
-		}
-		pkg := os.Args[2]
-		instPkg := filepath.Join(instDir, pkg)
-		if _, err := os.Stat(instPkg); err != nil {
-			fmt.Printf("porridge: package '%s' not installed\n", pkg)
-			return
-		}
-		src := getInstalledSource(pkg)
-		if src == "" || src == "local" {
-			fmt.Printf("porridge: no remote source for '%s'\n", pkg)
-			return
-		}
-		data, err := downloadFile(src)
-		if err != nil {
-			fmt.Printf("porridge: failed to download '%s': %v\n", src, err)
-			return
-		}
-		os.WriteFile(instPkg, data, 0644)
-		fmt.Printf("porridge: upgraded '%s'\n", pkg)
+		upgradeCommand(os.Args[2:])
 	case "remove":
 		if len(os.Args) < 3 {
 			fmt.Println("porridge: remove <package>")
 			return
 		}
 		pkg := os.Args[2]
+		if !validName(pkg) {
+			fmt.Printf("porridge: bad package name '%s'\n", pkg)
+			return
+		}
 		instPkg := filepath.Join(instDir, pkg)
 		if _, err := os.Stat(instPkg); err != nil {
 			fmt.Printf("porridge: package '%s' not installed\n", pkg)
 			return
 		}
-		os.RemoveAll(instPkg)
-		fmt.Printf("porridge: removed '%s'\n", pkg)
-		// Remove from installed sources
-		data, _ := os.ReadFile(installedSourcesFile)
-		lines := strings.Split(string(data), "\n")
-		newLines := []string{}
-		for _, line := range lines {
-			if !strings.HasPrefix(line, pkg+" ") {
-				newLines = append(newLines, line)
-			}
+		if err := removeInstalled(pkg); err != nil {
+			fmt.Printf("porridge: failed to remove '%s': %v\n", pkg, err)
+			return
 		}
-		_ = os.WriteFile(installedSourcesFile, []byte(strings.Join(newLines, "\n")), 0644)
+		fmt.Printf("porridge: removed '%s'\n", pkg)
 	case "search":
 		if len(os.Args) < 3 {
 			fmt.Println("porridge: search <query>")
 			return
 		}
 		query := strings.ToLower(os.Args[2])
-		files, _ := os.ReadDir(repoDir)
-		found := false
-		for _, f := range files {
-			if strings.Contains(strings.ToLower(f.Name()), query) {
-				fmt.Println(f.Name())
-				found = true
+		seen := map[string]bool{}
+		for _, c := range loadCatalog().pkgs {
+			if !strings.Contains(strings.ToLower(c.m.Name), query) || seen[c.String()] {
+				continue
 			}
-		}
-		// Search zip sources
-		zipPkgs := getZipPackages()
-		for name := range zipPkgs {
-			if strings.Contains(strings.ToLower(name), query) {
-				fmt.Println(name)
-				found = true
+			seen[c.String()] = true
+			if c.m.Description != "" {
+				fmt.Printf("%s - %s\n", c, c.m.Description)
+			} else {
+				fmt.Println(c)
 			}
 		}
-		if !found {
+		if len(seen) == 0 {
 			fmt.Println("porridge: no packages found")
 		}
 	case "sync":
-		// Sync packages from sources
-		zipPkgs := getZipPackages()
-		for name, url := range zipPkgs {
-			f := filepath.Join(repoDir, name)
-			os.WriteFile(f, []byte("source: "+url+"\npackage: "+name+"\n"), 0644)
-			fmt.Printf("porridge: synced '%s' from %s\n", name, url)
-		}
-		fmt.Println("porridge: repo synced")
+		syncSources()
 	case "update":
-		files, _ := os.ReadDir(instDir)
-		for _, f := range files {
-			os.Chtimes(filepath.Join(instDir, f.Name()), time.Now(), time.Now())
-			fmt.Printf("porridge: updated '%s'\n", f.Name())
-		}
+		updateCommand()
 	case "fetchgo":
-		if len(os.Args) < 3 {
+		args := os.Args[2:]
+		force := len(args) > 0 && args[0] == "--force"
+		if force {
+			args = args[1:]
+		}
+		if len(args) != 1 {
 			fmt.Println("porridge: fetchgo [--force] <url>")
 			return
 		}
-		force := false
-		urlIdx := 2
-		if os.Args[2] == "--force" {
-			force = true
-			if len(os.Args) < 4 {
-				fmt.Println("porridge: fetchgo [--force] <url>")
-				return
-			}
-			urlIdx = 3
-		}
-		url := os.Args[urlIdx]
-		if !strings.HasSuffix(url, ".go") {
+		if !strings.HasSuffix(args[0], ".go") {
 			fmt.Println("porridge: only .go files can be fetched with fetchgo")
 			return
 		}
-		parts := strings.Split(url, "/")
-		name := parts[len(parts)-1]
-		outPath := filepath.Join(downloadedGoDir, name)
-		if _, err := os.Stat(outPath); err == nil && !force {
-			fmt.Printf("porridge: file '%s' already exists in downloaded_go (use --force to overwrite)\n", name)
+		fetchGo(args[0], force)
+	case "files":
+		if len(os.Args) < 3 {
+			fmt.Println("porridge: files <package>")
 			return
 		}
-		data, err := downloadFile(url)
-		if err != nil {
-			fmt.Printf("porridge: failed to download '%s': %v\n", url, err)
+		filesCommand(os.Args[2])
+	case "owns":
+		if len(os.Args) < 3 {
+			fmt.Println("porridge: owns <path>")
 			return
 		}
-		os.WriteFile(outPath, data, 0644)
-		fmt.Printf("porridge: downloaded '%s' to downloaded_go/\n", name)
+		ownsCommand(os.Args[2])
+	case "verify":
+		verifyCommand(os.Args[2:])
+	case "recover":
+		recoverCommand(os.Args[2:])
+	case "key":
+		keyCommand(os.Args[2:])
+	case "repo":
+		repoCommand(os.Args[2:])
+	case "clean":
+		cleanCommand(os.Args[2:])
 	default:
 		fmt.Printf("porridge: unknown command '%s'\n", cmd)
 	}
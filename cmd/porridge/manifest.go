@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// manifestName is the file describing a package, at the top of its folder.
+// It is written in a small subset of TOML: comments, and keys set to a
+// quoted string or an array of them.
+//
+//	name = "hello"
+//	version = "1.2.0"
+//	description = "says hello"
+//	depends = ["libgreet >= 1.0, < 2", "sh"]
+//	conflicts = ["hello-classic"]
+//	provides = ["greeter"]
+//	files = ["bin/hello", "share/hello/README"]
+const manifestName = "PORRIDGE"
+
+// manifest is a package's metadata. Files are the paths (relative to the
+// package folder) it installs; when none are listed it installs everything.
+type manifest struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	Description string   `json:"description,omitempty"`
+	Depends     []string `json:"depends,omitempty"`
+	Conflicts   []string `json:"conflicts,omitempty"`
+	Provides    []string `json:"provides,omitempty"`
+	Files       []string `json:"files,omitempty"`
+}
+
+// bareManifest describes a package that came without a manifest
+func bareManifest(name string) *manifest {
+	return &manifest{Name: name, Version: "0"}
+}
+
+// parseManifest reads a PORRIDGE file
+func parseManifest(data []byte) (*manifest, error) {
+	return parseManifestFile(manifestName, data, nil)
+}
+
+// parseManifestFile reads a file written like a PORRIDGE file, handing the
+// keys a manifest doesn't have to extra, which reports whether it knows them
+func parseManifestFile(file string, data []byte, extra func(key string, p *tomlParser) (bool, error)) (*manifest, error) {
+	m := &manifest{}
+	p := &tomlParser{file: file, s: string(data), line: 1}
+	for {
+		p.skipSpace(true)
+		if p.done() {
+			break
+		}
+		key := p.key()
+		if key == "" {
+			return nil, p.errorf("expected a key")
+		}
+		p.skipSpace(false)
+		if !p.eat('=') {
+			return nil, p.errorf("expected = after %s", key)
+		}
+		p.skipSpace(false)
+		var err error
+		switch key {
+		case "name":
+			m.Name, err = p.str()
+		case "version":
+			m.Version, err = p.str()
+		case "description":
+			m.Description, err = p.str()
+		case "depends":
+			m.Depends, err = p.array()
+		case "conflicts":
+			m.Conflicts, err = p.array()
+		case "provides":
+			m.Provides, err = p.array()
+		case "files":
+			m.Files, err = p.array()
+		default:
+			known := false
+			if extra != nil {
+				known, err = extra(key, p)
+			}
+			if err == nil && !known {
+				return nil, p.errorf("unknown key %s", key)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace(false)
+		if !p.done() && !p.eat('\n') {
+			return nil, p.errorf("unexpected text after %s", key)
+		}
+		p.line++
+	}
+	if m.Name == "" || m.Version == "" {
+		return nil, fmt.Errorf("%s needs a name and a version", file)
+	}
+	if !validName(m.Name) {
+		return nil, fmt.Errorf("%s: bad package name '%s'", file, m.Name)
+	}
+	for _, d := range append(append([]string{}, m.Depends...), m.Conflicts...) {
+		if _, err := parseDep(d); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// validName reports whether a package name is fit to be a file name in
+// the installed folder and the database: one path element, not hidden.
+func validName(name string) bool {
+	return name != "" && name[0] != '.' && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// tomlParser walks the text of a manifest
+type tomlParser struct {
+	file string
+	s    string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) done() bool { return p.pos >= len(p.s) }
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s line %d: %s", p.file, p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) eat(c byte) bool {
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// skipSpace skips blanks and comments, and newlines too if lines is set
+func (p *tomlParser) skipSpace(lines bool) {
+	for p.pos < len(p.s) {
+		switch c := p.s[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.s) && p.s[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == '\n' && lines:
+			p.pos++
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) key() string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := rune(p.s[p.pos])
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' && c != '-' {
+			break
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// str reads a "basic" or 'literal' string
+func (p *tomlParser) str() (string, error) {
+	if p.eat('\'') {
+		end := strings.IndexAny(p.s[p.pos:], "'\n")
+		if end < 0 || p.s[p.pos+end] != '\'' {
+			return "", p.errorf("unterminated string")
+		}
+		v := p.s[p.pos : p.pos+end]
+		p.pos += end + 1
+		return v, nil
+	}
+	if !p.eat('"') {
+		return "", p.errorf("expected a quoted string")
+	}
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\n':
+			return "", p.errorf("unterminated string")
+		case '\\':
+			if p.done() {
+				return "", p.errorf("unterminated string")
+			}
+			e := p.s[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\':
+				b.WriteByte(e)
+			default:
+				return "", p.errorf("unknown escape \\%c", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// array reads [ "a", "b", ], which may run over several lines
+func (p *tomlParser) array() ([]string, error) {
+	if !p.eat('[') {
+		return nil, p.errorf("expected an array")
+	}
+	var out []string
+	for {
+		p.skipSpace(true)
+		if p.eat(']') {
+			return out, nil
+		}
+		v, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+		p.skipSpace(true)
+		if p.eat(']') {
+			return out, nil
+		}
+		if !p.eat(',') {
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+// dependency is one entry of depends or conflicts: a package name and the
+// versions of it that are meant, such as "libgreet >= 1.0, < 2"
+type dependency struct {
+	name  string
+	conds []versionCond
+}
+
+type versionCond struct {
+	op      string
+	version string
+}
+
+func (d dependency) String() string {
+	s := d.name
+	for i, c := range d.conds {
+		if i > 0 {
+			s += ","
+		}
+		s += " " + c.op + " " + c.version
+	}
+	return s
+}
+
+var versionOps = []string{">=", "<=", "==", "!=", ">", "<", "="}
+
+// parseDep reads a dependency
+func parseDep(s string) (dependency, error) {
+	s = strings.TrimSpace(s)
+	end := strings.IndexAny(s, "<>=! \t")
+	if end < 0 {
+		end = len(s)
+	}
+	d := dependency{name: s[:end]}
+	if d.name == "" {
+		return d, fmt.Errorf("bad dependency %q", s)
+	}
+	rest := strings.TrimSpace(s[end:])
+	if rest == "" {
+		return d, nil
+	}
+	for _, part := range strings.Split(rest, ",") {
+		part = strings.TrimSpace(part)
+		op := ""
+		for _, o := range versionOps {
+			if strings.HasPrefix(part, o) {
+				op = o
+				break
+			}
+		}
+		v := strings.TrimSpace(strings.TrimPrefix(part, op))
+		if op == "" || v == "" || strings.ContainsAny(v, " \t") {
+			return d, fmt.Errorf("bad version constraint %q in %q", part, s)
+		}
+		if op == "==" {
+			op = "="
+		}
+		d.conds = append(d.conds, versionCond{op, v})
+	}
+	return d, nil
+}
+
+// allows reports whether version meets every condition of d
+func (d dependency) allows(version string) bool {
+	for _, c := range d.conds {
+		n := compareVersions(version, c.version)
+		ok := false
+		switch c.op {
+		case "=":
+			ok = n == 0
+		case "!=":
+			ok = n != 0
+		case ">":
+			ok = n > 0
+		case ">=":
+			ok = n >= 0
+		case "<":
+			ok = n < 0
+		case "<=":
+			ok = n <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// installs reports whether the file or folder rel of the package is one
+// it installs. The manifest itself never is.
+func (m *manifest) installs(rel string) bool {
+	if rel == manifestName {
+		return false
+	}
+	if len(m.Files) == 0 {
+		return true
+	}
+	for _, f := range m.Files {
+		f = strings.Trim(f, "/")
+		// folders leading to a listed file are needed as well
+		if rel == f || strings.HasPrefix(rel, f+"/") || strings.HasPrefix(f, rel+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFiles makes sure every file the manifest lists was installed in dir
+func (m *manifest) checkFiles(dir string) error {
+	for _, f := range m.Files {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			return fmt.Errorf("%s lists %s, which the package doesn't have", manifestName, f)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A repository is a folder with an index.json, as porridge repo build
+// writes it, and the archives it lists:
+//
+//	index.json
+//	index.json.sig
+//	packages/hello-1.2.porridge
+//
+// Each archive holds one package in a folder named after it, in any of the
+// formats in archive.go. The index
+// lists every package with its manifest and the URL, size and SHA-256 of
+// its archive, which may be relative to the index, so a repository can be
+// served by hserve -dir, or read straight from disk as a file:// source.
+// Only the index is fetched to see what a repository offers; an archive is
+// downloaded when its package is installed.
+//
+// A source that is a URL of a .zip is the older kind, holding every
+// package in one archive with an index.json beside it giving only the
+// checksum of the zip under "archives".
+type repoIndex struct {
+	Archives map[string]archiveInfo `json:"archives,omitempty"`
+	Packages []indexEntry           `json:"packages,omitempty"`
+}
+
+type archiveInfo struct {
+	SHA256 string `json:"sha256"`
+}
+
+// indexEntry is one package of a repository
+type indexEntry struct {
+	manifest
+	Recipe  bool   `json:"recipe,omitempty"`
+	Archive string `json:"archive"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+}
+
+// isZipSource reports whether a source is a single zip rather than a
+// repository
+func isZipSource(src string) bool {
+	return strings.HasSuffix(src, ".zip")
+}
+
+// repoIndexURL is where the index of a repository is
+func repoIndexURL(src string) string {
+	if strings.HasSuffix(src, "/"+indexName) {
+		return src
+	}
+	return strings.TrimSuffix(src, "/") + "/" + indexName
+}
+
+// cachedRepoIndex is where the index of a repository is kept in the cache
+func cachedRepoIndex(src string) string {
+	return filepath.Join(cacheDir, "index-"+sha256Hex([]byte(repoIndexURL(src)))[:16]+".json")
+}
+
+// loadRepo returns the packages a repository offers, fetching its index
+// when the cache has none or refresh is set
+func loadRepo(src string, refresh bool) ([]*candidate, error) {
+	cached := cachedRepoIndex(src)
+	data, err := os.ReadFile(cached)
+	if err != nil || refresh {
+		if data, err = fetchSigned(repoIndexURL(src)); err != nil {
+			return nil, err
+		}
+		os.MkdirAll(cacheDir, 0755)
+		if err := os.WriteFile(cached, data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	var idx repoIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("%s: %v", repoIndexURL(src), err)
+	}
+	base, err := url.Parse(repoIndexURL(src))
+	if err != nil {
+		return nil, err
+	}
+	var out []*candidate
+	for i := range idx.Packages {
+		e := &idx.Packages[i]
+		if e.Name == "" || e.Version == "" || e.SHA256 == "" {
+			return nil, fmt.Errorf("%s: a package lacks a name, version or sha256", repoIndexURL(src))
+		}
+		if !validName(e.Name) {
+			return nil, fmt.Errorf("%s: bad package name '%s'", repoIndexURL(src), e.Name)
+		}
+		ref, err := url.Parse(e.Archive)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", repoIndexURL(src), err)
+		}
+		out = append(out, &candidate{m: &e.manifest, source: base.ResolveReference(ref).String(), path: e.Name,
+			recipe: e.Recipe, sum: e.SHA256, size: e.Size})
+	}
+	return out, nil
+}
+
+// archiveData returns the checked archive a candidate from a source comes in,
+// downloading it if the cache doesn't have it
+func archiveData(c *candidate) ([]byte, error) {
+	if c.sum == "" {
+		// all of a zip source, checked against the index beside it
+		data, err := os.ReadFile(filepath.Join(cacheDir, filepath.Base(c.source)))
+		if err != nil {
+			return nil, err
+		}
+		return data, verifyArchive(c.source, data)
+	}
+	p := newProgress(c.String())
+	defer p.finish()
+	return fetchCached(c.source, c.sum, c.size, p)
+}
+
+// repoCommand handles porridge repo list, repo add SOURCE, repo remove
+// SOURCE and repo build DIR [--key KEYFILE]
+func repoCommand(args []string) {
+	usage := "porridge: repo list | add <source> | remove <source> | build <dir> [--key <keyfile>]"
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		for _, src := range sourceList() {
+			fmt.Println(src)
+		}
+		return
+	case len(args) == 2 && (args[0] == "add" || args[0] == "remove"):
+		editSources(args[0] == "add", args[1])
+		return
+	case len(args) < 2 || args[0] != "build" || (len(args) != 2 && (len(args) != 4 || args[2] != "--key")):
+		fmt.Println(usage)
+		return
+	}
+	dir := args[1]
+	if err := buildRepo(dir); err != nil {
+		fmt.Printf("porridge: %v\n", err)
+		return
+	}
+	fmt.Printf("porridge: wrote %s\n", filepath.Join(dir, indexName))
+	if len(args) == 4 {
+		if err := signFile(args[3], filepath.Join(dir, indexName)); err != nil {
+			fmt.Printf("porridge: %v\n", err)
+			return
+		}
+		fmt.Printf("porridge: signed %s\n", filepath.Join(dir, indexName))
+	}
+}
+
+// editSources adds a source to sourcesFile, or removes one from it
+func editSources(add bool, src string) {
+	var out []string
+	found := false
+	for _, s := range sourceList() {
+		if s == src {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		out = append(out, s)
+	}
+	switch {
+	case add && found:
+		fmt.Printf("porridge: '%s' is already a source\n", src)
+		return
+	case !add && !found:
+		fmt.Printf("porridge: '%s' is not a source\n", src)
+		return
+	case add:
+		out = append(out, src)
+	}
+	data := strings.Join(out, "\n")
+	if len(out) > 0 {
+		data += "\n"
+	}
+	if err := writeFileAtomic(sourcesFile, []byte(data), 0644); err != nil {
+		fmt.Printf("porridge: %v\n", err)
+		return
+	}
+	if add {
+		fmt.Printf("porridge: added source '%s'; run 'porridge sync' to fetch it\n", src)
+	} else {
+		fmt.Printf("porridge: removed source '%s'\n", src)
+	}
+}
+
+// buildRepo packs each package folder in dir into packages/ and writes
+// the index of them all
+func buildRepo(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	pkgDir := filepath.Join(dir, "packages")
+	if err := os.MkdirAll(pkgDir, 0755); err != nil {
+		return err
+	}
+	idx := repoIndex{}
+	for _, f := range entries {
+		if !f.IsDir() || f.Name() == "packages" || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		e := indexEntry{}
+		if data, err := os.ReadFile(filepath.Join(path, recipeName)); err == nil {
+			r, err := parseRecipe(data)
+			if err != nil {
+				return fmt.Errorf("%s: %v", f.Name(), err)
+			}
+			e.manifest, e.Recipe = *r.m, true
+		} else if data, err := os.ReadFile(filepath.Join(path, manifestName)); err == nil {
+			m, err := parseManifest(data)
+			if err != nil {
+				return fmt.Errorf("%s: %v", f.Name(), err)
+			}
+			e.manifest = *m
+		} else {
+			fmt.Printf("porridge: skipping '%s', which has no %s or %s\n", f.Name(), manifestName, recipeName)
+			continue
+		}
+		e.Archive = "packages/" + e.Name + "-" + e.Version + porridgeSuffix
+		data, err := tarFolder(path, e.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Name(), err)
+		}
+		if err := writeFileAtomic(filepath.Join(dir, filepath.FromSlash(e.Archive)), data, 0644); err != nil {
+			return err
+		}
+		e.Size, e.SHA256 = int64(len(data)), sha256Hex(data)
+		idx.Packages = append(idx.Packages, e)
+		fmt.Printf("porridge: packed %s-%s (%d bytes)\n", e.Name, e.Version, e.Size)
+	}
+	sort.Slice(idx.Packages, func(i, j int) bool {
+		a, b := idx.Packages[i], idx.Packages[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return compareVersions(a.Version, b.Version) < 0
+	})
+	data, err := json.MarshalIndent(idx, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, indexName), append(data, '\n'), 0644)
+}
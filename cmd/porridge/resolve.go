@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// candidate is a package on offer and where it comes from
+type candidate struct {
+	m      *manifest
+	source string // "local" for the repo, else the URL of a zip source or archive
+	path   string // the file or folder in the repo, or the folder in the zip
+	recipe bool   // built from source when installed
+	sum    string // the SHA-256 of an archive from a repository
+	size   int64
+}
+
+func (c *candidate) String() string {
+	return c.m.Name + "-" + c.m.Version
+}
+
+// catalog is every package the repo and the sources offer, by name
+type catalog struct {
+	pkgs []*candidate
+}
+
+// loadCatalog reads the manifests of everything in the repo, the zip
+// sources and the indexes of repositories. Packages without one get a bare
+// manifest with version 0.
+func loadCatalog() *catalog {
+	c := &catalog{}
+	files, _ := os.ReadDir(repoDir)
+	for _, f := range files {
+		path := filepath.Join(repoDir, f.Name())
+		m := bareManifest(f.Name())
+		recipe := false
+		if f.IsDir() {
+			if data, err := os.ReadFile(filepath.Join(path, recipeName)); err == nil {
+				r, err := parseRecipe(data)
+				if err != nil {
+					fmt.Printf("porridge: skipping '%s': %v\n", f.Name(), err)
+					continue
+				}
+				m, recipe = r.m, true
+			} else if data, err := os.ReadFile(filepath.Join(path, manifestName)); err == nil {
+				pm, err := parseManifest(data)
+				if err != nil {
+					fmt.Printf("porridge: skipping '%s': %v\n", f.Name(), err)
+					continue
+				}
+				m = pm
+			}
+		} else if data, err := os.ReadFile(path); err == nil && strings.HasPrefix(string(data), "source: ") {
+			// a record left by sync; the zip source itself is listed below
+			continue
+		}
+		c.pkgs = append(c.pkgs, &candidate{m: m, source: "local", path: path, recipe: recipe})
+	}
+	readZipSources(func(url string, r *zip.Reader) {
+		for _, f := range r.File {
+			if !f.FileInfo().IsDir() || strings.Contains(strings.TrimSuffix(f.Name, "/"), "/") {
+				continue
+			}
+			folder := strings.TrimSuffix(f.Name, "/")
+			m := bareManifest(folder)
+			recipe := false
+			if data, err := readZipFile(r, folder+"/"+recipeName); err == nil {
+				rc, err := parseRecipe(data)
+				if err != nil {
+					fmt.Printf("porridge: skipping '%s' from %s: %v\n", folder, url, err)
+					continue
+				}
+				m, recipe = rc.m, true
+			} else if data, err := readZipFile(r, folder+"/"+manifestName); err == nil {
+				pm, err := parseManifest(data)
+				if err != nil {
+					fmt.Printf("porridge: skipping '%s' from %s: %v\n", folder, url, err)
+					continue
+				}
+				m = pm
+			}
+			c.pkgs = append(c.pkgs, &candidate{m: m, source: url, path: folder, recipe: recipe})
+		}
+	})
+	for _, src := range sourceList() {
+		if isZipSource(src) {
+			continue
+		}
+		pkgs, err := loadRepo(src, false)
+		if err != nil {
+			fmt.Printf("porridge: skipping source %s: %v\n", src, err)
+			continue
+		}
+		c.pkgs = append(c.pkgs, pkgs...)
+	}
+	return c
+}
+
+// readZipFile returns the contents of the file name in a zip
+func readZipFile(r *zip.Reader, name string) ([]byte, error) {
+	f, err := r.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// best returns the newest package that satisfies d: one with its name, or
+// when d has no version conditions, one that provides it
+func (c *catalog) best(d dependency) *candidate {
+	var found *candidate
+	for _, p := range c.pkgs {
+		if !satisfies(p.m, d) {
+			continue
+		}
+		if found == nil || (found.m.Name != d.name && p.m.Name == d.name) ||
+			(p.m.Name == found.m.Name && compareVersions(p.m.Version, found.m.Version) > 0) {
+			found = p
+		}
+	}
+	return found
+}
+
+// satisfies reports whether a package meets a dependency. What a package
+// provides has no version of its own, so it only meets unversioned ones.
+func satisfies(m *manifest, d dependency) bool {
+	if m.Name == d.name {
+		return d.allows(m.Version)
+	}
+	if len(d.conds) > 0 {
+		return false
+	}
+	for _, p := range m.Provides {
+		if p == d.name {
+			return true
+		}
+	}
+	return false
+}
+
+// installedManifests returns the manifest of every installed package
+func installedManifests() map[string]*manifest {
+	out := map[string]*manifest{}
+	files, _ := os.ReadDir(instDir)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") {
+			// a transaction's stage or backup
+			continue
+		}
+		m := bareManifest(f.Name())
+		if r := readRecord(f.Name()); r != nil {
+			m = r.Manifest
+		}
+		out[f.Name()] = m
+	}
+	return out
+}
+
+// resolver works out an install plan. Each package is picked once; its
+// dependencies are visited before it is added to the order, so the order
+// is one that can be installed front to back.
+type resolver struct {
+	cat       *catalog
+	installed map[string]*manifest
+	chosen    map[string]*candidate
+	visiting  map[string]bool
+	path      []string // the chain of packages being visited
+	order     []*candidate
+}
+
+// plan resolves the packages named, which may carry version conditions as
+// in "hello >= 1.2", and everything they depend on, leaving out what is
+// installed already. It fails on a missing package, a dependency cycle or
+// a conflict.
+func plan(cat *catalog, installed map[string]*manifest, names []string) ([]*candidate, error) {
+	r := &resolver{cat: cat, installed: installed, chosen: map[string]*candidate{}, visiting: map[string]bool{}}
+	for _, n := range names {
+		d, err := parseDep(n)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.visit(d); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.checkConflicts(); err != nil {
+		return nil, err
+	}
+	return r.order, nil
+}
+
+func (r *resolver) visit(d dependency) error {
+	for _, m := range r.installed {
+		if satisfies(m, d) {
+			return nil
+		}
+	}
+	if m, ok := r.installed[d.name]; ok {
+		return fmt.Errorf("%s%s is needed but %s-%s is installed", d, r.neededBy(), m.Name, m.Version)
+	}
+	for _, c := range r.chosen {
+		if !satisfies(c.m, d) {
+			continue
+		}
+		if r.visiting[c.m.Name] {
+			return fmt.Errorf("dependency cycle: %s -> %s", strings.Join(r.path, " -> "), c.m.Name)
+		}
+		return nil
+	}
+	if c, ok := r.chosen[d.name]; ok {
+		return fmt.Errorf("%s%s can't be met: %s is already wanted", d, r.neededBy(), c)
+	}
+	c := r.cat.best(d)
+	if c == nil {
+		return fmt.Errorf("no package satisfies %s%s", d, r.neededBy())
+	}
+	name := c.m.Name
+	r.chosen[name] = c
+	r.visiting[name] = true
+	r.path = append(r.path, name)
+	for _, dep := range c.m.Depends {
+		pd, err := parseDep(dep)
+		if err != nil {
+			return err
+		}
+		if err := r.visit(pd); err != nil {
+			return err
+		}
+	}
+	r.path = r.path[:len(r.path)-1]
+	r.visiting[name] = false
+	r.order = append(r.order, c)
+	return nil
+}
+
+// neededBy names the package whose dependencies are being visited
+func (r *resolver) neededBy() string {
+	if len(r.path) == 0 {
+		return ""
+	}
+	return " (needed by " + r.path[len(r.path)-1] + ")"
+}
+
+// checkConflicts refuses a plan in which a package conflicts with another,
+// installed or planned, as long as one of the two is new
+func (r *resolver) checkConflicts() error {
+	type pkg struct {
+		m   *manifest
+		new bool
+	}
+	var all []pkg
+	for _, m := range r.installed {
+		all = append(all, pkg{m, false})
+	}
+	for _, c := range r.order {
+		all = append(all, pkg{c.m, true})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].m.Name < all[j].m.Name })
+	for _, p := range all {
+		for _, s := range p.m.Conflicts {
+			d, err := parseDep(s)
+			if err != nil {
+				return err
+			}
+			for _, q := range all {
+				if q.m != p.m && (p.new || q.new) && satisfies(q.m, d) {
+					return fmt.Errorf("%s-%s conflicts with %s-%s", p.m.Name, p.m.Version, q.m.Name, q.m.Version)
+				}
+			}
+		}
+	}
+	return nil
+}
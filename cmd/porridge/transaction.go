@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A transaction installs and upgrades a run of packages. Each package is
+// extracted into a stage folder beside its final place and renamed into
+// it, and the version it replaces is renamed aside as a backup until the
+// whole transaction is done. The journal records how far each step got,
+// so one that is cut short can be rolled back or finished with porridge
+// recover.
+type transaction struct {
+	Op      string    `json:"op"`
+	Started time.Time `json:"started"`
+	Steps   []*step   `json:"steps"`
+}
+
+// step puts one package in place. State goes pending, staged (extracted
+// into the stage folder), swapped (moved into place) and done (recorded).
+type step struct {
+	Manifest *manifest `json:"manifest"`
+	Source   string    `json:"source"`
+	Path     string    `json:"path"`
+	Recipe   bool      `json:"recipe,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Explicit bool      `json:"explicit"`
+	Old      *record   `json:"old,omitempty"`
+	State    string    `json:"state"`
+}
+
+func newStep(c *candidate, explicit bool, old *record) *step {
+	return &step{Manifest: c.m, Source: c.source, Path: c.path, Recipe: c.recipe, SHA256: c.sum, Size: c.size,
+		Explicit: explicit, Old: old, State: "pending"}
+}
+
+func (s *step) candidate() *candidate {
+	return &candidate{m: s.Manifest, source: s.Source, path: s.Path, recipe: s.Recipe, sum: s.SHA256, size: s.Size}
+}
+
+func journalPath() string {
+	return filepath.Join(inRoot(stateDir), "journal.json")
+}
+
+func stagePath(name string) string {
+	return filepath.Join(instDir, ".new-"+name)
+}
+
+func backupPath(name string) string {
+	return filepath.Join(instDir, ".old-"+name)
+}
+
+// lockState takes the lock on the state dir, waiting for another porridge
+// that holds it. The lock goes when the returned func is called or the
+// process ends.
+func lockState() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(inRoot(stateDir), "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	return func() { f.Close() }, nil
+}
+
+// pendingTransaction reads the journal, returning nil if there is none
+func pendingTransaction() (*transaction, error) {
+	data, err := os.ReadFile(journalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var t transaction
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("bad journal %s: %v", journalPath(), err)
+	}
+	return &t, nil
+}
+
+// save writes the journal, replacing the old one in a single rename
+func (t *transaction) save() error {
+	data, err := json.MarshalIndent(t, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := journalPath() + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, journalPath())
+}
+
+// run carries out the steps not yet done. If one fails the whole
+// transaction is rolled back.
+func (t *transaction) run() error {
+	if err := t.save(); err != nil {
+		return err
+	}
+	var fetch []*candidate
+	for _, s := range t.Steps {
+		if s.State != "done" {
+			fetch = append(fetch, s.candidate())
+		}
+	}
+	prefetch(fetch)
+	for _, s := range t.Steps {
+		if s.State == "done" {
+			continue
+		}
+		if err := t.apply(s); err != nil {
+			err = fmt.Errorf("failed to install '%s': %v", s.Manifest.Name, err)
+			if rerr := t.rollback(); rerr != nil {
+				return fmt.Errorf("%v; rolling back failed too: %v", err, rerr)
+			}
+			return fmt.Errorf("%v; rolled back", err)
+		}
+		c := s.candidate()
+		switch {
+		case s.Old != nil:
+			fmt.Printf("porridge: upgraded '%s' %s -> %s\n", c.m.Name, s.Old.Manifest.Version, c.m.Version)
+		case c.source != "local":
+			fmt.Printf("porridge: installed '%s' %s from %s\n", c.m.Name, c.m.Version, c.source)
+		default:
+			fmt.Printf("porridge: installed '%s' %s\n", c.m.Name, c.m.Version)
+		}
+	}
+	return t.commit()
+}
+
+func (t *transaction) apply(s *step) error {
+	name := s.Manifest.Name
+	dest, stage := filepath.Join(instDir, name), stagePath(name)
+	os.RemoveAll(stage)
+	if err := stageCandidate(s.candidate(), stage); err != nil {
+		os.RemoveAll(stage)
+		return err
+	}
+	s.State = "staged"
+	if err := t.save(); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		if s.Old != nil {
+			for _, line := range s.Old.changedFiles() {
+				if strings.HasPrefix(line, "modified ") {
+					fmt.Printf("porridge: replacing %s\n", line)
+				}
+			}
+		}
+		if err := os.Rename(dest, backupPath(name)); err != nil {
+			return err
+		}
+		removeBinaries(backupPath(name), name)
+		os.Remove(recordPath(name))
+	}
+	if err := os.Rename(stage, dest); err != nil {
+		return err
+	}
+	s.State = "swapped"
+	if err := t.save(); err != nil {
+		return err
+	}
+	if err := recordInstall(s.Manifest, s.Source, s.Explicit); err != nil {
+		return err
+	}
+	s.State = "done"
+	return t.save()
+}
+
+// undo takes a step back to pending, putting back the version it replaced
+func (t *transaction) undo(s *step) {
+	name := s.Manifest.Name
+	dest, stage, backup := filepath.Join(instDir, name), stagePath(name), backupPath(name)
+	if _, err := os.Lstat(stage); err != nil && s.State == "staged" {
+		// cut short between the rename and the journal
+		s.State = "swapped"
+	}
+	os.RemoveAll(stage)
+	if s.State == "swapped" || s.State == "done" {
+		removeBinaries(dest, name)
+		os.Remove(recordPath(name))
+		os.RemoveAll(dest)
+	}
+	if _, err := os.Lstat(backup); err == nil {
+		if _, err := os.Lstat(dest); err != nil && os.Rename(backup, dest) == nil {
+			removeBinaries(dest, name)
+			installBinaries(name)
+			if s.Old != nil {
+				writeRecord(s.Old)
+			}
+		}
+	}
+	s.State = "pending"
+}
+
+// rollback undoes every step, last first, and ends the transaction
+func (t *transaction) rollback() error {
+	for i := len(t.Steps) - 1; i >= 0; i-- {
+		t.undo(t.Steps[i])
+		if err := t.save(); err != nil {
+			return err
+		}
+	}
+	return t.commit()
+}
+
+// commit deletes the backups and the journal
+func (t *transaction) commit() error {
+	for _, s := range t.Steps {
+		os.RemoveAll(backupPath(s.Manifest.Name))
+	}
+	return os.Remove(journalPath())
+}
+
+// stageCandidate extracts, copies or builds a package into stage
+func stageCandidate(c *candidate, stage string) error {
+	m := c.m
+	if c.recipe {
+		return buildPackage(c, stage)
+	}
+	if info, err := os.Stat(c.path); c.source == "local" && err == nil && !info.IsDir() {
+		data, err := os.ReadFile(c.path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(stage, data, 0644)
+	}
+	if c.source == "local" {
+		if err := copyTree(c.path, stage, m.installs); err != nil {
+			return err
+		}
+	} else {
+		data, err := archiveData(c)
+		if err != nil {
+			return err
+		}
+		os.MkdirAll(stage, 0755)
+		if err := extractArchive(c.source, data, c.path, stage, m.installs); err != nil {
+			return err
+		}
+	}
+	return m.checkFiles(stage)
+}
+
+// removeBinaries takes out of binDir what installBinaries put there for
+// the package whose files are now in tree
+func removeBinaries(tree, name string) {
+	files, _ := os.ReadDir(filepath.Join(tree, "bin"))
+	dir := inRoot(binDir)
+	for _, f := range files {
+		dest := filepath.Join(dir, f.Name())
+		want, _ := filepath.Rel(dir, filepath.Join(instDir, name, "bin", f.Name()))
+		if target, err := os.Readlink(dest); err == nil {
+			if target == want {
+				os.Remove(dest)
+			}
+			continue
+		}
+		a, err := os.ReadFile(dest)
+		if err != nil {
+			continue
+		}
+		if b, err := os.ReadFile(filepath.Join(tree, "bin", f.Name())); err == nil && bytes.Equal(a, b) {
+			os.Remove(dest)
+		}
+	}
+}
+
+// recoverCommand finishes the transaction that was cut short, or with
+// --rollback undoes it
+func recoverCommand(args []string) {
+	t, err := pendingTransaction()
+	if err != nil {
+		fmt.Printf("porridge: %v\n", err)
+		return
+	}
+	if t == nil {
+		fmt.Println("porridge: nothing to recover")
+		return
+	}
+	if len(args) == 1 && args[0] == "--rollback" {
+		if err := t.rollback(); err != nil {
+			fmt.Printf("porridge: %v\n", err)
+			return
+		}
+		fmt.Printf("porridge: rolled back the %s started %s\n", t.Op, t.Started.Local().Format(time.DateTime))
+		return
+	} else if len(args) > 0 {
+		fmt.Println("porridge: recover [--rollback]")
+		return
+	}
+	for _, s := range t.Steps {
+		if s.State != "done" && s.State != "pending" {
+			t.undo(s)
+		}
+	}
+	if err := t.run(); err != nil {
+		fmt.Printf("porridge: %v\n", err)
+		return
+	}
+	fmt.Printf("porridge: finished the %s started %s\n", t.Op, t.Started.Local().Format(time.DateTime))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// syncSources fetches the index of every source afresh, downloading the
+// zips that changed, and lists what each one offers
+func syncSources() {
+	for _, src := range sourceList() {
+		if !isZipSource(src) {
+			pkgs, err := loadRepo(src, true)
+			if err != nil {
+				fmt.Printf("porridge: failed to sync %s: %v\n", src, err)
+				continue
+			}
+			for _, c := range pkgs {
+				fmt.Printf("porridge: synced '%s' %s from %s\n", c.m.Name, c.m.Version, src)
+			}
+			continue
+		}
+		r, err := loadSource(src, true)
+		if err != nil {
+			fmt.Printf("porridge: failed to sync %s: %v\n", src, err)
+			continue
+		}
+		for _, name := range zipFolders(r) {
+			fmt.Printf("porridge: synced '%s' from %s\n", name, src)
+		}
+	}
+	fmt.Println("porridge: repo synced")
+}
+
+// zipFolders returns the top-level folders of a zip, which are its packages
+func zipFolders(r *zip.Reader) []string {
+	var out []string
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() && !strings.Contains(strings.TrimSuffix(f.Name, "/"), "/") {
+			out = append(out, strings.TrimSuffix(f.Name, "/"))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// outdated is an installed package and the newer version that replaces it
+type outdated struct {
+	old *record
+	new *candidate
+}
+
+// findOutdated returns the installed packages the catalog has newer
+// versions of, by name
+func findOutdated(cat *catalog, recs map[string]*record) []outdated {
+	var out []outdated
+	for name, r := range recs {
+		var newest *candidate
+		for _, p := range cat.pkgs {
+			if p.m.Name == name && compareVersions(p.m.Version, r.Manifest.Version) > 0 &&
+				(newest == nil || compareVersions(p.m.Version, newest.m.Version) > 0) {
+				newest = p
+			}
+		}
+		if newest != nil {
+			out = append(out, outdated{r, newest})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].old.Manifest.Name < out[j].old.Manifest.Name })
+	return out
+}
+
+// updateCommand reports the installed packages that have newer versions
+func updateCommand() {
+	list := findOutdated(loadCatalog(), allRecords())
+	if len(list) == 0 {
+		fmt.Println("porridge: all packages are up to date")
+		return
+	}
+	for _, o := range list {
+		fmt.Printf("%s %s -> %s\n", o.old.Manifest.Name, o.old.Manifest.Version, o.new.m.Version)
+	}
+	fmt.Printf("porridge: %d packages can be upgraded; run 'porridge upgrade'\n", len(list))
+}
+
+// upgradeCommand upgrades the packages named, or everything outdated, after
+// showing the plan and asking. -y doesn't ask. A package installed from a
+// URL is fetched from it again.
+func upgradeCommand(args []string) {
+	yes := false
+	var names []string
+	for _, a := range args {
+		if a == "-y" {
+			yes = true
+		} else if !validName(a) {
+			fmt.Printf("porridge: bad package name '%s'\n", a)
+			return
+		} else {
+			names = append(names, a)
+		}
+	}
+	recs := allRecords()
+	cat := loadCatalog()
+	list := findOutdated(cat, recs)
+	if len(names) > 0 {
+		var picked []outdated
+	next:
+		for _, name := range names {
+			r, ok := recs[name]
+			if !ok {
+				fmt.Printf("porridge: package '%s' not installed\n", name)
+				return
+			}
+			for _, o := range list {
+				if o.old == r {
+					picked = append(picked, o)
+					continue next
+				}
+			}
+			if r.Source != "local" && !cat.offers(name) {
+				upgradeFromURL(r)
+				continue
+			}
+			fmt.Printf("porridge: package '%s' is up to date\n", name)
+		}
+		list = picked
+	}
+	if len(list) == 0 {
+		if len(names) == 0 {
+			fmt.Println("porridge: all packages are up to date")
+		}
+		return
+	}
+	installed := installedManifests()
+	var want []string
+	for _, o := range list {
+		delete(installed, o.old.Manifest.Name)
+		want = append(want, o.new.m.Name+" = "+o.new.m.Version)
+	}
+	order, err := plan(cat, installed, want)
+	if err != nil {
+		fmt.Printf("porridge: %v\n", err)
+		return
+	}
+	fmt.Println("porridge: upgrade plan:")
+	for _, c := range order {
+		if r, ok := recs[c.m.Name]; ok {
+			fmt.Printf("  %s %s -> %s\n", c.m.Name, r.Manifest.Version, c.m.Version)
+		} else {
+			fmt.Printf("  %s %s (new dependency)\n", c.m.Name, c.m.Version)
+		}
+	}
+	if !yes && !confirm("porridge: proceed? [y/N] ") {
+		fmt.Println("porridge: upgrade cancelled")
+		return
+	}
+	t := &transaction{Op: "upgrade", Started: time.Now().UTC()}
+	for _, c := range order {
+		if r, ok := recs[c.m.Name]; ok {
+			t.Steps = append(t.Steps, newStep(c, r.Explicit, r))
+		} else {
+			t.Steps = append(t.Steps, newStep(c, false, nil))
+		}
+	}
+	if err := t.run(); err != nil {
+		fmt.Printf("porridge: %v\n", err)
+	}
+}
+
+// offers reports whether the catalog has any package called name
+func (c *catalog) offers(name string) bool {
+	for _, p := range c.pkgs {
+		if p.m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeFromURL downloads a package installed from a URL again
+func upgradeFromURL(r *record) {
+	name := r.Manifest.Name
+	data, err := fetchSigned(r.Source)
+	if err != nil {
+		fmt.Printf("porridge: failed to download '%s': %v\n", r.Source, err)
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(instDir, name), data, 0644); err != nil {
+		fmt.Printf("porridge: %v\n", err)
+		return
+	}
+	if err := recordInstall(r.Manifest, r.Source, r.Explicit); err != nil {
+		fmt.Printf("porridge: %v\n", err)
+		return
+	}
+	fmt.Printf("porridge: upgraded '%s'\n", name)
+}
+
+// confirm asks a yes or no question on the terminal
+func confirm(prompt string) bool {
+	fmt.Print(prompt)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	line = strings.ToLower(strings.TrimSpace(line))
+	return line == "y" || line == "yes"
+}
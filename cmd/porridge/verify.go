@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Archives are checked before anything is read from them, against the
+// SHA-256 the index.json of their source gives (see repo.go). Each source
+// zip sits next to one like
+//
+//	{"archives": {"pkgs.zip": {"sha256": "9f86d0..."}}}
+//
+// and the index may be signed with an ed25519 key, in index.json.sig as
+// base64. A signature must come from one of the trusted keys in keysDir.
+// Once any key is trusted, everything must be signed; until then an
+// unsigned index is believed over https or from a file:// URL. Single
+// files installed from a URL are checked the same way against URL.sig.
+const (
+	indexName  = "index.json"
+	sigSuffix  = ".sig"
+	keySuffix  = ".pub"
+	privSuffix = ".key"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// trustedKeys reads the public keys in keysDir, by name
+func trustedKeys() (map[string]ed25519.PublicKey, error) {
+	keys := map[string]ed25519.PublicKey{}
+	files, err := os.ReadDir(keysDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), keySuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(keysDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		k, err := decodeKey(data, ed25519.PublicKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", f.Name(), err)
+		}
+		keys[strings.TrimSuffix(f.Name(), keySuffix)] = ed25519.PublicKey(k)
+	}
+	return keys, nil
+}
+
+// decodeKey reads a base64 key or signature of size bytes
+func decodeKey(data []byte, size int) ([]byte, error) {
+	k, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != size {
+		return nil, fmt.Errorf("want %d bytes, got %d", size, len(k))
+	}
+	return k, nil
+}
+
+// checkSignature verifies a base64 signature of data against the trusted
+// keys and returns the name of the key that made it
+func checkSignature(data, sig []byte) (string, error) {
+	s, err := decodeKey(sig, ed25519.SignatureSize)
+	if err != nil {
+		return "", fmt.Errorf("bad signature: %v", err)
+	}
+	keys, err := trustedKeys()
+	if err != nil {
+		return "", err
+	}
+	for name, k := range keys {
+		if ed25519.Verify(k, data, s) {
+			return name, nil
+		}
+	}
+	return "", errors.New("signature is not from a trusted key")
+}
+
+// fetchSigned downloads a payload and its signature, if it has one. The
+// signature must check out. Without one the payload is refused if any key
+// is trusted, and otherwise believed only over https or from a local file.
+func fetchSigned(url string) ([]byte, error) {
+	data, err := downloadFile(url)
+	if err != nil {
+		return nil, err
+	}
+	sig, serr := downloadFile(url + sigSuffix)
+	if serr == nil {
+		if _, err := checkSignature(data, sig); err != nil {
+			return nil, fmt.Errorf("%s: %v", url, err)
+		}
+		return data, nil
+	}
+	keys, err := trustedKeys()
+	switch {
+	case err != nil:
+		return nil, err
+	case len(keys) > 0:
+		return nil, fmt.Errorf("refusing unsigned %s, as keys are trusted", url)
+	case !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "file://"):
+		return nil, fmt.Errorf("refusing unsigned %s over plain http", url)
+	}
+	return data, nil
+}
+
+// indexURL is where the index of the source at src lives
+func indexURL(src string) string {
+	return src[:strings.LastIndex(src, "/")+1] + indexName
+}
+
+// cachedIndexPath is where the index of a source is kept in the cache
+func cachedIndexPath(src string) string {
+	return filepath.Join(cacheDir, filepath.Base(src)+"."+indexName)
+}
+
+// fetchIndex downloads the index of a source into the cache, checking its
+// signature
+func fetchIndex(src string) error {
+	data, err := fetchSigned(indexURL(src))
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(cacheDir, 0755)
+	return os.WriteFile(cachedIndexPath(src), data, 0644)
+}
+
+// verifyArchive checks a source's archive against the checksum in the
+// cached index of the source
+func verifyArchive(src string, data []byte) error {
+	raw, err := os.ReadFile(cachedIndexPath(src))
+	if err != nil {
+		return fmt.Errorf("no verified index for %s", src)
+	}
+	var idx repoIndex
+	if err := json.Unmarshal(raw, &idx); err != nil {
+		return fmt.Errorf("%s: %v", indexURL(src), err)
+	}
+	a, ok := idx.Archives[filepath.Base(src)]
+	if !ok || a.SHA256 == "" {
+		return fmt.Errorf("%s has no checksum for %s", indexURL(src), filepath.Base(src))
+	}
+	if got := sha256Hex(data); !strings.EqualFold(got, a.SHA256) {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", src, got, a.SHA256)
+	}
+	return nil
+}
+
+// keyCommand handles porridge key: managing the trusted keys, and making
+// and using signing keys for publishing a source
+func keyCommand(args []string) {
+	usage := "porridge: key add NAME FILE | list | remove NAME | gen FILE | sign KEYFILE FILE"
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		keys, err := trustedKeys()
+		if err != nil {
+			fmt.Printf("porridge: %v\n", err)
+			return
+		}
+		var names []string
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s %s\n", name, sha256Hex(keys[name])[:16])
+		}
+	case args[0] == "add" && len(args) == 3:
+		data, err := os.ReadFile(args[2])
+		if err != nil {
+			fmt.Printf("porridge: %v\n", err)
+			return
+		}
+		if _, err := decodeKey(data, ed25519.PublicKeySize); err != nil {
+			fmt.Printf("porridge: '%s' is not an ed25519 public key: %v\n", args[2], err)
+			return
+		}
+		if !validKeyName(args[1]) {
+			fmt.Printf("porridge: bad key name '%s'\n", args[1])
+			return
+		}
+		if err := os.MkdirAll(keysDir, 0755); err != nil {
+			fmt.Printf("porridge: %v\n", err)
+			return
+		}
+		if err := os.WriteFile(filepath.Join(keysDir, args[1]+keySuffix), data, 0644); err != nil {
+			fmt.Printf("porridge: %v\n", err)
+			return
+		}
+		fmt.Printf("porridge: trusting key '%s'\n", args[1])
+	case args[0] == "remove" && len(args) == 2:
+		if !validKeyName(args[1]) {
+			fmt.Printf("porridge: bad key name '%s'\n", args[1])
+			return
+		}
+		if err := os.Remove(filepath.Join(keysDir, args[1]+keySuffix)); err != nil {
+			fmt.Printf("porridge: no key '%s'\n", args[1])
+			return
+		}
+		fmt.Printf("porridge: removed key '%s'\n", args[1])
+	case args[0] == "gen" && len(args) == 2:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fmt.Printf("porridge: %v\n", err)
+			return
+		}
+		name := strings.TrimSuffix(args[1], privSuffix)
+		if err := os.WriteFile(name+privSuffix, []byte(base64.StdEncoding.EncodeToString(priv)+"\n"), 0600); err != nil {
+			fmt.Printf("porridge: %v\n", err)
+			return
+		}
+		os.WriteFile(name+keySuffix, []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644)
+		fmt.Printf("porridge: wrote %s%s and %s%s\n", name, privSuffix, name, keySuffix)
+	case args[0] == "sign" && len(args) == 3:
+		if err := signFile(args[1], args[2]); err != nil {
+			fmt.Printf("porridge: %v\n", err)
+			return
+		}
+		fmt.Printf("porridge: signed '%s'\n", args[2])
+	default:
+		fmt.Println(usage)
+	}
+}
+
+// validKeyName reports whether a key name is fit to be a file name in
+// keysDir
+func validKeyName(name string) bool {
+	return name != "" && name[0] != '.' && !strings.ContainsAny(name, "/\\")
+}
+
+// signFile writes FILE.sig, signing FILE with the private key in keyFile
+func signFile(keyFile, file string) error {
+	raw, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	priv, err := decodeKey(raw, ed25519.PrivateKeySize)
+	if err != nil {
+		return fmt.Errorf("'%s' is not an ed25519 private key: %v", keyFile, err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	sig := ed25519.Sign(ed25519.PrivateKey(priv), data)
+	return os.WriteFile(file+sigSuffix, []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0644)
+}
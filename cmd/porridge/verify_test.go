@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testRoot points porridge at a fresh root with one trusted key, returning
+// the private half of it
+func testRoot(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	old := [...]string{rootDir, stateDir, keysDir}
+	t.Cleanup(func() {
+		rootDir, stateDir, keysDir = old[0], old[1], old[2]
+		setPaths()
+	})
+	rootDir, stateDir = t.TempDir(), "/var/lib/porridge"
+	keysDir = filepath.Join(t.TempDir(), "keys")
+	if err := setPaths(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(instDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(keysDir, 0755)
+	if err := os.WriteFile(filepath.Join(keysDir, "test"+keySuffix), []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+// testPayload writes a file to install and returns its file:// URL
+func testPayload(t *testing.T) (string, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hello")
+	if err := os.WriteFile(path, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, "file://" + filepath.ToSlash(path)
+}
+
+func TestInstallUnsignedWithTrustedKey(t *testing.T) {
+	testRoot(t)
+	_, url := testPayload(t)
+	if err := installURL(url); err == nil {
+		t.Fatal("an unsigned payload was installed while a key is trusted")
+	}
+	if _, err := os.Lstat(filepath.Join(instDir, "hello")); !os.IsNotExist(err) {
+		t.Errorf("refused payload left in %s: %v", instDir, err)
+	}
+	if readRecord("hello") != nil {
+		t.Error("refused payload was recorded")
+	}
+}
+
+func TestInstallSignedWithTrustedKey(t *testing.T) {
+	priv := testRoot(t)
+	path, url := testPayload(t)
+	data, _ := os.ReadFile(path)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data))
+	if err := os.WriteFile(path+sigSuffix, []byte(sig+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := installURL(url); err != nil {
+		t.Fatal(err)
+	}
+	if readRecord("hello") == nil {
+		t.Error("signed payload was not recorded")
+	}
+}
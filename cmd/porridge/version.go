@@ -0,0 +1,172 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Versions are ordered the way Gentoo and semver order them, which agree
+// on the common cases:
+//
+//	1.2 < 1.2.0 < 1.2.1 < 1.2.1a < 1.10
+//	1.0_alpha < 1.0_beta2 < 1.0_pre < 1.0_rc1 < 1.0 < 1.0-r1 < 1.0_p1
+//	1.0.0-alpha < 1.0.0-alpha.1 < 1.0.0-beta < 1.0.0-rc.1 < 1.0.0
+//
+// Semver build metadata (+...) is ignored. Anything that doesn't look like
+// either falls back to comparing dotted components one by one.
+var (
+	versionMain = regexp.MustCompile(`^(\d+(?:\.\d+)*)([a-z]?)`)
+	versionRev  = regexp.MustCompile(`-r(\d+)$`)
+	gentooSufx  = regexp.MustCompile(`^_(alpha|beta|pre|rc|p)(\d*)`)
+)
+
+// suffixRank orders the kinds of suffix; a release without one ranks 0
+var suffixRank = map[string]int{"alpha": -4, "beta": -3, "pre": -2, "rc": -1, "p": 1}
+
+type version struct {
+	nums     []int
+	letter   string
+	suffixes []versionSuffix
+	rev      int
+}
+
+// versionSuffix is a Gentoo _alpha2-style suffix or a semver pre-release.
+// A pre-release that isn't alpha, beta, pre or rc ranks below all of
+// them and is told apart by its text.
+type versionSuffix struct {
+	rank int
+	num  int
+	text string
+}
+
+// parseVersion splits a version into its parts, failing if it is neither
+// Gentoo nor semver
+func parseVersion(s string) (version, bool) {
+	var v version
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if m := versionRev.FindStringSubmatchIndex(s); m != nil {
+		v.rev, _ = strconv.Atoi(s[m[2]:m[3]])
+		s = s[:m[0]]
+	}
+	m := versionMain.FindStringSubmatch(s)
+	if m == nil {
+		return v, false
+	}
+	for _, n := range strings.Split(m[1], ".") {
+		x, err := strconv.Atoi(n)
+		if err != nil {
+			return v, false
+		}
+		v.nums = append(v.nums, x)
+	}
+	v.letter = m[2]
+	rest := s[len(m[0]):]
+	if strings.HasPrefix(rest, "-") && len(rest) > 1 {
+		v.suffixes = append(v.suffixes, semverPre(rest[1:]))
+		return v, true
+	}
+	for rest != "" {
+		g := gentooSufx.FindStringSubmatch(rest)
+		if g == nil {
+			return v, false
+		}
+		n, _ := strconv.Atoi(g[2])
+		v.suffixes = append(v.suffixes, versionSuffix{rank: suffixRank[g[1]], num: n})
+		rest = rest[len(g[0]):]
+	}
+	return v, true
+}
+
+// semverPre reads a pre-release such as rc.1, beta2 or build.5
+func semverPre(s string) versionSuffix {
+	word := strings.TrimRightFunc(strings.SplitN(s, ".", 2)[0], isDigit)
+	sf := versionSuffix{rank: -5, text: s}
+	if r, ok := suffixRank[word]; ok && r < 0 {
+		sf.rank, sf.text = r, ""
+	}
+	if i := strings.IndexFunc(s, isDigit); i >= 0 {
+		j := i
+		for j < len(s) && isDigit(rune(s[j])) {
+			j++
+		}
+		sf.num, _ = strconv.Atoi(s[i:j])
+	}
+	return sf
+}
+
+func isDigit(r rune) bool { return r >= '0' && r <= '9' }
+
+// compareVersions returns -1, 0 or 1 as a is older than, the same as or
+// newer than b
+func compareVersions(a, b string) int {
+	va, oka := parseVersion(a)
+	vb, okb := parseVersion(b)
+	if !oka || !okb {
+		return compareLoose(a, b)
+	}
+	for i := 0; i < len(va.nums) && i < len(vb.nums); i++ {
+		if c := cmpInt(va.nums[i], vb.nums[i]); c != 0 {
+			return c
+		}
+	}
+	if c := cmpInt(len(va.nums), len(vb.nums)); c != 0 {
+		return c
+	}
+	if c := strings.Compare(va.letter, vb.letter); c != 0 {
+		return c
+	}
+	for i := 0; i < len(va.suffixes) || i < len(vb.suffixes); i++ {
+		var x, y versionSuffix
+		if i < len(va.suffixes) {
+			x = va.suffixes[i]
+		}
+		if i < len(vb.suffixes) {
+			y = vb.suffixes[i]
+		}
+		if c := cmpInt(x.rank, y.rank); c != 0 {
+			return c
+		}
+		if c := strings.Compare(x.text, y.text); c != 0 {
+			return c
+		}
+		if c := cmpInt(x.num, y.num); c != 0 {
+			return c
+		}
+	}
+	return cmpInt(va.rev, vb.rev)
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareLoose orders versions of no known form: dotted components compare
+// as numbers when both are numeric and as text otherwise, and a version
+// that runs out of components first is the older
+func compareLoose(a, b string) int {
+	as, bs := strings.FieldsFunc(a, isVersionSep), strings.FieldsFunc(b, isVersionSep)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, errx := strconv.Atoi(as[i])
+		y, erry := strconv.Atoi(bs[i])
+		switch {
+		case errx == nil && erry == nil && x != y:
+			return cmpInt(x, y)
+		case (errx != nil || erry != nil) && as[i] != bs[i]:
+			return strings.Compare(as[i], bs[i])
+		}
+	}
+	return cmpInt(len(as), len(bs))
+}
+
+func isVersionSep(r rune) bool {
+	return r == '.' || r == '-' || r == '_'
+}